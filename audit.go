@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// With [audit] file set, every mutating request (see isWriteRequest) and
+// every admin request, allowed or not, is appended to the audit log as a
+// JSON line: who (principal and address), what (route, command and the
+// stored keys, shown as [audit] keys says) and the status. Values are never
+// logged. The file is rotated to file.1, file.2, ... once it reaches
+// maxsize megabytes, keeping maxfiles old files.
+const (
+	defaultAuditMaxSize  = 100
+	defaultAuditMaxFiles = 10
+)
+
+type auditInfo struct {
+	File string
+	// Megabytes before rotating.
+	MaxSize int
+	// Rotated files kept.
+	MaxFiles int
+	// "hash" (default), "plain" or "redact".
+	Keys string
+}
+
+type auditRecord struct {
+	Time      string   `json:"time"`
+	RequestID string   `json:"request_id"`
+	Principal string   `json:"principal"`
+	Remote    string   `json:"remote"`
+	Method    string   `json:"method"`
+	Route     string   `json:"route"`
+	Command   string   `json:"command"`
+	Keys      []string `json:"keys,omitempty"`
+	Status    int      `json:"status"`
+}
+
+type auditor struct {
+	info auditInfo
+	out  *rotatingFile
+}
+
+func newAuditor(info auditInfo) (*auditor, error) {
+	switch info.Keys {
+	case "":
+		info.Keys = "hash"
+	case "hash", "plain", "redact":
+	default:
+		return nil, fmt.Errorf("bad keys '%s'", info.Keys)
+	}
+	if info.MaxSize <= 0 {
+		info.MaxSize = defaultAuditMaxSize
+	}
+	if info.MaxFiles <= 0 {
+		info.MaxFiles = defaultAuditMaxFiles
+	}
+	out, err := openRotatingFile(info.File, int64(info.MaxSize)<<20, info.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &auditor{info: info, out: out}, nil
+}
+
+func (a *auditor) write(rec auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		logError("audit write", "err", err)
+	}
+}
+
+// auditEntry follows an audited request through authenticate and
+// namespaceHandler, which pass on new requests.
+type auditEntry struct {
+	r *http.Request
+}
+
+type auditKey struct{}
+
+// noteAudit makes r, which carries the principal or the rewritten keys,
+// the request audit records.
+func noteAudit(r *http.Request) {
+	if e, ok := r.Context().Value(auditKey{}).(*auditEntry); ok {
+		e.r = r
+	}
+}
+
+// audit records the requests of router that change data or use admin
+// endpoints, pprof included. It runs before authentication so refused
+// requests are recorded too, with the principal and the stored keys when
+// they got that far.
+func (this *CacheRequestHandler) audit(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := this.auditor
+		_, path, _ := nsPath(r.URL.Path)
+		cmd := commandOf(path)
+		if a == nil || !(isWriteRequest(router, r) || adminCommands[cmd]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Parsed here so the requests passed on share the form.
+		r.ParseMultipartForm(32 << 20)
+		entry := &auditEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), auditKey{}, entry))
+		entry.r = r
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		last := entry.r
+		var match mux.RouteMatch
+		vars := map[string]string{}
+		if router.Match(last, &match) {
+			vars = match.Vars
+		}
+		keys := requestKeys(last, vars)
+		for i, k := range keys {
+			keys[i] = redactKey(a.info.Keys, k)
+		}
+		principal, ok := requestPrincipal(last)
+		if !ok {
+			principal = "-"
+		}
+		a.write(auditRecord{
+			Time:      time.Now().UTC().Format(time.RFC3339Nano),
+			RequestID: requestID(r),
+			Principal: principal,
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			Route:     routeOf(router, last),
+			Command:   cmd,
+			Keys:      keys,
+			Status:    sw.code,
+		})
+	})
+}
+
+// rotatingFile appends to path, moving it aside once it reaches max_size.
+type rotatingFile struct {
+	mu        sync.Mutex
+	path      string
+	max_size  int64
+	max_files int
+	f         *os.File
+	size      int64
+}
+
+func openRotatingFile(path string, max_size int64, max_files int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, max_size: max_size, max_files: max_files}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, st.Size()
+	return nil
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and path to
+// path.1.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	os.Remove(rf.path + "." + strconv.Itoa(rf.max_files))
+	for i := rf.max_files - 1; i >= 1; i-- {
+		os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil && rf.size > 0 && rf.size+int64(len(p)) > rf.max_size {
+		if err := rf.rotate(); err != nil {
+			logError("audit rotate", "err", err)
+		}
+	}
+	if rf.f == nil {
+		// A failed rotation leaves no file open; keep trying.
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
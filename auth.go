@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Requests authenticate with a static API key (X-API-Key), a JWT
+// (Authorization: Bearer, or access_token in the query for websocket
+// clients) verified against a local JWKS file, or a client certificate.
+// Each resolves to a principal whose [acl.<principal>] says which key prefixes it may read
+// and write, which commands (the first path segment: string, hash, queue,
+// ...) it may use and whether it may use the admin endpoints. [acl."*"]
+// applies to principals without their own entry.
+const jwtLeeway = 60 * time.Second
+
+// Admin endpoints by first path segment; /debug is pprof.
+var adminCommands = map[string]bool{
+	"server":      true,
+	"sync":        true,
+	"db":          true,
+	"encryption":  true,
+	"compression": true,
+	"namespace":   true,
+	"group":       true,
+	"metrics":     true,
+	"debug":       true,
+}
+
+type authInfo struct {
+	// JWKS file verifying bearer JWTs; reloaded when a kid is not found.
+	Jwks string
+	// Required iss and aud claims, when set.
+	Issuer   string
+	Audience string
+	// Claim naming the principal; defaults to "sub".
+	Claim string
+	// Principal of requests without credentials; empty refuses them.
+	Anonymous string
+}
+
+type apiKeyInfo struct {
+	// Hex SHA-256 of the key, so the config holds no secret.
+	Sha256 string
+	// Defaults to the [apikey.<name>] name.
+	Principal string
+}
+
+type aclInfo struct {
+	// Key prefixes; "*" is every key. Write implies read. Queue, lock and
+	// the other subsystem keys match by their name: queue:jobs:ready as
+	// jobs:ready.
+	Read  []string
+	Write []string
+	// Commands allowed; empty allows all but the admin ones.
+	Commands []string
+	Admin    bool
+}
+
+type authenticator struct {
+	info    authInfo
+	apikeys map[string]string
+	acls    map[string]aclInfo
+	// Verified client certificates authenticate, see listenInfo.
+	cert_auth       bool
+	cert_principals map[string]string
+
+	mu    sync.RWMutex
+	jwks  map[string]crypto.PublicKey
+	mtime time.Time
+}
+
+type principalKey struct{}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newAuthenticator(info authInfo, apikeys map[string]apiKeyInfo, acls map[string]aclInfo) (*authenticator, error) {
+	if info.Claim == "" {
+		info.Claim = "sub"
+	}
+	a := &authenticator{info: info, apikeys: make(map[string]string), acls: acls}
+	for name, k := range apikeys {
+		sum, err := hex.DecodeString(k.Sha256)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("apikey %s: sha256 is not a hex SHA-256", name)
+		}
+		if k.Principal == "" {
+			k.Principal = name
+		}
+		a.apikeys[strings.ToLower(k.Sha256)] = k.Principal
+	}
+	if info.Jwks != "" {
+		if err := a.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func b64url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func parseJWK(k jwk) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64url(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64url(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := b64url(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64url(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// reload reads the JWKS file if it changed since the last load.
+func (a *authenticator) reload() error {
+	st, err := os.Stat(a.info.Jwks)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	unchanged := a.jwks != nil && st.ModTime().Equal(a.mtime)
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.info.Jwks)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := parseJWK(k)
+		if err != nil {
+			return fmt.Errorf("jwks key '%s': %s", k.Kid, err.Error())
+		}
+		keys[k.Kid] = pub
+	}
+
+	a.mu.Lock()
+	a.jwks, a.mtime = keys, st.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *authenticator) jwtKey(kid string) crypto.PublicKey {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if key, ok := a.jwks[kid]; ok {
+		return key
+	}
+	// A token without kid matches a single key set.
+	if kid == "" && len(a.jwks) == 1 {
+		for _, key := range a.jwks {
+			return key
+		}
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, input, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg '%s'", alg)
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("alg '%s' does not match an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return fmt.Errorf("bad ECDSA signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key")
+}
+
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	f, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func hasAudience(claims map[string]interface{}, aud string) bool {
+	switch v := claims["aud"].(type) {
+	case string:
+		return v == aud
+	case []interface{}:
+		for _, a := range v {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWT checks a token and returns its principal.
+func (a *authenticator) verifyJWT(token string) (string, error) {
+	if a.info.Jwks == "" {
+		return "", fmt.Errorf("jwt not accepted")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed jwt")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	claims := map[string]interface{}{}
+	for i, v := range []interface{}{&header, &claims} {
+		b, err := b64url(parts[i])
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			return "", err
+		}
+	}
+	sig, err := b64url(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	key := a.jwtKey(header.Kid)
+	if key == nil {
+		a.reload()
+		if key = a.jwtKey(header.Kid); key == nil {
+			return "", fmt.Errorf("unknown kid '%s'", header.Kid)
+		}
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	exp, ok := claimTime(claims, "exp")
+	if !ok || now.After(exp.Add(jwtLeeway)) {
+		return "", fmt.Errorf("jwt expired")
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return "", fmt.Errorf("jwt not yet valid")
+	}
+	if a.info.Issuer != "" && claims["iss"] != a.info.Issuer {
+		return "", fmt.Errorf("bad issuer")
+	}
+	if a.info.Audience != "" && !hasAudience(claims, a.info.Audience) {
+		return "", fmt.Errorf("bad audience")
+	}
+	principal, ok := claims[a.info.Claim].(string)
+	if !ok || principal == "" {
+		return "", fmt.Errorf("jwt has no '%s' claim", a.info.Claim)
+	}
+	return principal, nil
+}
+
+// certPrincipal maps a verified client certificate to its principal.
+func (a *authenticator) certPrincipal(r *http.Request) string {
+	if !a.cert_auth || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, n := range append(names, cert.EmailAddresses...) {
+		if p, ok := a.cert_principals[n]; ok {
+			return p
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// principal returns who made the request; "" with a nil error means no
+// credentials were sent. An API key or JWT takes precedence over a client
+// certificate.
+func (a *authenticator) principal(r *http.Request) (string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		if p, ok := a.apikeys[hex.EncodeToString(sum[:])]; ok {
+			return p, nil
+		}
+		return "", fmt.Errorf("unknown api key")
+	}
+	token := ""
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(h[len("Bearer "):])
+	} else {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return a.certPrincipal(r), nil
+	}
+	return a.verifyJWT(token)
+}
+
+func (a *authenticator) acl(principal string) (aclInfo, bool) {
+	if acl, ok := a.acls[principal]; ok {
+		return acl, true
+	}
+	acl, ok := a.acls["*"]
+	return acl, ok
+}
+
+func requestPrincipal(r *http.Request) (string, bool) {
+	p, ok := r.Context().Value(principalKey{}).(string)
+	return p, ok
+}
+
+func commandOf(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// authenticate resolves the principal of every request and keeps
+// unauthenticated ones out; next sees the principal in the context.
+func (this *CacheRequestHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := this.auth
+		if a == nil || r.URL.Path == "/info" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := a.principal(r)
+		if err == nil && p == "" {
+			p = a.info.Anonymous
+		}
+		if err != nil || p == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			replyStatus(w, http.StatusUnauthorized)
+			if err == nil {
+				err = fmt.Errorf("credentials required")
+			}
+			ErrorExcu(w, err)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		noteAudit(r)
+
+		// pprof is served outside the router.
+		if commandOf(r.URL.Path) == "debug" {
+			if acl, ok := a.acl(p); !ok || !acl.Admin {
+				replyStatus(w, http.StatusForbidden)
+				ErrorExcu(w, fmt.Errorf("%s may not use debug", p))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func matchPrefixes(prefixes []string, key string) bool {
+	for _, p := range prefixes {
+		if p == "*" || strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Routes that only read, by method and path template. Every other route
+// is a write, GET ones included: the pops, and XREADGROUP, which moves
+// entries to the pending list.
+var readRoutes = map[string]bool{
+	"GET /info":         true,
+	"GET /key":          true,
+	"GET /string":       true,
+	"GET /string/{key}": true,
+	"GET /json/{key}":   true,
+	"GET /hash":         true,
+	"GET /set/ops":      true,
+	"GET /set":          true,
+	"GET /zset":         true,
+	"GET /geo/{key}":    true,
+	"GET /stream/{key}": true,
+	"GET /stream/{key}/group/{group}/pending": true,
+	"GET /queue/{name}":                       true,
+	"GET /queue/{name}/dead":                  true,
+	"GET /schedule/{name}":                    true,
+	"GET /schedule/{name}/{id}":               true,
+	"GET /lock/{name}":                        true,
+	"GET /ratelimit/{bucket}":                 true,
+	"GET /leaderboard/{name}":                 true,
+	"GET /leaderboard/{name}/member/{member}": true,
+	"GET /hll":                true,
+	"GET /bitmap/{key}":       true,
+	"GET /bloom/{name}":       true,
+	"GET /bloom/{name}/check": true,
+	"GET /compression":        true,
+	"GET /encryption":         true,
+	"GET /namespace":          true,
+	"GET /metrics":            true,
+	"GET /subscribe":          true,
+	"GET /db":                 true,
+	"GET /server":             true,
+	"GET /group":              true,
+}
+
+// isWriteRoute reports whether a request for route with method may change
+// data.
+func isWriteRoute(method string, route *mux.Route) bool {
+	tpl, err := route.GetPathTemplate()
+	return err != nil || !readRoutes[method+" "+tpl]
+}
+
+// isWriteRequest reports whether r may change data, by the route of router
+// it matches past a /ns/{ns} prefix. Requests matching no route go by
+// their method.
+func isWriteRequest(router *mux.Router, r *http.Request) bool {
+	if _, path, _ := nsPath(r.URL.Path); path != r.URL.Path {
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return r.Method != "GET" && r.Method != "HEAD"
+	}
+	return isWriteRoute(r.Method, match.Route)
+}
+
+// requestKeys returns the keys request r names in its route variables vars
+// and its form.
+func requestKeys(r *http.Request, vars map[string]string) []string {
+	keys := []string{}
+	for _, v := range nsPathVars {
+		if k, ok := vars[v]; ok {
+			keys = append(keys, k)
+		}
+	}
+	for _, f := range nsFormFields {
+		keys = append(keys, r.Form[f]...)
+	}
+	return keys
+}
+
+// forbidden returns why the principal may not make request r for route,
+// whose variables are vars; "" allows it.
+func (a *authenticator) forbidden(r *http.Request, principal string, route *mux.Route, vars map[string]string) string {
+	acl, ok := a.acl(principal)
+	if !ok {
+		return principal + " has no acl"
+	}
+	cmd := commandOf(r.URL.Path)
+	if adminCommands[cmd] {
+		if !acl.Admin {
+			return principal + " may not use " + cmd
+		}
+		return ""
+	}
+	if len(acl.Commands) > 0 && !inStrings(acl.Commands, cmd) {
+		return principal + " may not use " + cmd
+	}
+
+	write := route != nil && isWriteRoute(r.Method, route)
+	for _, k := range requestKeys(r, vars) {
+		// Subsystem keys (queue:<name>:ready, ...) go by their name.
+		owner := ownerKey(k)
+		if matchPrefixes(acl.Write, owner) || (!write && matchPrefixes(acl.Read, owner)) {
+			continue
+		}
+		if write {
+			return principal + " may not write " + k
+		}
+		return principal + " may not read " + k
+	}
+	return ""
+}
+
+// authorize applies the principal's acl to requests for router, after
+// any namespace rewrite.
+func (this *CacheRequestHandler) authorize(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := requestPrincipal(r)
+		if this.auth == nil || !ok {
+			router.ServeHTTP(w, r)
+			return
+		}
+
+		r.ParseMultipartForm(32 << 20)
+		var match mux.RouteMatch
+		vars := map[string]string{}
+		if router.Match(r, &match) {
+			vars = match.Vars
+		}
+		if why := this.auth.forbidden(r, principal, match.Route, vars); why != "" {
+			replyStatus(w, http.StatusForbidden)
+			ErrorExcu(w, fmt.Errorf("%s", why))
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func signJWT(alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	input := enc(map[string]string{"alg": alg, "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func Test_Auth(t *testing.T) {
+	rsa_key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ec_key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "r1", "n": b64(rsa_key.N.Bytes()), "e": b64(big.NewInt(int64(rsa_key.E)).Bytes())},
+		{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ec_key.X.Bytes()), "y": b64(ec_key.Y.Bytes())},
+	}})
+	f, _ := ioutil.TempFile("", "jwks")
+	defer os.Remove(f.Name())
+	f.Write(jwks)
+	f.Close()
+
+	sum := sha256.Sum256([]byte("secret-key"))
+	a, err := newAuthenticator(
+		authInfo{Jwks: f.Name(), Audience: "cache"},
+		map[string]apiKeyInfo{"ci": {Sha256: hex.EncodeToString(sum[:])}},
+		map[string]aclInfo{
+			"ci":    {Read: []string{"*"}, Write: []string{"ci:"}, Commands: []string{"string", "hash"}},
+			"alice": {Write: []string{"*"}, Admin: true},
+			"dev":   {Read: []string{"*"}, Write: []string{"dev:"}},
+		})
+	if err != nil {
+		t.Fatalf("newAuthenticator Error:%v", err.Error())
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	cases := []struct {
+		token, principal string
+	}{
+		{signJWT("RS256", "r1", rsa_key, map[string]interface{}{"sub": "alice", "aud": "cache", "exp": exp}), "alice"},
+		{signJWT("ES256", "e1", ec_key, map[string]interface{}{"sub": "bob", "aud": []string{"x", "cache"}, "exp": exp}), "bob"},
+		{signJWT("RS256", "r1", rsa_key, map[string]interface{}{"sub": "alice", "aud": "cache", "exp": float64(1)}), ""},
+		{signJWT("RS256", "r1", rsa_key, map[string]interface{}{"sub": "alice", "aud": "other", "exp": exp}), ""},
+		{signJWT("ES256", "r1", ec_key, map[string]interface{}{"sub": "alice", "aud": "cache", "exp": exp}), ""},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/string", nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		p, err := a.principal(r)
+		if p != c.principal || (c.principal == "") != (err != nil) {
+			t.Errorf("case %d: principal %q, %v", i, p, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/string", nil)
+	r.Header.Set("X-API-Key", "secret-key")
+	if p, err := a.principal(r); p != "ci" || err != nil {
+		t.Errorf("api key: %q, %v", p, err)
+	}
+	r.Header.Set("X-API-Key", "wrong")
+	if _, err := a.principal(r); err == nil {
+		t.Errorf("wrong api key accepted")
+	}
+
+	router := mux.NewRouter()
+	for _, route := range []struct{ path, method string }{
+		{"/string", "GET"}, {"/string", "POST"}, {"/hash/{key}", "PUT"},
+		{"/queue/{name}", "GET"}, {"/server", "POST"}, {"/list/{key}/pop", "GET"},
+		{"/stream/{key}/group/{group}", "GET"}, {"/stream/{key}", "GET"},
+	} {
+		router.HandleFunc(route.path, func(http.ResponseWriter, *http.Request) {}).Methods(route.method)
+	}
+
+	checks := []struct {
+		principal, method, path string
+		form                    url.Values
+		allowed                 bool
+	}{
+		{"ci", "GET", "/string", url.Values{"key": {"any"}}, true},
+		{"ci", "POST", "/string", url.Values{"key": {"ci:1"}}, true},
+		{"ci", "POST", "/string", url.Values{"key": {"prod:1"}}, false},
+		{"ci", "PUT", "/hash/prod:1", nil, false},
+		{"ci", "GET", "/queue/jobs", nil, false},
+		{"ci", "POST", "/server", nil, false},
+		{"alice", "POST", "/server", nil, true},
+		{"alice", "GET", "/list/a/pop", nil, true},
+		{"bob", "GET", "/string", url.Values{"key": {"a"}}, false},
+		{"dev", "GET", "/stream/any:1", nil, true},
+		// Reading a group moves entries to the pending list.
+		{"dev", "GET", "/stream/any:1/group/g", nil, false},
+		{"dev", "GET", "/list/any:1/pop", nil, false},
+		{"dev", "GET", "/list/dev:1/pop", nil, true},
+		{"dev", "PUT", "/hash/queue:dev:jobs:items", nil, true},
+		{"dev", "PUT", "/hash/queue:prod:jobs:items", nil, false},
+		{"dev", "PUT", "/hash/queue:names", nil, false},
+	}
+	for _, c := range checks {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		var match mux.RouteMatch
+		if !router.Match(r, &match) {
+			t.Fatalf("%s %s matches no route", c.method, c.path)
+		}
+		why := a.forbidden(r, c.principal, match.Route, match.Vars)
+		if (why == "") != c.allowed {
+			t.Errorf("%s %s %s %v: %q", c.principal, c.method, c.path, c.form, why)
+		}
+	}
+}
+
+func Test_IsWriteRequest(t *testing.T) {
+	router := mux.NewRouter()
+	for _, route := range []struct{ path, method string }{
+		{"/string/{key}", "GET"}, {"/string/{key}", "PUT"}, {"/zset/{key}/pop", "GET"},
+		{"/stream/{key}/group/{group}", "GET"}, {"/queue/{name}", "GET"},
+	} {
+		router.HandleFunc(route.path, func(http.ResponseWriter, *http.Request) {}).Methods(route.method)
+	}
+	for target, write := range map[string]bool{
+		"GET /string/a":              false,
+		"PUT /string/a":              true,
+		"GET /zset/a/pop":            true,
+		"GET /ns/billing/zset/a/pop": true,
+		"GET /stream/a/group/g":      true,
+		"GET /ns/billing/queue/q":    false,
+		"GET /nowhere":               false,
+		"POST /nowhere":              true,
+	} {
+		parts := strings.SplitN(target, " ", 2)
+		if got := isWriteRequest(router, httptest.NewRequest(parts[0], parts[1], nil)); got != write {
+			t.Errorf("%s: write %v", target, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A backend group pins keys to a subset of the [redis.*] shards. Each group
+// has its own consistent hash ring, so its keys never land outside it and a
+// shard failing in one group leaves the others alone. Keys matching no
+// group prefix hash over the shards that belong to no group, or over all
+// shards when every configured shard is in one. A ring whose shards are all
+// down is not spilled into another: its keys get 503 until one connects.
+type groupInfo struct {
+	// [redis.*] names in the group.
+	Redis []string
+	// Key prefixes stored in the group; a trailing "*" is ignored.
+	Prefixes []string
+}
+
+type backendGroup struct {
+	name string
+	info groupInfo
+	ring *Consistent
+}
+
+type groupPrefix struct {
+	prefix string
+	group  *backendGroup
+}
+
+// noShardError is returned for keys whose ring has no connected shard.
+type noShardError struct {
+	group string
+}
+
+func (e *noShardError) Error() string {
+	if e.group == "" {
+		return "no redis connected for ungrouped keys"
+	}
+	return "no redis connected in group " + e.group
+}
+
+type groupStats struct {
+	Name     string   `json:"name"`
+	Redis    []string `json:"redis"`
+	Prefixes []string `json:"prefixes"`
+	Up       []string `json:"up"`
+}
+
+// initGroups builds the group rings, empty until addServer fills them.
+// Namespaces naming a group add their prefix to it.
+func (this *CacheRequestHandler) initGroups(cfg cacheConfig) error {
+	this.groups = make(map[string]*backendGroup)
+	this.group_prefixes = nil
+	this.grouped = make(map[string][]*backendGroup)
+	this.all_grouped = false
+
+	for name, info := range cfg.Group {
+		if len(info.Redis) == 0 {
+			return fmt.Errorf("group %s has no redis", name)
+		}
+		g := &backendGroup{name: name, info: info, ring: NewConsisten()}
+		for _, r := range info.Redis {
+			if _, ok := cfg.Redis[r]; !ok {
+				return fmt.Errorf("group %s: unknown redis '%s'", name, r)
+			}
+			this.grouped[r] = append(this.grouped[r], g)
+		}
+		for _, p := range info.Prefixes {
+			this.addGroupPrefix(g, strings.TrimSuffix(p, "*"))
+		}
+		this.groups[name] = g
+	}
+
+	for _, ns := range this.namespaces {
+		if ns.info.Group == "" {
+			continue
+		}
+		g, ok := this.groups[ns.info.Group]
+		if !ok {
+			return fmt.Errorf("namespace %s: unknown group '%s'", ns.name, ns.info.Group)
+		}
+		g.info.Prefixes = append(g.info.Prefixes, ns.info.Prefix)
+		this.addGroupPrefix(g, ns.info.Prefix)
+	}
+
+	this.all_grouped = len(this.groups) > 0
+	for name := range cfg.Redis {
+		if _, ok := this.grouped[name]; !ok {
+			this.all_grouped = false
+		}
+	}
+
+	sort.Slice(this.group_prefixes, func(i, j int) bool {
+		return len(this.group_prefixes[i].prefix) > len(this.group_prefixes[j].prefix)
+	})
+	return nil
+}
+
+func (this *CacheRequestHandler) addGroupPrefix(g *backendGroup, prefix string) {
+	this.group_prefixes = append(this.group_prefixes, groupPrefix{prefix: prefix, group: g})
+}
+
+// addToRings adds a connected shard to the rings it belongs to. When every
+// configured shard is grouped, ungrouped keys hash over all of them.
+func (this *CacheRequestHandler) addToRings(name string) {
+	groups, ok := this.grouped[name]
+	if !ok || this.all_grouped {
+		this.master_hashRing.Add(name)
+	}
+	for _, g := range groups {
+		g.ring.Add(name)
+	}
+}
+
+// checkRings reports the rings left without a connected shard.
+func (this *CacheRequestHandler) checkRings() {
+	if len(this.master_hashRing.Members()) == 0 {
+		logError("no redis connected for ungrouped keys")
+	}
+	for _, g := range this.groups {
+		if len(g.ring.Members()) == 0 {
+			logError("group has no redis connected", "group", g.name)
+		}
+	}
+}
+
+// keyShard returns the shard owning key, or a noShardError when its ring
+// has none connected.
+func (this *CacheRequestHandler) keyShard(key string) (string, error) {
+	for _, p := range this.group_prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			if name := p.group.ring.Get(key); name != "" {
+				return name, nil
+			}
+			return "", &noShardError{group: p.group.name}
+		}
+	}
+	if name := this.master_hashRing.Get(key); name != "" {
+		return name, nil
+	}
+	return "", &noShardError{}
+}
+
+// Returns the backend groups with their connected shards.
+// curl /group
+func (this *CacheRequestHandler) getGroups(w http.ResponseWriter, r *http.Request) {
+	stats := make([]groupStats, 0, len(this.groups)+1)
+	for _, g := range this.groups {
+		up := g.ring.Members()
+		sort.Strings(up)
+		stats = append(stats, groupStats{Name: g.name, Redis: g.info.Redis, Prefixes: g.info.Prefixes, Up: up})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+
+	up := this.master_hashRing.Members()
+	sort.Strings(up)
+	stats = append(stats, groupStats{Name: "", Up: up})
+	ErrorNil(w, stats)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_KeyShard(t *testing.T) {
+	handler := new(CacheRequestHandler)
+	handler.master_hashRing = NewConsisten()
+	handler.master_clients = make(map[string]*redis.Client)
+
+	cfg := cacheConfig{
+		Redis: map[string]redisInfo{"main": {}, "child0": {}, "child1": {}},
+		Group: map[string]groupInfo{
+			"perf": {Redis: []string{"child0"}, Prefixes: []string{"perf-*"}},
+			"team": {Redis: []string{"child0", "child1"}},
+		},
+		Namespace: map[string]namespaceInfo{"billing": {Group: "team"}},
+	}
+	if err := handler.initNamespaces(&cfg); err != nil {
+		t.Fatalf("initNamespaces Error:%v", err.Error())
+	}
+	if err := handler.initGroups(cfg); err != nil {
+		t.Fatalf("initGroups Error:%v", err.Error())
+	}
+	for name := range cfg.Redis {
+		handler.master_clients[name] = nil
+		handler.addToRings(name)
+	}
+	handler.checkRings()
+
+	for i := 0; i < 100; i++ {
+		n := strconv.Itoa(i)
+		if s, _ := handler.keyShard("perf-" + n); s != "child0" {
+			t.Errorf("perf-%s on %s", n, s)
+		}
+		if s, _ := handler.keyShard("billing:" + n); s != "child0" && s != "child1" {
+			t.Errorf("billing:%s on %s", n, s)
+		}
+		if s, _ := handler.keyShard("other" + n); s != "main" {
+			t.Errorf("other%s on %s", n, s)
+		}
+	}
+
+	// Rings stay apart when their shards go down.
+	handler.master_hashRing.Remove("main")
+	if _, err := handler.keyShard("other"); err == nil {
+		t.Errorf("ungrouped key without shard should fail")
+	}
+	if s, err := handler.keyShard("perf-1"); err != nil || s != "child0" {
+		t.Errorf("perf-1 on %s, %v", s, err)
+	}
+	handler.groups["perf"].ring.Remove("child0")
+	if _, err := handler.keyShard("perf-1"); err == nil {
+		t.Errorf("perf-1 without shard should fail")
+	}
+
+	w := httptest.NewRecorder()
+	ErrorExcu(w, &noShardError{group: "perf"})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("no shard answered %d", w.Code)
+	}
+
+	cfg.Group["bad"] = groupInfo{Redis: []string{"child9"}}
+	if err := handler.initGroups(cfg); err == nil {
+		t.Errorf("unknown redis should fail")
+	}
+}
+
+func Test_KeyShardAllGrouped(t *testing.T) {
+	handler := new(CacheRequestHandler)
+	handler.master_hashRing = NewConsisten()
+	cfg := cacheConfig{
+		Redis: map[string]redisInfo{"child0": {}, "child1": {}},
+		Group: map[string]groupInfo{"perf": {Redis: []string{"child0"}, Prefixes: []string{"perf-"}}},
+	}
+	if err := handler.initGroups(cfg); err != nil {
+		t.Fatalf("initGroups Error:%v", err.Error())
+	}
+	handler.addToRings("child0")
+	if _, err := handler.keyShard("other"); err == nil {
+		t.Errorf("child1 is ungrouped, other must not use child0")
+	}
+
+	cfg.Group["rest"] = groupInfo{Redis: []string{"child1"}}
+	if err := handler.initGroups(cfg); err != nil {
+		t.Fatalf("initGroups Error:%v", err.Error())
+	}
+	handler.addToRings("child0")
+	if s, err := handler.keyShard("other"); err != nil || s != "child0" {
+		t.Errorf("other on %s, %v", s, err)
+	}
+}
+
+func Test_PubSubGrouped(t *testing.T) {
+	handler := testHandler(t, cacheConfig{
+		Redis: map[string]redisInfo{"main": {}, "child0": {}},
+		Group: map[string]groupInfo{"perf": {Redis: []string{"child0"}, Prefixes: []string{"perf-"}}},
+	})
+
+	sub, err := handler.pubsub.Subscribe([]string{"perf-news"}, nil)
+	if err != nil {
+		t.Fatalf("Subscribe Error:%v", err.Error())
+	}
+	defer handler.pubsub.Unsubscribe(sub)
+	if sub.shards[0] != "child0" {
+		t.Errorf("perf-news subscribed on %s", sub.shards[0])
+	}
+
+	// The shard subscription is set up asynchronously; publish until a
+	// subscriber counts.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := serveTest("/publish/{channel}", "POST", handler.publish, "/publish/perf-news", "message=hello")
+		if w.Code != http.StatusOK {
+			t.Fatalf("publish answered %d %s", w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), `"val":"0"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody subscribed to perf-news")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case msg := <-sub.msgs:
+		if msg.Channel != "perf-news" || msg.Payload != "hello" {
+			t.Errorf("got %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no message on perf-news")
+	}
+
+	handler.groups["perf"].ring.Remove("child0")
+	if _, err := handler.pubsub.Subscribe([]string{"perf-news"}, nil); err == nil {
+		t.Errorf("subscribe without shard should fail")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// Values are binary safe in Redis but not in form fields and JSON strings.
+// Binary values either travel raw as application/octet-stream
+// (/string/{key}) or base64 encoded when a request sets "encoding=base64";
+// the encoding then applies to both the values sent and those returned.
+const (
+	octetStream = "application/octet-stream"
+	// Largest Redis string.
+	maxValueSize = 512 << 20
+)
+
+// base64Param reads the "encoding" form value; true means base64.
+func (this *CacheRequestHandler) base64Param(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch this.GetFormValue(w, r, "encoding") {
+	case "":
+		return false, true
+	case "base64":
+		return true, true
+	}
+	ErrorParam(w, "encoding")
+	return false, false
+}
+
+func decodeValue(b64 bool, v string) (string, error) {
+	if !b64 {
+		return v, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	return string(b), err
+}
+
+// decodeValues decodes vals in place.
+func decodeValues(b64 bool, vals []string) error {
+	for i, v := range vals {
+		d, err := decodeValue(b64, v)
+		if err != nil {
+			return err
+		}
+		vals[i] = d
+	}
+	return nil
+}
+
+func encodeValue(b64 bool, v string) string {
+	if !b64 {
+		return v
+	}
+	return base64.StdEncoding.EncodeToString([]byte(v))
+}
+
+// encodeValues encodes vals in place.
+func encodeValues(b64 bool, vals []string) []string {
+	for i, v := range vals {
+		vals[i] = encodeValue(b64, v)
+	}
+	return vals
+}
+
+func isOctetStream(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), octetStream)
+}
+
+func wantOctetStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), octetStream)
+}
+
+// writeOctetStream answers with the raw value.
+func writeOctetStream(w http.ResponseWriter, val string) {
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+	w.Write([]byte(val))
+}
+
+// Stores the raw request body when sent as application/octet-stream,
+// otherwise the "value" form field.
+// curl -X PUT -H "Content-Type: application/octet-stream" --data-binary @report.pb "/string/report:42?expire=3600"
+func (this *CacheRequestHandler) putString(w http.ResponseWriter, r *http.Request) {
+	if !isOctetStream(r) {
+		this.updateString(w, r)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if r.ContentLength > maxValueSize {
+		replyStatus(w, http.StatusRequestEntityTooLarge)
+		ErrorParam(w, "body")
+		return
+	}
+	val, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	r.ParseForm()
+
+	stored, err := this.storeValue(key, string(val))
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, name, "SET", key)
+	err = client.Set(key, stored, 0).Err()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, name, key, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, nil)
+}
+
+// Answers the raw value when the client accepts application/octet-stream,
+// otherwise the value as JSON like GET /string?key=. Writes go through
+// PUT /string/{key}. See writeStoredValue for reading compressed values.
+// curl -H "Accept: application/octet-stream" /string/report:42 > report.pb
+// curl "/string/report:42?encoding=base64"
+func (this *CacheRequestHandler) readString(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	octet := wantOctetStream(r)
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, name, "GET", key)
+	val, err := client.Get(key).Result()
+	done(err)
+	if err == redis.Nil {
+		if octet {
+			replyStatus(w, http.StatusNotFound)
+		}
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		if octet {
+			replyStatus(w, http.StatusInternalServerError)
+		}
+		ErrorExcu(w, err)
+		return
+	}
+	if octet {
+		this.writeStoredValue(w, r, val, this.GetFormValue(w, r, "raw") == "1")
+		return
+	}
+	if val, err = this.loadValue(val); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, encodeValue(b64, val))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ErrorNilBinary(t *testing.T) {
+	raw := "a\"b\\c\x00\n"
+	w := httptest.NewRecorder()
+	ErrorNil(w, raw)
+
+	var reply struct{ Val string }
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("reply %q is not JSON: %v", w.Body.String(), err)
+	}
+	if reply.Val != raw {
+		t.Errorf("got %q, want %q", reply.Val, raw)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func Test_Base64Values(t *testing.T) {
+	raw := []string{"\xff\xfe\x00", ""}
+	vals := encodeValues(true, append([]string{}, raw...))
+	if err := decodeValues(true, vals); err != nil {
+		t.Fatalf("decodeValues Error:%v", err.Error())
+	}
+	for i := range raw {
+		if vals[i] != raw[i] {
+			t.Errorf("got %q, want %q", vals[i], raw[i])
+		}
+	}
+	if _, err := decodeValue(true, "not base64!"); err == nil {
+		t.Errorf("decodeValue should fail")
+	}
+	if v, _ := decodeValue(false, "plain"); v != "plain" {
+		t.Errorf("got %q, want plain", v)
+	}
+}
+
+func Test_ReadString(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+
+	serveTest("/string/{key}", "PUT", handler.putString, "/string/greeting", "value=hello")
+	w := serveTest("/string/{key}", "GET", handler.readString, "/string/greeting?value=overwritten", "")
+	if !strings.Contains(w.Body.String(), `"val":"hello"`) {
+		t.Errorf("GET answered %s", w.Body.String())
+	}
+	w = serveTest("/string/{key}", "GET", handler.readString, "/string/greeting?encoding=base64", "")
+	if !strings.Contains(w.Body.String(), `"val":"aGVsbG8="`) {
+		t.Errorf("base64 GET answered %s", w.Body.String())
+	}
+	w = serveTest("/string/{key}", "GET", handler.readString, "/string/missing", "")
+	if !strings.Contains(w.Body.String(), `"_msg":"nil"`) {
+		t.Errorf("missing key answered %s", w.Body.String())
+	}
+}
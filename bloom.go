@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// A Bloom filter is the bitmap bloom:<name> with its parameters in
+// bloom:<name>:conf (capacity, error_rate, bits, hashes), both on the shard
+// the name hashes to. Bit positions are computed by the proxy with double
+// hashing over a 128 bit FNV-1a hash of the item.
+const (
+	// Redis strings, and so bitmaps, are at most 512MB.
+	maxBloomBits = 1 << 32
+	// Items per add/check request.
+	maxBloomBatch = 10000
+)
+
+// KEYS: bits. ARGV: hashes, then hashes positions per item.
+// Returns per item 1 when it was new (some bit was unset).
+var bloomAddScript = NewLuaScript(`
+local k = tonumber(ARGV[1])
+local added = {}
+for i = 2, #ARGV, k do
+	local new = 0
+	for j = i, i + k - 1 do
+		if redis.call('SETBIT', KEYS[1], ARGV[j], 1) == 0 then
+			new = 1
+		end
+	end
+	added[#added + 1] = new
+end
+return added
+`)
+
+// KEYS: bits. ARGV: hashes, then hashes positions per item.
+// Returns per item 1 when it may be present.
+var bloomCheckScript = NewLuaScript(`
+local k = tonumber(ARGV[1])
+local found = {}
+for i = 2, #ARGV, k do
+	local hit = 1
+	for j = i, i + k - 1 do
+		if redis.call('GETBIT', KEYS[1], ARGV[j]) == 0 then
+			hit = 0
+			break
+		end
+	end
+	found[#found + 1] = hit
+end
+return found
+`)
+
+// KEYS: conf. ARGV: capacity, error_rate, bits, hashes.
+var bloomCreateScript = NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'capacity', ARGV[1], 'error_rate', ARGV[2], 'bits', ARGV[3], 'hashes', ARGV[4])
+return 1
+`)
+
+type bloomInfo struct {
+	Capacity  int64   `json:"capacity"`
+	ErrorRate float64 `json:"error_rate"`
+	Bits      uint64  `json:"bits"`
+	Hashes    int     `json:"hashes"`
+}
+
+func bloomKey(name string) string {
+	return "bloom:" + name
+}
+
+func bloomConfKey(name string) string {
+	return "bloom:" + name + ":conf"
+}
+
+// newBloomInfo sizes a filter holding capacity items at error_rate false
+// positives: bits = -n ln p / (ln 2)^2 and hashes = bits/n ln 2.
+func newBloomInfo(capacity int64, error_rate float64) (bloomInfo, error) {
+	if capacity <= 0 {
+		return bloomInfo{}, fmt.Errorf("capacity must be positive")
+	}
+	if error_rate <= 0 || error_rate >= 1 {
+		return bloomInfo{}, fmt.Errorf("error_rate must be between 0 and 1")
+	}
+
+	bits := math.Ceil(-float64(capacity) * math.Log(error_rate) / (math.Ln2 * math.Ln2))
+	if bits > maxBloomBits {
+		return bloomInfo{}, fmt.Errorf("filter needs %.0f bits (max %d)", bits, uint64(maxBloomBits))
+	}
+	hashes := int(math.Floor(bits/float64(capacity)*math.Ln2 + 0.5))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return bloomInfo{Capacity: capacity, ErrorRate: error_rate, Bits: uint64(bits), Hashes: hashes}, nil
+}
+
+// positions returns the bit offsets of item, h1 + i*h2 mod bits.
+func (b bloomInfo) positions(item string) []uint64 {
+	h := fnv.New128a()
+	h.Write([]byte(item))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+
+	pos := make([]uint64, b.Hashes)
+	for i := range pos {
+		pos[i] = (h1 + uint64(i)*h2) % b.Bits
+	}
+	return pos
+}
+
+// estimate returns the approximate number of items added given the number
+// of bits set.
+func (b bloomInfo) estimate(set int64) int64 {
+	m := float64(b.Bits)
+	if float64(set) >= m {
+		return b.Capacity
+	}
+	return int64(math.Floor(-m/float64(b.Hashes)*math.Log(1-float64(set)/m) + 0.5))
+}
+
+func (this *CacheRequestHandler) getBloomInfo(r *http.Request, shard string, client *redis.Client, name string) (bloomInfo, error) {
+	done := traceRedis(r, shard, "HGETALL", bloomConfKey(name))
+	conf, err := client.HGetAll(bloomConfKey(name)).Result()
+	done(err)
+	if err != nil {
+		return bloomInfo{}, err
+	}
+	if len(conf) == 0 {
+		return bloomInfo{}, redis.Nil
+	}
+	b := bloomInfo{}
+	b.Capacity, _ = strconv.ParseInt(conf["capacity"], 10, 64)
+	b.ErrorRate, _ = strconv.ParseFloat(conf["error_rate"], 64)
+	b.Bits, _ = strconv.ParseUint(conf["bits"], 10, 64)
+	b.Hashes, _ = strconv.Atoi(conf["hashes"])
+	if b.Bits == 0 || b.Hashes <= 0 {
+		return bloomInfo{}, fmt.Errorf("bloom filter '%s' has a broken conf", name)
+	}
+	return b, nil
+}
+
+// bloomRun runs script over the "item"s of the request and answers with
+// item -> bool.
+func (this *CacheRequestHandler) bloomRun(w http.ResponseWriter, r *http.Request, script *LuaScript) {
+	name := mux.Vars(r)["name"]
+	items := r.Form["item"]
+	if len(items) == 0 || len(items) > maxBloomBatch {
+		ErrorParam(w, "item")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	b, err := this.getBloomInfo(r, shard, client, name)
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	args := make([]interface{}, 0, 1+len(items)*b.Hashes)
+	args = append(args, b.Hashes)
+	for _, item := range items {
+		for _, p := range b.positions(item) {
+			args = append(args, strconv.FormatUint(p, 10))
+		}
+	}
+	done := traceRedis(r, shard, "EVALSHA", bloomKey(name))
+	val, err := script.Run(client, []string{bloomKey(name)}, args...).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	vals, _ := val.([]interface{})
+	if len(vals) != len(items) {
+		ErrorExcu(w, fmt.Errorf("unexpected bloom reply"))
+		return
+	}
+
+	res := make(map[string]bool, len(items))
+	for i, item := range items {
+		res[item] = replyInt(vals[i]) == 1
+	}
+	ErrorNil(w, res)
+}
+
+// Creates the filter sized for "capacity" items at "error_rate".
+// curl -X PUT -d "capacity=1000000&error_rate=0.001" /bloom/seen-runs
+func (this *CacheRequestHandler) createBloom(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	capacity, err := strconv.ParseInt(this.GetFormValue(w, r, "capacity"), 10, 64)
+	if err != nil {
+		ErrorParam(w, "capacity")
+		return
+	}
+	error_rate, err := strconv.ParseFloat(this.GetFormValue(w, r, "error_rate"), 64)
+	if err != nil {
+		ErrorParam(w, "error_rate")
+		return
+	}
+	b, err := newBloomInfo(capacity, error_rate)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "EVALSHA", bloomConfKey(name))
+	val, err := bloomCreateScript.Run(client, []string{bloomConfKey(name)},
+		b.Capacity, strconv.FormatFloat(b.ErrorRate, 'g', -1, 64), strconv.FormatUint(b.Bits, 10), b.Hashes).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if replyInt(val) != 1 {
+		ErrorExcu(w, fmt.Errorf("bloom filter '%s' exists", name))
+		return
+	}
+	ErrorNil(w, b)
+}
+
+// Adds the "item"s; each maps to true when it was not in the filter yet.
+// curl -d "item=run1&item=run2" /bloom/seen-runs
+func (this *CacheRequestHandler) addBloom(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+	this.bloomRun(w, r, bloomAddScript)
+}
+
+// Checks the "item"s; false means definitely absent.
+// curl "/bloom/seen-runs/check?item=run1&item=run3"
+func (this *CacheRequestHandler) checkBloom(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+	this.bloomRun(w, r, bloomCheckScript)
+}
+
+// Returns the filter parameters with the bits set and estimated items.
+// curl /bloom/seen-runs
+func (this *CacheRequestHandler) getBloom(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	b, err := this.getBloomInfo(r, shard, client, name)
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	done := traceRedis(r, shard, "BITCOUNT", bloomKey(name))
+	cmd := redis.NewIntCmd("BITCOUNT", bloomKey(name))
+	client.Process(cmd)
+	set, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, map[string]interface{}{
+		"capacity":   b.Capacity,
+		"error_rate": b.ErrorRate,
+		"bits":       b.Bits,
+		"hashes":     b.Hashes,
+		"bits_set":   set,
+		"estimate":   b.estimate(set),
+	})
+}
+
+// curl -X DELETE /bloom/seen-runs
+func (this *CacheRequestHandler) delBloom(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "DEL", bloomKey(name))
+	val, err := client.Del(bloomKey(name), bloomConfKey(name)).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
+}
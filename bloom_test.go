@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func Test_NewBloomInfo(t *testing.T) {
+	// 1M items at 1% need about 9.59M bits and 7 hashes.
+	b, err := newBloomInfo(1000000, 0.01)
+	if err != nil {
+		t.Fatalf("newBloomInfo Error:%v", err.Error())
+	}
+	if b.Bits != 9585059 || b.Hashes != 7 {
+		t.Errorf("got %d bits %d hashes, want 9585059 bits 7 hashes", b.Bits, b.Hashes)
+	}
+
+	for _, c := range []struct {
+		capacity   int64
+		error_rate float64
+	}{{0, 0.01}, {100, 0}, {100, 1}, {1 << 40, 0.0001}} {
+		if _, err := newBloomInfo(c.capacity, c.error_rate); err == nil {
+			t.Errorf("newBloomInfo(%d, %v) should fail", c.capacity, c.error_rate)
+		}
+	}
+}
+
+func Test_BloomFalsePositives(t *testing.T) {
+	b, _ := newBloomInfo(10000, 0.01)
+	bits := make([]bool, b.Bits)
+	set := int64(0)
+	for i := 0; i < 10000; i++ {
+		for _, p := range b.positions("item" + strconv.Itoa(i)) {
+			if !bits[p] {
+				bits[p] = true
+				set++
+			}
+		}
+	}
+
+	if n := b.estimate(set); math.Abs(float64(n-10000)) > 200 {
+		t.Errorf("estimate %d, want about 10000", n)
+	}
+
+	hits := 0
+	for i := 0; i < 100000; i++ {
+		found := true
+		for _, p := range b.positions("other" + strconv.Itoa(i)) {
+			if !bits[p] {
+				found = false
+				break
+			}
+		}
+		if found {
+			hits++
+		}
+	}
+	if rate := float64(hits) / 100000; rate > 0.015 {
+		t.Errorf("false positive rate %v, want about 0.01", rate)
+	}
+}
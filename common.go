@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -10,16 +14,43 @@ import (
 	"gopkg.in/redis.v4"
 )
 
+// writeReply writes a JSON reply, labelled as such unless the handler
+// chose another Content-Type.
+func writeReply(w http.ResponseWriter, reply string) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	io.WriteString(w, reply)
+}
+
+// replyStatus sends a non-200 status ahead of a JSON reply.
+func replyStatus(w http.ResponseWriter, code int) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+}
+
+// jsonString quotes s as a JSON string.
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// ErrorExcu answers err; keys without a connected shard get a 503.
 func ErrorExcu(w http.ResponseWriter, err error) {
-	fmt.Fprintf(w, "%v", fmt.Sprintf(`{"_type":"-1","_msg":"%s"}`, err.Error()))
+	if _, ok := err.(*noShardError); ok {
+		replyStatus(w, http.StatusServiceUnavailable)
+	}
+	writeReply(w, fmt.Sprintf(`{"_type":"-1","_msg":%s}`, jsonString(err.Error())))
 }
 func ErrorValNone(w http.ResponseWriter) {
-	fmt.Fprintf(w, "%v", `{"_type":"-1","_msg":"nil"}`)
+	writeReply(w, `{"_type":"-1","_msg":"nil"}`)
 }
 
 func ErrorNil(w http.ResponseWriter, val interface{}) {
 	if val == nil {
-		fmt.Fprintf(w, "%v", `{"_type":"0", "_msg":"ok"}`)
+		writeReply(w, `{"_type":"0", "_msg":"ok"}`)
 		return
 	}
 	w_s := ""
@@ -29,27 +60,42 @@ func ErrorNil(w http.ResponseWriter, val interface{}) {
 	case int64:
 		w_s = `"` + strconv.FormatInt(val.(int64), 10) + `"`
 	case string:
-		w_s = `"` + val.(string) + `"`
+		w_s = jsonString(val.(string))
 	case bool:
 		if val.(bool) {
 			w_s = "true"
 		} else {
 			w_s = "false"
 		}
-	case []string:
-		w_s += "["
-		for _, s := range val.([]string) {
-			w_s += `"` + s + `",`
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
 		}
-		w_s += w_s[:len(w_s)-2]
-		w_s += "]"
+		// Large replies are written as marshalled, without copies.
+		writeReply(w, `{"_type":"0", "val":`)
+		w.Write(b)
+		io.WriteString(w, "}")
+		return
 	}
 
-	fmt.Fprintf(w, "%v", fmt.Sprintf(`{"_type":"0", "val":%s}`, w_s))
+	writeReply(w, fmt.Sprintf(`{"_type":"0", "val":%s}`, w_s))
+}
+
+// ErrorScan writes one page of a cursor read; a returned cursor of "0"
+// means the iteration is complete.
+func ErrorScan(w http.ResponseWriter, cursor uint64, val interface{}) {
+	b, err := json.Marshal(val)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	writeReply(w, fmt.Sprintf(`{"_type":"0", "cursor":"%d", "val":%s}`, cursor, string(b)))
 }
 
 func ErrorParam(w http.ResponseWriter, param string) {
-	fmt.Fprintf(w, "%v", fmt.Sprintf(`{"_type":"1", "_msg":"Param '%s' Error."}`, param))
+	writeReply(w, fmt.Sprintf(`{"_type":"1", "_msg":"Param '%s' Error."}`, param))
 }
 
 func HTTPGet(url_str string) ([]byte, error) {
@@ -108,7 +154,7 @@ func ParseZSetValue(val string) (redis.Z, error) {
 	}
 	score, err := strconv.ParseFloat(vals[0], 64)
 	if err != nil {
-		return zset_val, fmt.Errorf("Score Error:", err.Error())
+		return zset_val, fmt.Errorf("Score Error: %s", err.Error())
 	}
 
 	zset_val.Score = score
@@ -116,3 +162,39 @@ func ParseZSetValue(val string) (redis.Z, error) {
 
 	return zset_val, nil
 }
+
+// LuaScript runs a script with EVALSHA, falling back to EVAL the first
+// time a shard has not cached it yet.
+type LuaScript struct {
+	src  string
+	hash string
+}
+
+func NewLuaScript(src string) *LuaScript {
+	return &LuaScript{src: src, hash: sha1Hex(src)}
+}
+
+func sha1Hex(s string) string {
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *LuaScript) Run(client *redis.Client, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := s.eval(client, "EVALSHA", s.hash, keys, args)
+	if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		cmd = s.eval(client, "EVAL", s.src, keys, args)
+	}
+	return cmd
+}
+
+func (s *LuaScript) eval(client *redis.Client, op, script string, keys []string, args []interface{}) *redis.Cmd {
+	cmd_args := make([]interface{}, 0, 3+len(keys)+len(args))
+	cmd_args = append(cmd_args, op, script, len(keys))
+	for _, k := range keys {
+		cmd_args = append(cmd_args, k)
+	}
+	cmd_args = append(cmd_args, args...)
+	cmd := redis.NewCmd(cmd_args...)
+	client.Process(cmd)
+	return cmd
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// String and hash values written through the proxy may be compressed. A
+// stored value that went through the proxy starts with a 4 byte header,
+// valueMagic followed by the algorithm id, so reads decompress whatever
+// rule wrote them. Values at or below the rule's MinSize, or that do not
+// shrink, are stored as is, unless they happen to start with valueMagic,
+// in which case they get a compressNone header. Encrypted values use the
+// same header with their own ids, see encryption.go.
+const valueMagic = "\xfeCZ"
+
+const (
+	compressNone byte = iota
+	compressGzip
+	compressZstd
+	compressSnappy
+)
+
+var compressAlgorithms = map[string]byte{
+	"none":   compressNone,
+	"gzip":   compressGzip,
+	"zstd":   compressZstd,
+	"snappy": compressSnappy,
+}
+
+var compressNames = map[byte]string{
+	compressNone:   "none",
+	compressGzip:   "gzip",
+	compressZstd:   "zstd",
+	compressSnappy: "snappy",
+}
+
+// DecodeAll is safe for concurrent use.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// compressionInfo is one [compression.<name>] rule, applied to keys
+// starting with Prefix; the longest matching prefix wins.
+type compressionInfo struct {
+	Prefix    string
+	Algorithm string
+	// Compression level; 0 uses the algorithm's default.
+	Level int
+	// Values up to this many bytes are stored uncompressed.
+	MinSize int
+}
+
+type compressor struct {
+	name string
+	info compressionInfo
+	id   byte
+	zstd *zstd.Encoder
+
+	// Stats since start, updated atomically.
+	values     int64
+	compressed int64
+	bytes_in   int64
+	bytes_out  int64
+}
+
+type compressorStats struct {
+	Name       string  `json:"name"`
+	Prefix     string  `json:"prefix"`
+	Algorithm  string  `json:"algorithm"`
+	MinSize    int     `json:"min_size"`
+	Values     int64   `json:"values"`
+	Compressed int64   `json:"compressed"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	Ratio      float64 `json:"ratio"`
+}
+
+func newCompressor(name string, info compressionInfo) (*compressor, error) {
+	id, ok := compressAlgorithms[info.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm '%s'", info.Algorithm)
+	}
+	c := &compressor{name: name, info: info, id: id}
+
+	switch id {
+	case compressGzip:
+		if info.Level != 0 && (info.Level < gzip.BestSpeed || info.Level > gzip.BestCompression) {
+			return nil, fmt.Errorf("gzip level %d out of range", info.Level)
+		}
+	case compressZstd:
+		opts := []zstd.EOption{}
+		if info.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(info.Level)))
+		}
+		enc, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+		c.zstd = enc
+	}
+	return c, nil
+}
+
+// initCompression builds the compressors from the config, longest prefix
+// first.
+func (this *CacheRequestHandler) initCompression(rules map[string]compressionInfo) error {
+	this.compressors = nil
+	for name, info := range rules {
+		c, err := newCompressor(name, info)
+		if err != nil {
+			return fmt.Errorf("compression %s: %s", name, err.Error())
+		}
+		this.compressors = append(this.compressors, c)
+	}
+	sort.Slice(this.compressors, func(i, j int) bool {
+		return len(this.compressors[i].info.Prefix) > len(this.compressors[j].info.Prefix)
+	})
+	return nil
+}
+
+func (this *CacheRequestHandler) compressorFor(key string) *compressor {
+	for _, c := range this.compressors {
+		if strings.HasPrefix(key, c.info.Prefix) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *compressor) compress(val []byte) ([]byte, error) {
+	switch c.id {
+	case compressGzip:
+		level := c.info.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Write(val)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case compressZstd:
+		return c.zstd.EncodeAll(val, nil), nil
+	case compressSnappy:
+		return snappy.Encode(nil, val), nil
+	}
+	return val, nil
+}
+
+// packValue returns val as it should be stored at key.
+func (this *CacheRequestHandler) packValue(key, val string) (string, error) {
+	c := this.compressorFor(key)
+	if c == nil || c.id == compressNone || len(val) <= c.info.MinSize {
+		if strings.HasPrefix(val, valueMagic) {
+			return valueMagic + string(compressNone) + val, nil
+		}
+		return val, nil
+	}
+
+	out, err := c.compress([]byte(val))
+	if err != nil {
+		return "", err
+	}
+	atomic.AddInt64(&c.values, 1)
+	atomic.AddInt64(&c.bytes_in, int64(len(val)))
+	if len(out)+len(valueMagic)+1 >= len(val) {
+		atomic.AddInt64(&c.bytes_out, int64(len(val)))
+		if strings.HasPrefix(val, valueMagic) {
+			return valueMagic + string(compressNone) + val, nil
+		}
+		return val, nil
+	}
+	atomic.AddInt64(&c.compressed, 1)
+	atomic.AddInt64(&c.bytes_out, int64(len(out)+len(valueMagic)+1))
+	return valueMagic + string(c.id) + string(out), nil
+}
+
+// packValues packs vals stored at key in place.
+func (this *CacheRequestHandler) packValues(key string, vals []string) error {
+	for i, v := range vals {
+		p, err := this.packValue(key, v)
+		if err != nil {
+			return err
+		}
+		vals[i] = p
+	}
+	return nil
+}
+
+// storedAlgorithm splits a stored value into its algorithm and payload.
+func storedAlgorithm(val string) (byte, string) {
+	if len(val) < len(valueMagic)+1 || !strings.HasPrefix(val, valueMagic) {
+		return compressNone, val
+	}
+	return val[len(valueMagic)], val[len(valueMagic)+1:]
+}
+
+// unpackValue returns the original of a stored value.
+func unpackValue(val string) (string, error) {
+	id, payload := storedAlgorithm(val)
+	switch id {
+	case compressNone:
+		return payload, nil
+	case compressGzip:
+		zr, err := gzip.NewReader(strings.NewReader(payload))
+		if err != nil {
+			return "", err
+		}
+		b, err := ioutil.ReadAll(zr)
+		return string(b), err
+	case compressZstd:
+		b, err := zstdDecoder.DecodeAll([]byte(payload), nil)
+		return string(b), err
+	case compressSnappy:
+		b, err := snappy.Decode(nil, []byte(payload))
+		return string(b), err
+	}
+	return "", fmt.Errorf("value compressed with unknown algorithm %d", id)
+}
+
+// writeStoredValue answers a raw string read. raw returns the value as
+// stored, header included; a client whose Accept-Encoding lists the stored
+// algorithm gets the compressed payload with Content-Encoding; anyone else
+// gets the original bytes. Encrypted values are decrypted first, except
+// for raw reads.
+func (this *CacheRequestHandler) writeStoredValue(w http.ResponseWriter, r *http.Request, val string, raw bool) {
+	if raw {
+		id, _ := storedAlgorithm(val)
+		if name, ok := compressNames[id]; ok {
+			w.Header().Set("X-Cache-Compression", name)
+		}
+		writeOctetStream(w, val)
+		return
+	}
+	val, err := this.decryptValue(val)
+	if err != nil {
+		replyStatus(w, http.StatusInternalServerError)
+		ErrorExcu(w, err)
+		return
+	}
+	id, payload := storedAlgorithm(val)
+	if id != compressNone && strings.Contains(r.Header.Get("Accept-Encoding"), compressNames[id]) {
+		w.Header().Set("Content-Encoding", compressNames[id])
+		writeOctetStream(w, payload)
+		return
+	}
+
+	orig, err := unpackValue(val)
+	if err != nil {
+		replyStatus(w, http.StatusInternalServerError)
+		ErrorExcu(w, err)
+		return
+	}
+	writeOctetStream(w, orig)
+}
+
+// Returns the compression rules with the ratio each achieved since start.
+// curl /compression
+func (this *CacheRequestHandler) getCompression(w http.ResponseWriter, r *http.Request) {
+	stats := make([]compressorStats, len(this.compressors))
+	for i, c := range this.compressors {
+		s := compressorStats{
+			Name:       c.name,
+			Prefix:     c.info.Prefix,
+			Algorithm:  compressNames[c.id],
+			MinSize:    c.info.MinSize,
+			Values:     atomic.LoadInt64(&c.values),
+			Compressed: atomic.LoadInt64(&c.compressed),
+			BytesIn:    atomic.LoadInt64(&c.bytes_in),
+			BytesOut:   atomic.LoadInt64(&c.bytes_out),
+		}
+		if s.BytesOut > 0 {
+			s.Ratio = float64(s.BytesIn) / float64(s.BytesOut)
+		}
+		stats[i] = s
+	}
+	ErrorNil(w, stats)
+}
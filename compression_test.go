@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_PackValue(t *testing.T) {
+	handler := new(CacheRequestHandler)
+	err := handler.initCompression(map[string]compressionInfo{
+		"default": {Prefix: "", Algorithm: "none"},
+		"reports": {Prefix: "report:", Algorithm: "gzip", MinSize: 16},
+	})
+	if err != nil {
+		t.Fatalf("initCompression Error:%v", err.Error())
+	}
+
+	big := strings.Repeat("passed ", 100)
+	cases := []struct {
+		key, val   string
+		compressed bool
+	}{
+		{"report:1", big, true},
+		{"report:2", "short", false},
+		{"other", big, false},
+		{"other", valueMagic + "\x01looks compressed", false},
+	}
+	for _, c := range cases {
+		stored, err := handler.packValue(c.key, c.val)
+		if err != nil {
+			t.Fatalf("packValue(%q) Error:%v", c.key, err.Error())
+		}
+		if id, _ := storedAlgorithm(stored); (id == compressGzip) != c.compressed {
+			t.Errorf("%s: stored with algorithm %d", c.key, id)
+		}
+		if c.compressed && len(stored) >= len(c.val) {
+			t.Errorf("%s: %d bytes stored for %d", c.key, len(stored), len(c.val))
+		}
+		orig, err := unpackValue(stored)
+		if err != nil || orig != c.val {
+			t.Errorf("%s: unpacked %q, %v", c.key, orig, err)
+		}
+	}
+
+	if err := handler.initCompression(map[string]compressionInfo{"x": {Algorithm: "lz4"}}); err == nil {
+		t.Errorf("unknown algorithm should fail")
+	}
+}
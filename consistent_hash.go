@@ -84,11 +84,16 @@ func (c *Consistent) Members() []string {
 	return m
 }
 
+// Get returns the member owning key, "" when the ring is empty.
 func (c *Consistent) Get(key string) string {
 	hashKey := c.hash([]byte(key))
 	c.RLock()
 	defer c.RUnlock()
 
+	if len(c.circle) == 0 {
+		return ""
+	}
+
 	i := c.search(hashKey)
 	//fmt.Println("i", i)
 
@@ -173,3 +178,25 @@ func (c *Consistent) Remove(elt string) {
 
 	c.updateCricle()
 }
+
+// Vnodes returns the virtual node count of each member and the share of
+// the hash space its virtual nodes own.
+func (c *Consistent) Vnodes() (map[string]int, map[string]float64) {
+	c.RLock()
+	defer c.RUnlock()
+
+	counts := make(map[string]int)
+	shares := make(map[string]float64)
+	n := len(c.circle)
+	for i, h := range c.circle {
+		elt := c.virtualMap[h]
+		counts[elt]++
+		// A vnode owns the keys up to the next one, see search.
+		arc := float64(c.circle[(i+1)%n] - h)
+		if n == 1 {
+			arc = 1 << 32
+		}
+		shares[elt] += arc / (1 << 32)
+	}
+	return counts, shares
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard five field cron expression
+// (minute hour day-of-month month day-of-week) supporting "*", lists,
+// ranges and steps, e.g. "*/15 9-18 * * 1-5".
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Day-of-month and day-of-week restricted; like cron, a day then
+	// matches when either field does.
+	dom_star, dow_star bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron '%s': want 5 fields", spec)
+	}
+
+	bits := make([]uint64, 5)
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron '%s': %s", spec, err.Error())
+		}
+		bits[i] = b
+	}
+	// Sunday may be written as 7.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute:   bits[0],
+		hour:     bits[1],
+		dom:      bits[2],
+		month:    bits[3],
+		dow:      bits[4],
+		dom_star: strings.HasPrefix(fields[2], "*"),
+		dow_star: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, bounds cronField) (uint64, error) {
+	max := bounds.max
+	if bounds.max == 6 {
+		max = 7
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step '%s'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := bounds.min, max
+		if part != "*" {
+			bounds_str := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds_str[0])
+			if err != nil {
+				return 0, fmt.Errorf("bad value '%s'", part)
+			}
+			lo, hi = n, n
+			if len(bounds_str) == 2 {
+				hi, err = strconv.Atoi(bounds_str[1])
+				if err != nil {
+					return 0, fmt.Errorf("bad range '%s'", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < bounds.min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' out of range %d-%d", part, bounds.min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.dom_star || c.dow_star {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t matching the schedule, or the zero
+// time if there is none within five years.
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ParseCron(t *testing.T) {
+	for _, spec := range []string{"* * * * *", "*/15 9-18 * * 1-5", "0 0 1,15 * 7", "5-59/10 * * 2 *"} {
+		if _, err := parseCron(spec); err != nil {
+			t.Errorf("parseCron(%q) Error:%v", spec, err.Error())
+		}
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) should fail", spec)
+		}
+	}
+}
+
+func Test_CronNext(t *testing.T) {
+	base := time.Date(2017, 3, 31, 23, 58, 30, 0, time.UTC) // Friday
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 31, 23, 59, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2017, 4, 3, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 15 * 0", time.Date(2017, 4, 2, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2017, 4, 2, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q) Error:%v", c.spec, err.Error())
+		}
+		if next := cron.Next(base); !next.Equal(c.next) {
+			t.Errorf("%q: next %v, want %v", c.spec, next, c.next)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// A lock is lock:<name> holding the owner's token with a PX expiry, and
+// lock:<name>:fence counting acquisitions. The fencing token handed out on
+// every acquire is strictly increasing, so a resource can reject writes
+// from a holder whose lock has already expired.
+const (
+	defaultLockTTL   = 30 * time.Second
+	maxLockWait      = time.Minute
+	lockRetryDelay   = 50 * time.Millisecond
+	lockDriftDivisor = 100 // clock drift allowance of TTL/100, as in Redlock
+)
+
+// KEYS: lock, fence. ARGV: token, ttl ms. Returns the fencing token, or 0
+// when someone else holds the lock. Re-acquiring with the held token
+// refreshes the TTL.
+var lockAcquireScript = NewLuaScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return tonumber(redis.call('GET', KEYS[2]) or '0')
+end
+if cur then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return redis.call('INCR', KEYS[2])
+`)
+
+// KEYS: lock. ARGV: token, ttl ms.
+var lockExtendScript = NewLuaScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// KEYS: lock. ARGV: token.
+var lockReleaseScript = NewLuaScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// KEYS: fence. ARGV: floor.
+var lockFenceScript = NewLuaScript(`
+if tonumber(redis.call('GET', KEYS[1]) or '0') < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+type lockGrant struct {
+	Token string `json:"token"`
+	Fence int64  `json:"fence"`
+	TTL   int64  `json:"ttl"`
+}
+
+func lockKeys(name string) []string {
+	return []string{"lock:" + name, "lock:" + name + ":fence"}
+}
+
+func newLockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// lockClients returns the shards a lock lives on by name: the owning shard,
+// or all shards for quorum (Redlock) locks.
+func (this *CacheRequestHandler) lockClients(r *http.Request, name string, quorum bool) (map[string]*redis.Client, error) {
+	if !quorum {
+		shard, client, err := this.keyClient(r, name)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]*redis.Client{shard: client}, nil
+	}
+	clients := make(map[string]*redis.Client, len(this.master_clients))
+	for shard, client := range this.master_clients {
+		clients[shard] = client
+	}
+	return clients, nil
+}
+
+// tryLock makes one acquisition attempt and returns the fencing token and
+// the remaining validity, or 0 when the lock was not obtained. Quorum locks
+// need a majority of shards within the TTL; partial acquisitions are rolled
+// back. When the shards that failed could have made up the majority the
+// attempt fails with their error rather than as held.
+func (this *CacheRequestHandler) tryLock(r *http.Request, name, token string, ttl time.Duration, quorum bool) (int64, time.Duration, error) {
+	clients, err := this.lockClients(r, name, quorum)
+	if err != nil {
+		return 0, 0, err
+	}
+	keys := lockKeys(name)
+	ttl_ms := int64(ttl / time.Millisecond)
+
+	start := time.Now()
+	acquired := map[string]*redis.Client{}
+	fence := int64(0)
+	var last_err error
+	failed := 0
+	for shard, client := range clients {
+		done := traceRedis(r, shard, "EVALSHA", keys[0])
+		val, err := lockAcquireScript.Run(client, keys, token, ttl_ms).Result()
+		done(err)
+		if err != nil {
+			last_err = err
+			failed++
+			continue
+		}
+		if n := replyInt(val); n > 0 {
+			acquired[shard] = client
+			if n > fence {
+				fence = n
+			}
+		}
+	}
+
+	validity := ttl - time.Since(start)
+	if quorum {
+		validity -= ttl/lockDriftDivisor + 2*time.Millisecond
+	}
+	majority := lockMajority(len(clients))
+	if len(acquired) >= majority && validity > 0 {
+		// Every later majority overlaps this one, so raising these
+		// counters keeps the fencing token strictly increasing.
+		if len(acquired) > 1 {
+			for shard, client := range acquired {
+				done := traceRedis(r, shard, "EVALSHA", keys[1])
+				done(lockFenceScript.Run(client, keys[1:], fence).Err())
+			}
+		}
+		return fence, validity, nil
+	}
+
+	for shard, client := range acquired {
+		done := traceRedis(r, shard, "EVALSHA", keys[0])
+		done(lockReleaseScript.Run(client, keys[:1], token).Err())
+	}
+	if len(acquired) < majority && len(acquired)+failed >= majority {
+		return 0, 0, fmt.Errorf("lock '%s': %d of %d shards failed: %v", name, failed, len(clients), last_err)
+	}
+	return 0, 0, nil
+}
+
+func (this *CacheRequestHandler) lockTTL(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	v := this.GetFormValue(w, r, "ttl")
+	if v == "" {
+		return defaultLockTTL, true
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || secs <= 0 {
+		ErrorParam(w, "ttl")
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+// Acquires the lock for "ttl" seconds, retrying for up to "wait" seconds.
+// "quorum=1" acquires on a majority of all shards (Redlock) so the lock
+// survives a sentinel group failing.
+// curl -d "ttl=30&wait=5" /lock/deploy
+func (this *CacheRequestHandler) acquireLock(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	ttl, ok := this.lockTTL(w, r)
+	if !ok {
+		return
+	}
+	wait := time.Duration(0)
+	if v := this.GetFormValue(w, r, "wait"); v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil || secs < 0 {
+			ErrorParam(w, "wait")
+			return
+		}
+		wait = time.Duration(secs * float64(time.Second))
+		if wait > maxLockWait {
+			wait = maxLockWait
+		}
+	}
+	token := this.GetFormValue(w, r, "token")
+	if token == "" {
+		token = newLockToken()
+	}
+	quorum := this.GetFormValue(w, r, "quorum") == "1"
+
+	deadline := time.Now().Add(wait)
+	for {
+		fence, validity, err := this.tryLock(r, name, token, ttl, quorum)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		if fence > 0 {
+			ErrorNil(w, lockGrant{Token: token, Fence: fence, TTL: int64(validity / time.Millisecond)})
+			return
+		}
+		if !time.Now().Before(deadline) {
+			ErrorExcu(w, fmt.Errorf("lock '%s' is held", name))
+			return
+		}
+
+		// Random backoff so waiters don't retry in lockstep.
+		jitter, _ := rand.Int(rand.Reader, big.NewInt(int64(lockRetryDelay)))
+		select {
+		case <-time.After(lockRetryDelay + time.Duration(jitter.Int64())):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// curl -X PUT -d "token=...&ttl=30" /lock/deploy
+func (this *CacheRequestHandler) extendLock(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	token := this.GetFormValue(w, r, "token")
+	if token == "" {
+		ErrorParam(w, "token")
+		return
+	}
+	ttl, ok := this.lockTTL(w, r)
+	if !ok {
+		return
+	}
+	quorum := this.GetFormValue(w, r, "quorum") == "1"
+
+	clients, err := this.lockClients(r, name, quorum)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	extended := 0
+	for shard, client := range clients {
+		done := traceRedis(r, shard, "EVALSHA", lockKeys(name)[0])
+		val, err := lockExtendScript.Run(client, lockKeys(name)[:1], token, int64(ttl/time.Millisecond)).Result()
+		done(err)
+		if err != nil && !quorum {
+			ErrorExcu(w, err)
+			return
+		}
+		if replyInt(val) == 1 {
+			extended++
+		}
+	}
+	ErrorNil(w, extended >= lockMajority(len(clients)))
+}
+
+// Releases the lock only if "token" still holds it.
+// curl -X DELETE "/lock/deploy?token=..."
+func (this *CacheRequestHandler) releaseLock(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	token := this.GetFormValue(w, r, "token")
+	if token == "" {
+		ErrorParam(w, "token")
+		return
+	}
+	quorum := this.GetFormValue(w, r, "quorum") == "1"
+
+	clients, err := this.lockClients(r, name, quorum)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	released := false
+	for shard, client := range clients {
+		done := traceRedis(r, shard, "EVALSHA", lockKeys(name)[0])
+		val, err := lockReleaseScript.Run(client, lockKeys(name)[:1], token).Result()
+		done(err)
+		if err != nil && !quorum {
+			ErrorExcu(w, err)
+			return
+		}
+		if replyInt(val) == 1 {
+			released = true
+		}
+	}
+	ErrorNil(w, released)
+}
+
+// lockState is one shard's view of a lock: the holder's token (empty when
+// free), its PTTL in ms and the fencing counter.
+type lockState struct {
+	token string
+	pttl  int64
+	fence int64
+}
+
+func readLockState(r *http.Request, shard string, client *redis.Client, name string) (lockState, error) {
+	keys := lockKeys(name)
+	var st lockState
+
+	done := traceRedis(r, shard, "GET", keys[0])
+	token, err := client.Get(keys[0]).Result()
+	done(err)
+	if err != nil && err != redis.Nil {
+		return st, err
+	}
+	st.token = token
+
+	done = traceRedis(r, shard, "PTTL", keys[0])
+	cmd := redis.NewIntCmd("PTTL", keys[0])
+	client.Process(cmd)
+	st.pttl, err = cmd.Result()
+	done(err)
+	if err != nil {
+		return st, err
+	}
+
+	done = traceRedis(r, shard, "GET", keys[1])
+	st.fence, err = client.Get(keys[1]).Int64()
+	done(err)
+	if err != nil && err != redis.Nil {
+		return st, err
+	}
+	return st, nil
+}
+
+// lockMajority returns the number of shards out of n a lock must be held
+// on to count as held.
+func lockMajority(n int) int {
+	return n/2 + 1
+}
+
+// agreeLock folds the shards' views of a lock: it is held when a majority
+// of all n shards report the same token. The TTL is the shortest among
+// those shards and the fence the highest seen anywhere. Without a majority
+// it fails when the shards that did not answer could have made one.
+func agreeLock(states []lockState, n int) (bool, int64, int64, error) {
+	votes := map[string]int{}
+	fence := int64(0)
+	for _, st := range states {
+		if st.token != "" {
+			votes[st.token]++
+		}
+		if st.fence > fence {
+			fence = st.fence
+		}
+	}
+	best := 0
+	for token, count := range votes {
+		if count > best {
+			best = count
+		}
+		if count < lockMajority(n) {
+			continue
+		}
+		ttl := int64(-1)
+		for _, st := range states {
+			if st.token == token && (ttl < 0 || st.pttl < ttl) {
+				ttl = st.pttl
+			}
+		}
+		return true, ttl, fence, nil
+	}
+	if best+n-len(states) >= lockMajority(n) {
+		return false, -2, fence, fmt.Errorf("%d of %d shards did not answer", n-len(states), n)
+	}
+	return false, -2, fence, nil
+}
+
+// Reports whether the lock is held, its remaining TTL in ms and the last
+// fencing token. "quorum=1" reads every shard and reports the lock held
+// only when a majority agree on the holder.
+// curl /lock/deploy
+func (this *CacheRequestHandler) getLock(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	quorum := this.GetFormValue(w, r, "quorum") == "1"
+
+	clients, err := this.lockClients(r, name, quorum)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	states := make([]lockState, 0, len(clients))
+	for shard, client := range clients {
+		st, err := readLockState(r, shard, client, name)
+		if err != nil {
+			if !quorum {
+				ErrorExcu(w, err)
+				return
+			}
+			// An unreachable shard doesn't vote; agreeLock fails if its
+			// vote could have decided.
+			continue
+		}
+		states = append(states, st)
+	}
+	locked, ttl, fence, err := agreeLock(states, len(clients))
+	if err != nil {
+		ErrorExcu(w, fmt.Errorf("lock '%s': %v", name, err))
+		return
+	}
+	ErrorNil(w, map[string]interface{}{"locked": locked, "ttl": ttl, "fence": fence})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_LockMajority(t *testing.T) {
+	for n, want := range map[int]int{1: 1, 2: 2, 3: 2, 4: 3, 5: 3} {
+		if got := lockMajority(n); got != want {
+			t.Errorf("majority of %d is %d, want %d", n, got, want)
+		}
+	}
+
+	states := []lockState{
+		{token: "a", pttl: 900, fence: 4},
+		{token: "a", pttl: 700, fence: 5},
+		{token: "b", pttl: 800, fence: 3},
+	}
+	if locked, ttl, fence, err := agreeLock(states, 3); !locked || ttl != 700 || fence != 5 || err != nil {
+		t.Errorf("two of three: %v %d %d %v", locked, ttl, fence, err)
+	}
+	// Unreachable shards still count towards the majority needed, and
+	// fail the read when they could have made it.
+	if locked, _, _, err := agreeLock(states[:2], 5); locked || err == nil {
+		t.Errorf("two of five reported %v %v", locked, err)
+	}
+	if locked, _, _, err := agreeLock([]lockState{states[0], states[2], {pttl: -2}}, 3); locked || err != nil {
+		t.Errorf("split three reported %v %v", locked, err)
+	}
+	if locked, ttl, fence, err := agreeLock([]lockState{{pttl: -2, fence: 2}}, 1); locked || ttl != -2 || fence != 2 || err != nil {
+		t.Errorf("free lock: %v %d %d %v", locked, ttl, fence, err)
+	}
+}
+
+func Test_LockFence(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"s0": {}, "s1": {}, "s2": {}}})
+
+	type grant struct {
+		Val lockGrant `json:"val"`
+	}
+	acquire := func() lockGrant {
+		w := serveTest("/lock/{name}", "POST", handler.acquireLock, "/lock/deploy", "ttl=30&quorum=1")
+		var g grant
+		if err := json.Unmarshal(w.Body.Bytes(), &g); err != nil || g.Val.Fence == 0 {
+			t.Fatalf("acquire answered %s", w.Body.String())
+		}
+		return g.Val
+	}
+	state := func() map[string]interface{} {
+		w := serveTest("/lock/{name}", "GET", handler.getLock, "/lock/deploy?quorum=1", "")
+		var v struct {
+			Val map[string]interface{} `json:"val"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatalf("get answered %s", w.Body.String())
+		}
+		return v.Val
+	}
+
+	first := acquire()
+	if st := state(); st["locked"] != true || st["fence"].(float64) != float64(first.Fence) {
+		t.Errorf("held lock reported %v", st)
+	}
+
+	// Losing the lock on one shard leaves a majority.
+	handler.master_clients["s0"].Del(lockKeys("deploy")[0])
+	if st := state(); st["locked"] != true {
+		t.Errorf("two of three reported %v", st)
+	}
+	handler.master_clients["s1"].Del(lockKeys("deploy")[0])
+	if st := state(); st["locked"] != false {
+		t.Errorf("one of three reported %v", st)
+	}
+	handler.master_clients["s2"].Del(lockKeys("deploy")[0])
+
+	// A shard whose counter lags must not hand out an older token.
+	handler.master_clients["s0"].Set(lockKeys("deploy")[1], 0, 0)
+	second := acquire()
+	if second.Fence <= first.Fence {
+		t.Errorf("fence went from %d to %d", first.Fence, second.Fence)
+	}
+	serveTest("/lock/{name}", "DELETE", handler.releaseLock, "/lock/deploy?quorum=1&token="+second.Token, "")
+	if third := acquire(); third.Fence <= second.Fence {
+		t.Errorf("fence went from %d to %d", second.Fence, third.Fence)
+	}
+}
+
+func Test_LockShardErrors(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"s0": {}, "s1": {}, "s2": {}}})
+	handler.master_clients["s1"].Set(lockKeys("deploy")[0], "other", 0)
+	handler.master_clients["s2"] = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: 0})
+
+	// s0 grants, s1 is held and s2 is down: s2 could have made the
+	// majority, so this is an error and s0's grant is released.
+	w := serveTest("/lock/{name}", "POST", handler.acquireLock, "/lock/deploy", "ttl=30&quorum=1")
+	if body := w.Body.String(); !strings.Contains(body, "shards failed") {
+		t.Errorf("acquire answered %s", body)
+	}
+	if n, _ := handler.master_clients["s0"].Exists(lockKeys("deploy")[0]).Result(); n {
+		t.Error("partial grant kept")
+	}
+	w = serveTest("/lock/{name}", "GET", handler.getLock, "/lock/deploy?quorum=1", "")
+	if body := w.Body.String(); !strings.Contains(body, `"_type":"-1"`) {
+		t.Errorf("get answered %s", body)
+	}
+}
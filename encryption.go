@@ -0,0 +1,605 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+// Values of keys under an [encryption] prefix are encrypted with AES-256-GCM
+// before they are stored. Encrypted values carry the valueMagic header with
+// their own ids and the id of the keyring key used, so keys can be rotated:
+//
+//	envelope:      header | wrapped data key | nonce | ciphertext
+//	deterministic: header | nonce | ciphertext
+//
+// String, hash and list values, JSON documents, stream field values and
+// queue items (covered by the queue name) get a random data key per value,
+// wrapped with the keyring key. Re-encryption passes rotate string, hash
+// and list values only; stream entries and queue items keep their key until
+// they are consumed, so retired keys stay in the keyring until then. Set members must stay comparable, so they are
+// encrypted deterministically with a nonce derived from the member.
+// Encryption runs after compression, and reads undo both. Until a
+// re-encryption pass completes, members written under different keyring
+// keys do not compare equal in set operations.
+const (
+	encryptEnvelope      byte = 0x10
+	encryptDeterministic byte = 0x11
+
+	dataKeySize = 32
+	// nonce + data key + GCM tag
+	wrappedKeySize = 12 + dataKeySize + 16
+
+	reencryptPage = 1000
+)
+
+type encryptionInfo struct {
+	// JSON file {"current": "<id>", "keys": {"<id>": "<base64 32 bytes>"}}.
+	Keyring  string
+	Prefixes []string
+	// Seconds between re-encryption passes, which also reload the keyring
+	// when the file changed; 0 disables them.
+	Reencrypt int
+}
+
+type keyring struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+
+	keys map[string][]byte
+}
+
+type reencryptStats struct {
+	Running   bool      `json:"running"`
+	LastStart time.Time `json:"last_start"`
+	LastEnd   time.Time `json:"last_end"`
+	Scanned   int64     `json:"scanned"`
+	Rewritten int64     `json:"rewritten"`
+	Errors    int64     `json:"errors"`
+}
+
+type encryptor struct {
+	info encryptionInfo
+
+	mu    sync.RWMutex
+	ring  *keyring
+	mtime time.Time
+	stats reencryptStats
+}
+
+// KEYS: key. ARGV: type, old value, new value, hash field or list index.
+// Replaces the value only if it is still the one that was read.
+var reencryptScript = NewLuaScript(`
+local t = ARGV[1]
+if t == 'string' then
+	if redis.call('GET', KEYS[1]) ~= ARGV[2] then
+		return 0
+	end
+	local ttl = redis.call('PTTL', KEYS[1])
+	redis.call('SET', KEYS[1], ARGV[3])
+	if ttl > 0 then
+		redis.call('PEXPIRE', KEYS[1], ttl)
+	end
+elseif t == 'hash' then
+	if redis.call('HGET', KEYS[1], ARGV[4]) ~= ARGV[2] then
+		return 0
+	end
+	redis.call('HSET', KEYS[1], ARGV[4], ARGV[3])
+elseif t == 'list' then
+	if redis.call('LINDEX', KEYS[1], ARGV[4]) ~= ARGV[2] then
+		return 0
+	end
+	redis.call('LSET', KEYS[1], ARGV[4], ARGV[3])
+elseif t == 'set' then
+	if redis.call('SREM', KEYS[1], ARGV[2]) == 0 then
+		return 0
+	end
+	redis.call('SADD', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+func loadKeyring(path string) (*keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ring := &keyring{}
+	if err := json.Unmarshal(data, ring); err != nil {
+		return nil, err
+	}
+
+	ring.keys = make(map[string][]byte, len(ring.Keys))
+	for id, k := range ring.Keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("bad key id '%s'", id)
+		}
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("key '%s' is not 32 base64 encoded bytes", id)
+		}
+		ring.keys[id] = b
+	}
+	if _, ok := ring.keys[ring.Current]; !ok {
+		return nil, fmt.Errorf("current key '%s' is not in the keyring", ring.Current)
+	}
+	return ring, nil
+}
+
+func newEncryptor(info encryptionInfo) (*encryptor, error) {
+	e := &encryptor{info: info}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// reload reads the keyring file if it changed since the last load.
+func (e *encryptor) reload() error {
+	st, err := os.Stat(e.info.Keyring)
+	if err != nil {
+		return err
+	}
+	e.mu.RLock()
+	unchanged := e.ring != nil && st.ModTime().Equal(e.mtime)
+	e.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	ring, err := loadKeyring(e.info.Keyring)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.ring, e.mtime = ring, st.ModTime()
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *encryptor) keyring() *keyring {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ring
+}
+
+func (e *encryptor) covers(key string) bool {
+	for _, prefix := range e.info.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGCM returns nonce | ciphertext; a nil nonce is random.
+func sealGCM(key, nonce, plain, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == nil {
+		nonce = make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func openGCM(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value truncated")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+func encryptHeader(mode byte, key_id string) string {
+	return valueMagic + string(mode) + string(byte(len(key_id))) + key_id
+}
+
+// parseEncrypted splits an encrypted value into its mode, key id, header and
+// body; ok is false for values that are not encrypted.
+func parseEncrypted(val string) (byte, string, string, string, bool) {
+	if !strings.HasPrefix(val, valueMagic) || len(val) < len(valueMagic)+2 {
+		return 0, "", "", "", false
+	}
+	mode := val[len(valueMagic)]
+	if mode != encryptEnvelope && mode != encryptDeterministic {
+		return 0, "", "", "", false
+	}
+	n := int(val[len(valueMagic)+1])
+	end := len(valueMagic) + 2 + n
+	if len(val) < end {
+		return 0, "", "", "", false
+	}
+	return mode, val[len(valueMagic)+2 : end], val[:end], val[end:], true
+}
+
+// memberNonce derives the nonce of a deterministic encryption from the
+// plaintext, so equal members encrypt equally.
+func memberNonce(kek []byte, plain string) []byte {
+	sub := hmac.New(sha256.New, kek)
+	sub.Write([]byte("member nonce"))
+	mac := hmac.New(sha256.New, sub.Sum(nil))
+	mac.Write([]byte(plain))
+	return mac.Sum(nil)[:12]
+}
+
+func (e *encryptor) encrypt(plain string, mode byte) (string, error) {
+	ring := e.keyring()
+	kek := ring.keys[ring.Current]
+	header := encryptHeader(mode, ring.Current)
+
+	if mode == encryptDeterministic {
+		body, err := sealGCM(kek, memberNonce(kek, plain), []byte(plain), []byte(header))
+		if err != nil {
+			return "", err
+		}
+		return header + string(body), nil
+	}
+
+	dek := make([]byte, dataKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	wrapped, err := sealGCM(kek, nil, dek, []byte(header))
+	if err != nil {
+		return "", err
+	}
+	// The body is bound to the mode only, so rotation just rewraps the
+	// data key.
+	body, err := sealGCM(dek, nil, []byte(plain), []byte(valueMagic+string(mode)))
+	if err != nil {
+		return "", err
+	}
+	return header + string(wrapped) + string(body), nil
+}
+
+func (e *encryptor) unwrapKey(key_id, header, body string) ([]byte, error) {
+	kek, ok := e.keyring().keys[key_id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key '%s'", key_id)
+	}
+	if len(body) < wrappedKeySize {
+		return nil, fmt.Errorf("encrypted value truncated")
+	}
+	return openGCM(kek, []byte(body[:wrappedKeySize]), []byte(header))
+}
+
+func (e *encryptor) decrypt(val string) (string, error) {
+	mode, key_id, header, body, ok := parseEncrypted(val)
+	if !ok {
+		return val, nil
+	}
+
+	if mode == encryptDeterministic {
+		kek, ok := e.keyring().keys[key_id]
+		if !ok {
+			return "", fmt.Errorf("unknown encryption key '%s'", key_id)
+		}
+		plain, err := openGCM(kek, []byte(body), []byte(header))
+		return string(plain), err
+	}
+
+	dek, err := e.unwrapKey(key_id, header, body)
+	if err != nil {
+		return "", err
+	}
+	plain, err := openGCM(dek, []byte(body[wrappedKeySize:]), []byte(valueMagic+string(mode)))
+	return string(plain), err
+}
+
+// rotate returns val under the current key; false when it already is or
+// is not encrypted.
+func (e *encryptor) rotate(val string) (string, bool, error) {
+	mode, key_id, header, body, ok := parseEncrypted(val)
+	ring := e.keyring()
+	if !ok || key_id == ring.Current {
+		return val, false, nil
+	}
+
+	if mode == encryptDeterministic {
+		plain, err := e.decrypt(val)
+		if err != nil {
+			return "", false, err
+		}
+		val, err = e.encrypt(plain, mode)
+		return val, err == nil, err
+	}
+
+	dek, err := e.unwrapKey(key_id, header, body)
+	if err != nil {
+		return "", false, err
+	}
+	new_header := encryptHeader(mode, ring.Current)
+	wrapped, err := sealGCM(ring.keys[ring.Current], nil, dek, []byte(new_header))
+	if err != nil {
+		return "", false, err
+	}
+	return new_header + string(wrapped) + body[wrappedKeySize:], true, nil
+}
+
+// storeValue returns a string, hash or list value as it should be stored
+// at key: compressed, then encrypted.
+func (this *CacheRequestHandler) storeValue(key, val string) (string, error) {
+	val, err := this.packValue(key, val)
+	if err != nil || this.encryptor == nil || !this.encryptor.covers(key) {
+		return val, err
+	}
+	return this.encryptor.encrypt(val, encryptEnvelope)
+}
+
+// storeValues stores vals at key in place.
+func (this *CacheRequestHandler) storeValues(key string, vals []string) error {
+	for i, v := range vals {
+		s, err := this.storeValue(key, v)
+		if err != nil {
+			return err
+		}
+		vals[i] = s
+	}
+	return nil
+}
+
+// storeMember returns a set member as stored at key.
+func (this *CacheRequestHandler) storeMember(key, member string) (string, error) {
+	if this.encryptor == nil || !this.encryptor.covers(key) {
+		return member, nil
+	}
+	return this.encryptor.encrypt(member, encryptDeterministic)
+}
+
+// storeMembers stores members at key in place.
+func (this *CacheRequestHandler) storeMembers(key string, members []string) error {
+	for i, m := range members {
+		s, err := this.storeMember(key, m)
+		if err != nil {
+			return err
+		}
+		members[i] = s
+	}
+	return nil
+}
+
+func (this *CacheRequestHandler) decryptValue(val string) (string, error) {
+	if _, _, _, _, ok := parseEncrypted(val); !ok {
+		return val, nil
+	}
+	if this.encryptor == nil {
+		return "", fmt.Errorf("value is encrypted and no keyring is configured")
+	}
+	return this.encryptor.decrypt(val)
+}
+
+// loadValue returns the original of a stored string, hash or list value.
+func (this *CacheRequestHandler) loadValue(val string) (string, error) {
+	val, err := this.decryptValue(val)
+	if err != nil {
+		return "", err
+	}
+	return unpackValue(val)
+}
+
+// loadMembers returns the original of stored set members in place.
+func (this *CacheRequestHandler) loadMembers(members []string) error {
+	for i, m := range members {
+		s, err := this.decryptValue(m)
+		if err != nil {
+			return err
+		}
+		members[i] = s
+	}
+	return nil
+}
+
+// reencryptLoop periodically reloads the keyring and moves values still
+// encrypted with an older key to the current one.
+func (this *CacheRequestHandler) reencryptLoop() {
+	for range time.Tick(time.Duration(this.encryptor.info.Reencrypt) * time.Second) {
+		this.reencrypt()
+	}
+}
+
+func (this *CacheRequestHandler) reencrypt() {
+	e := this.encryptor
+	if err := e.reload(); err != nil {
+		logError("keyring reload", "err", err)
+	}
+
+	e.mu.Lock()
+	if e.stats.Running {
+		e.mu.Unlock()
+		return
+	}
+	e.stats = reencryptStats{Running: true, LastStart: time.Now()}
+	e.mu.Unlock()
+
+	var scanned, rewritten, errors int64
+	for shard, client := range this.master_clients {
+		for _, prefix := range e.info.Prefixes {
+			s, r, n, err := this.reencryptShard(client, prefix)
+			scanned, rewritten, errors = scanned+s, rewritten+r, errors+n
+			if err != nil {
+				logError("reencrypt", "shard", shard, "err", err)
+				errors++
+			}
+		}
+	}
+
+	e.mu.Lock()
+	e.stats = reencryptStats{
+		LastStart: e.stats.LastStart,
+		LastEnd:   time.Now(),
+		Scanned:   scanned,
+		Rewritten: rewritten,
+		Errors:    errors,
+	}
+	e.mu.Unlock()
+}
+
+// reencryptShard rotates every key under prefix on the shard and returns
+// the keys scanned, values rewritten and values that failed.
+func (this *CacheRequestHandler) reencryptShard(client *redis.Client, prefix string) (int64, int64, int64, error) {
+	var scanned, rewritten, errors int64
+	cursor := uint64(0)
+	for {
+		keys, next, err := client.Scan(cursor, prefix+"*", reencryptPage).Result()
+		if err != nil {
+			return scanned, rewritten, errors, err
+		}
+		for _, key := range keys {
+			scanned++
+			r, n, err := this.reencryptKey(client, key)
+			rewritten, errors = rewritten+r, errors+n
+			if err != nil {
+				logError("reencrypt", "key", redactKey("hash", key), "err", err)
+				errors++
+			}
+		}
+		if next == 0 {
+			return scanned, rewritten, errors, nil
+		}
+		cursor = next
+	}
+}
+
+func (this *CacheRequestHandler) reencryptKey(client *redis.Client, key string) (int64, int64, error) {
+	var rewritten, errors int64
+	rewrite := func(kind, old, field string) {
+		val, changed, err := this.encryptor.rotate(old)
+		if err != nil {
+			errors++
+			return
+		}
+		if !changed {
+			return
+		}
+		ok, err := reencryptScript.Run(client, []string{key}, kind, old, val, field).Result()
+		if err != nil {
+			errors++
+		} else if replyInt(ok) == 1 {
+			rewritten++
+		}
+	}
+
+	kind, err := client.Type(key).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch kind {
+	case "string":
+		val, err := client.Get(key).Result()
+		if err == redis.Nil {
+			return 0, 0, nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+		rewrite(kind, val, "")
+	case "hash", "set":
+		cursor := uint64(0)
+		for {
+			var cmd *redis.ScanCmd
+			if kind == "hash" {
+				cmd = client.HScan(key, cursor, "", reencryptPage).ScanCmd
+			} else {
+				cmd = client.SScan(key, cursor, "", reencryptPage).ScanCmd
+			}
+			vals, next, err := cmd.Result()
+			if err != nil {
+				return rewritten, errors, err
+			}
+			if kind == "hash" {
+				for i := 0; i+1 < len(vals); i += 2 {
+					rewrite(kind, vals[i+1], vals[i])
+				}
+			} else {
+				for _, m := range vals {
+					rewrite(kind, m, "")
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	case "list":
+		for start := int64(0); ; start += reencryptPage {
+			vals, err := client.LRange(key, start, start+reencryptPage-1).Result()
+			if err != nil {
+				return rewritten, errors, err
+			}
+			for i, v := range vals {
+				rewrite(kind, v, fmt.Sprint(start+int64(i)))
+			}
+			if len(vals) < reencryptPage {
+				break
+			}
+		}
+	}
+	return rewritten, errors, nil
+}
+
+// Returns the keyring ids in use and the last re-encryption pass.
+// curl /encryption
+func (this *CacheRequestHandler) getEncryption(w http.ResponseWriter, r *http.Request) {
+	e := this.encryptor
+	if e == nil {
+		ErrorValNone(w)
+		return
+	}
+	ring := e.keyring()
+	ids := make([]string, 0, len(ring.keys))
+	for id := range ring.keys {
+		ids = append(ids, id)
+	}
+	e.mu.RLock()
+	stats := e.stats
+	e.mu.RUnlock()
+	ErrorNil(w, map[string]interface{}{
+		"current":   ring.Current,
+		"keys":      ids,
+		"prefixes":  e.info.Prefixes,
+		"reencrypt": stats,
+	})
+}
+
+// Reloads the keyring and starts a re-encryption pass now.
+// curl -X POST /encryption/reencrypt
+func (this *CacheRequestHandler) startReencrypt(w http.ResponseWriter, r *http.Request) {
+	if this.encryptor == nil {
+		ErrorValNone(w)
+		return
+	}
+	if err := this.encryptor.reload(); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	go this.reencrypt()
+	ErrorNil(w, nil)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func writeKeyring(t *testing.T, path, current string, ids ...string) {
+	keys := []string{}
+	for i, id := range ids {
+		k := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('a'+i)), 32)))
+		keys = append(keys, `"`+id+`":"`+k+`"`)
+	}
+	data := `{"current":"` + current + `","keys":{` + strings.Join(keys, ",") + `}}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+	writeKeyring(t, path, "k1", "k1")
+
+	handler := new(CacheRequestHandler)
+	handler.initCompression(map[string]compressionInfo{
+		"secret": {Prefix: "secret:", Algorithm: "gzip"},
+	})
+	handler.encryptor, err = newEncryptor(encryptionInfo{Keyring: path, Prefixes: []string{"secret:"}})
+	if err != nil {
+		t.Fatalf("newEncryptor Error:%v", err.Error())
+	}
+
+	val := strings.Repeat("token ", 50)
+	stored, err := handler.storeValue("secret:1", val)
+	if err != nil {
+		t.Fatalf("storeValue Error:%v", err.Error())
+	}
+	if _, key_id, _, _, ok := parseEncrypted(stored); !ok || key_id != "k1" {
+		t.Fatalf("stored value not encrypted with k1")
+	}
+	if strings.Contains(stored, "token") {
+		t.Errorf("plaintext in stored value")
+	}
+	if plain, _ := handler.storeValue("public:1", "token"); plain != "token" {
+		t.Errorf("uncovered key stored as %q", plain)
+	}
+
+	m1, _ := handler.storeMember("secret:set", "alice")
+	m2, _ := handler.storeMember("secret:set", "alice")
+	if m1 != m2 || m1 == "alice" {
+		t.Errorf("members should encrypt deterministically")
+	}
+
+	// Rotate: k2 becomes current, k1 stays readable until rewrapped.
+	writeKeyring(t, path, "k2", "k1", "k2")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if err := handler.encryptor.reload(); err != nil {
+		t.Fatalf("reload Error:%v", err.Error())
+	}
+
+	for _, s := range []string{stored, m1} {
+		rotated, changed, err := handler.encryptor.rotate(s)
+		if err != nil || !changed {
+			t.Fatalf("rotate: %v, %v", changed, err)
+		}
+		if _, key_id, _, _, _ := parseEncrypted(rotated); key_id != "k2" {
+			t.Errorf("rotated with %s", key_id)
+		}
+		if _, changed, _ := handler.encryptor.rotate(rotated); changed {
+			t.Errorf("current value rotated again")
+		}
+		if s == stored {
+			if orig, err := handler.loadValue(rotated); err != nil || orig != val {
+				t.Errorf("loadValue after rotation: %v", err)
+			}
+		} else if m, _ := handler.storeMember("secret:set", "alice"); m != rotated {
+			t.Errorf("rotated member differs from a new write")
+		}
+	}
+	if orig, err := handler.loadValue(stored); err != nil || orig != val {
+		t.Errorf("loadValue with old key: %v", err)
+	}
+
+	tampered := stored[:len(stored)-1] + string(stored[len(stored)-1]^1)
+	if _, err := handler.loadValue(tampered); err == nil {
+		t.Errorf("tampered value should fail")
+	}
+}
+
+func Test_EncryptedStreamQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+	writeKeyring(t, path, "k1", "k1")
+
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+	handler.encryptor, err = newEncryptor(encryptionInfo{Keyring: path, Prefixes: []string{"secret:"}})
+	if err != nil {
+		t.Fatalf("newEncryptor Error:%v", err.Error())
+	}
+	_, client, _ := handler.keyClient(nil, "secret:s")
+
+	serveTest("/stream/{key}", "POST", handler.addStream, "/stream/secret:s", "field=token&value=hunter2")
+	raw := redis.NewCmd("XRANGE", "secret:s", "-", "+")
+	client.Process(raw)
+	if entries, _ := parseStreamEntries(raw.Val()); len(entries) != 1 || strings.Contains(fmt.Sprint(entries), "hunter2") {
+		t.Errorf("stream stored %v", entries)
+	}
+	w := serveTest("/stream/{key}", "GET", handler.getStream, "/stream/secret:s", "")
+	if !strings.Contains(w.Body.String(), `"token":"hunter2"`) {
+		t.Errorf("xrange: %s", w.Body.String())
+	}
+
+	serveTest("/queue/{name}", "POST", handler.enqueue, "/queue/secret:q", "value=hunter2")
+	for _, v := range client.HVals(queueKey("secret:q", "items")).Val() {
+		if strings.Contains(v, "hunter2") {
+			t.Errorf("queue item stored in the clear")
+		}
+	}
+	w = serveTest("/queue/{name}/dequeue", "POST", handler.dequeue, "/queue/secret:q/dequeue", "consumer=c1")
+	if !strings.Contains(w.Body.String(), `"value":"hunter2"`) {
+		t.Errorf("dequeue: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// testHandler serves the shards of cfg from separate, flushed databases of
+// the Redis at FXQA_TEST_REDIS, skipping the test when there is none.
+func testHandler(t *testing.T, cfg cacheConfig) *CacheRequestHandler {
+	addr := os.Getenv("FXQA_TEST_REDIS")
+	if addr == "" {
+		t.Skip("FXQA_TEST_REDIS not set")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err != nil {
+		t.Skipf("no redis at %s", addr)
+	} else {
+		c.Close()
+	}
+
+	handler := new(CacheRequestHandler)
+	handler.master_clients = make(map[string]*redis.Client)
+	handler.block_clients = make(map[string]*redis.Client)
+	handler.master_hashRing = NewConsisten()
+	handler.pubsub = newPubSubHub(handler)
+	handler.rate_limits = make(map[string]rateLimitInfo)
+	if err := handler.initNamespaces(&cfg); err != nil {
+		t.Fatalf("initNamespaces Error:%v", err.Error())
+	}
+	if err := handler.initGroups(cfg); err != nil {
+		t.Fatalf("initGroups Error:%v", err.Error())
+	}
+
+	names := []string{}
+	for name := range cfg.Redis {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		client := redis.NewClient(&redis.Options{Addr: addr, DB: i + 1})
+		if err := client.FlushDb().Err(); err != nil {
+			t.Fatalf("FlushDb Error:%v", err.Error())
+		}
+		handler.master_clients[name] = client
+		handler.block_clients[name] = client
+		handler.addToRings(name)
+	}
+	handler.checkRings()
+	return handler
+}
+
+// serveTest sends an HTTP request to handle registered on path.
+func serveTest(path, method string, handle http.HandlerFunc, target, body string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc(path, handle).Methods(method)
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
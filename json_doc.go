@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// JSON documents are plain strings, so this works without RedisJSON. Path
+// updates read the document, change it in the proxy and write it back with
+// a compare-and-set on the owning shard, retrying when it changed between.
+// Documents are stored like string values, compressed and encrypted as
+// configured for their key.
+const jsonUpdateRetries = 10
+
+// KEYS: doc. ARGV: sha1 of the document read ("" when it was missing, "*"
+// to write unconditionally), new document. Keeps the key's TTL.
+// Returns 0 when the document changed since it was read.
+var jsonCASScript = NewLuaScript(`
+local cur = redis.call('GET', KEYS[1])
+if ARGV[1] ~= '*' then
+	if cur then
+		if redis.sha1hex(cur) ~= ARGV[1] then
+			return 0
+		end
+	elseif ARGV[1] ~= '' then
+		return 0
+	end
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[2])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+var errJSONConflict = fmt.Errorf("document kept changing, update abandoned")
+
+// updateJSON applies fn to the decoded document at key until the write
+// back is not raced by another update, and returns fn's result.
+func (this *CacheRequestHandler) updateJSON(r *http.Request, key string, fn func(doc interface{}) (interface{}, interface{}, error)) (interface{}, error) {
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < jsonUpdateRetries; i++ {
+		done := traceRedis(r, name, "GET", key)
+		cur, err := client.Get(key).Result()
+		done(err)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := this.loadJSON(cur)
+		if err != nil {
+			return nil, err
+		}
+
+		doc, res, err := fn(doc)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := this.storeValue(key, string(b))
+		if err != nil {
+			return nil, err
+		}
+
+		done = traceRedis(r, name, "EVALSHA", key)
+		val, err := jsonCASScript.Run(client, []string{key}, sha1Hex(cur), stored).Result()
+		done(err)
+		if err != nil {
+			return nil, err
+		}
+		if replyInt(val) == 1 {
+			return res, nil
+		}
+	}
+	return nil, errJSONConflict
+}
+
+// loadJSON decodes a document as stored.
+func (this *CacheRequestHandler) loadJSON(cur string) (interface{}, error) {
+	plain, err := this.loadValue(cur)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeJSON([]byte(plain))
+	if err != nil {
+		return nil, fmt.Errorf("stored value is not JSON: %s", err.Error())
+	}
+	return doc, nil
+}
+
+// jsonValue returns the JSON value of the request: the body when sent as
+// application/json, otherwise the "value" form field.
+func (this *CacheRequestHandler) jsonValue(w http.ResponseWriter, r *http.Request) (interface{}, bool) {
+	var data []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ErrorExcu(w, err)
+			return nil, false
+		}
+		data = b
+	} else {
+		data = []byte(this.GetFormValue(w, r, "value"))
+	}
+
+	v, err := decodeJSON(data)
+	if err != nil {
+		ErrorParam(w, "value")
+		return nil, false
+	}
+	return v, true
+}
+
+func (this *CacheRequestHandler) jsonPath(w http.ResponseWriter, r *http.Request) ([]jsonStep, bool) {
+	steps, err := parseJSONPath(this.GetFormValue(w, r, "path"))
+	if err != nil {
+		ErrorExcu(w, err)
+		return nil, false
+	}
+	return steps, true
+}
+
+func jsonReply(w http.ResponseWriter, val interface{}, err error) {
+	if err == redis.Nil {
+		ErrorValNone(w)
+	} else if err != nil {
+		ErrorExcu(w, err)
+	} else {
+		ErrorNil(w, val)
+	}
+}
+
+// Returns the values matched by "path" (default $).
+// curl "/json/run:42?path=$.results[*].status"
+func (this *CacheRequestHandler) getJSON(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	steps, ok := this.jsonPath(w, r)
+	if !ok {
+		return
+	}
+
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, name, "GET", key)
+	cur, err := client.Get(key).Result()
+	done(err)
+	if err != nil {
+		jsonReply(w, nil, err)
+		return
+	}
+	doc, err := this.loadJSON(cur)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	matches := []interface{}{}
+	jsonApply(doc, steps, func(v interface{}, exists bool) (interface{}, bool, error) {
+		if exists {
+			matches = append(matches, v)
+		}
+		return v, exists, nil
+	})
+	ErrorNil(w, matches)
+}
+
+// Sets the value at "path"; $ (the default) replaces the whole document.
+// Only the last step of a path may name a missing object member.
+// curl -X PUT -d 'path=$.status&value="passed"' /json/run:42
+// curl -X PUT -H "Content-Type: application/json" -d '{"status":"new"}' /json/run:42
+func (this *CacheRequestHandler) setJSON(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	steps, ok := this.jsonPath(w, r)
+	if !ok {
+		return
+	}
+	value, ok := this.jsonValue(w, r)
+	if !ok {
+		return
+	}
+
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if len(steps) == 0 {
+		b, _ := json.Marshal(value)
+		stored, err := this.storeValue(key, string(b))
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		done := traceRedis(r, name, "EVALSHA", key)
+		err = jsonCASScript.Run(client, []string{key}, "*", stored).Err()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	} else {
+		_, err := this.updateJSON(r, key, func(doc interface{}) (interface{}, interface{}, error) {
+			set := 0
+			doc, _, err := jsonApply(doc, steps, func(v interface{}, exists bool) (interface{}, bool, error) {
+				set++
+				return value, true, nil
+			})
+			if err == nil && set == 0 {
+				err = fmt.Errorf("path matches nothing")
+			}
+			return doc, set, err
+		})
+		if err != nil {
+			jsonReply(w, nil, err)
+			return
+		}
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, name, key, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, nil)
+}
+
+// Deletes the values matched by "path" and returns how many; $ deletes the
+// document.
+// curl -X DELETE "/json/run:42?path=$.results[0]"
+func (this *CacheRequestHandler) delJSON(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	steps, ok := this.jsonPath(w, r)
+	if !ok {
+		return
+	}
+
+	if len(steps) == 0 {
+		name, client, err := this.keyClient(r, key)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		done := traceRedis(r, name, "DEL", key)
+		val, err := client.Del(key).Result()
+		done(err)
+		jsonReply(w, val, err)
+		return
+	}
+	val, err := this.updateJSON(r, key, func(doc interface{}) (interface{}, interface{}, error) {
+		doc, n, err := jsonApply(doc, steps, func(v interface{}, exists bool) (interface{}, bool, error) {
+			return v, false, nil
+		})
+		return doc, n, err
+	})
+	jsonReply(w, val, err)
+}
+
+// Appends the "value"s to the arrays matched by "path" and returns their
+// new lengths.
+// curl -d 'path=$.results&value={"case":"t1"}&value={"case":"t2"}' /json/run:42/arrappend
+func (this *CacheRequestHandler) appendJSON(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	steps, ok := this.jsonPath(w, r)
+	if !ok {
+		return
+	}
+	values := []interface{}{}
+	for _, s := range r.Form["value"] {
+		v, err := decodeJSON([]byte(s))
+		if err != nil {
+			ErrorParam(w, "value")
+			return
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		ErrorParam(w, "value")
+		return
+	}
+
+	val, err := this.updateJSON(r, key, func(doc interface{}) (interface{}, interface{}, error) {
+		lens := []int{}
+		doc, _, err := jsonApply(doc, steps, func(v interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return v, false, nil
+			}
+			arr, ok := v.([]interface{})
+			if !ok {
+				return v, true, fmt.Errorf("value is not an array")
+			}
+			arr = append(arr, values...)
+			lens = append(lens, len(arr))
+			return arr, true, nil
+		})
+		return doc, lens, err
+	})
+	jsonReply(w, val, err)
+}
+
+// Adds "by" to the numbers matched by "path" and returns the new values.
+// curl -d "path=$.stats.failed&by=1" /json/run:42/numincrby
+func (this *CacheRequestHandler) incrJSON(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	steps, ok := this.jsonPath(w, r)
+	if !ok {
+		return
+	}
+	by := json.Number(this.GetFormValue(w, r, "by"))
+	if _, err := by.Float64(); err != nil {
+		ErrorParam(w, "by")
+		return
+	}
+
+	val, err := this.updateJSON(r, key, func(doc interface{}) (interface{}, interface{}, error) {
+		nums := []json.Number{}
+		doc, _, err := jsonApply(doc, steps, func(v interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return v, false, nil
+			}
+			n, err := jsonIncr(v, by)
+			if err != nil {
+				return v, true, err
+			}
+			nums = append(nums, n)
+			return n, true, nil
+		})
+		return doc, nums, err
+	})
+	jsonReply(w, val, err)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonStep is one step of a JSONPath: an object member, an array index
+// (negative counts from the end) or "*" for every child.
+type jsonStep struct {
+	name     string
+	index    int
+	is_index bool
+	wildcard bool
+}
+
+// parseJSONPath parses the JSONPath subset the /json endpoints support:
+// $, .name, ['name'], [n], [-n], .* and [*].
+func parseJSONPath(path string) ([]jsonStep, error) {
+	if path == "" {
+		path = "$"
+	}
+	if path[0] != '$' {
+		return nil, fmt.Errorf("path '%s' must start with $", path)
+	}
+
+	steps := []jsonStep{}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			if name == "" {
+				return nil, fmt.Errorf("path '%s': empty member name", path)
+			}
+			steps = append(steps, jsonStep{name: name, wildcard: name == "*"})
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path '%s': missing ]", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, jsonStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, jsonStep{name: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("path '%s': bad index '%s'", path, inner)
+				}
+				steps = append(steps, jsonStep{index: n, is_index: true})
+			}
+		default:
+			return nil, fmt.Errorf("path '%s': unexpected '%c'", path, rest[0])
+		}
+	}
+	return steps, nil
+}
+
+// jsonVisit is called on every node a path matches; exists is false for a
+// missing object member named by the last step. It returns the node's new
+// value and false to remove it.
+type jsonVisit func(v interface{}, exists bool) (interface{}, bool, error)
+
+// jsonApply walks steps from v, calls fn on each match and returns the
+// updated v and the number of existing nodes matched.
+func jsonApply(v interface{}, steps []jsonStep, fn jsonVisit) (interface{}, int, error) {
+	if len(steps) == 0 {
+		nv, _, err := fn(v, true)
+		return nv, 1, err
+	}
+	step, rest := steps[0], steps[1:]
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if step.is_index {
+			return v, 0, nil
+		}
+		names := []string{step.name}
+		if step.wildcard {
+			names = names[:0]
+			for name := range node {
+				names = append(names, name)
+			}
+		}
+		total := 0
+		for _, name := range names {
+			child, ok := node[name]
+			if !ok {
+				if len(rest) > 0 {
+					continue
+				}
+				nv, keep, err := fn(nil, false)
+				if err != nil {
+					return v, total, err
+				}
+				if keep {
+					node[name] = nv
+				}
+				continue
+			}
+
+			var n int
+			var err error
+			keep := true
+			if len(rest) == 0 {
+				child, keep, err = fn(child, true)
+				n = 1
+			} else {
+				child, n, err = jsonApply(child, rest, fn)
+			}
+			total += n
+			if err != nil {
+				return v, total, err
+			}
+			if keep {
+				node[name] = child
+			} else {
+				delete(node, name)
+			}
+		}
+		return node, total, nil
+
+	case []interface{}:
+		if !step.is_index && !step.wildcard {
+			return v, 0, nil
+		}
+		indexes := []int{}
+		if step.wildcard {
+			for i := range node {
+				indexes = append(indexes, i)
+			}
+		} else {
+			i := step.index
+			if i < 0 {
+				i += len(node)
+			}
+			if i < 0 || i >= len(node) {
+				return v, 0, nil
+			}
+			indexes = append(indexes, i)
+		}
+
+		total := 0
+		removed := map[int]bool{}
+		for _, i := range indexes {
+			var n int
+			var err error
+			keep := true
+			if len(rest) == 0 {
+				node[i], keep, err = fn(node[i], true)
+				n = 1
+			} else {
+				node[i], n, err = jsonApply(node[i], rest, fn)
+			}
+			total += n
+			if err != nil {
+				return v, total, err
+			}
+			if !keep {
+				removed[i] = true
+			}
+		}
+		if len(removed) == 0 {
+			return node, total, nil
+		}
+		kept := make([]interface{}, 0, len(node)-len(removed))
+		for i, child := range node {
+			if !removed[i] {
+				kept = append(kept, child)
+			}
+		}
+		return kept, total, nil
+	}
+	return v, 0, nil
+}
+
+// decodeJSON decodes a document keeping numbers as written.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return v, nil
+}
+
+// jsonIncr adds by to the number v, staying integral when both are.
+func jsonIncr(v interface{}, by json.Number) (json.Number, error) {
+	num, ok := v.(json.Number)
+	if !ok {
+		return "", fmt.Errorf("value is not a number")
+	}
+	a, err0 := num.Int64()
+	b, err1 := by.Int64()
+	if err0 == nil && err1 == nil {
+		return json.Number(strconv.FormatInt(a+b, 10)), nil
+	}
+	fa, err := num.Float64()
+	if err != nil {
+		return "", err
+	}
+	fb, err := by.Float64()
+	if err != nil {
+		return "", err
+	}
+	return json.Number(strconv.FormatFloat(fa+fb, 'g', -1, 64)), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_ParseJSONPath(t *testing.T) {
+	for _, path := range []string{"", "$", "$.a.b", "$['a b'][0]", "$.a[-1].*", "$[*]"} {
+		if _, err := parseJSONPath(path); err != nil {
+			t.Errorf("parseJSONPath(%q) Error:%v", path, err.Error())
+		}
+	}
+	for _, path := range []string{"a", "$.", "$[0", "$[x]", "$a"} {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("parseJSONPath(%q) should fail", path)
+		}
+	}
+}
+
+func applyJSON(t *testing.T, doc, path string, fn jsonVisit) (string, int) {
+	v, err := decodeJSON([]byte(doc))
+	if err != nil {
+		t.Fatalf("decodeJSON(%q) Error:%v", doc, err.Error())
+	}
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		t.Fatalf("parseJSONPath(%q) Error:%v", path, err.Error())
+	}
+	v, n, err := jsonApply(v, steps, fn)
+	if err != nil {
+		t.Fatalf("jsonApply(%q) Error:%v", path, err.Error())
+	}
+	b, _ := json.Marshal(v)
+	return string(b), n
+}
+
+func Test_JSONApply(t *testing.T) {
+	set := func(v interface{}, exists bool) (interface{}, bool, error) {
+		return json.Number("7"), true, nil
+	}
+	del := func(v interface{}, exists bool) (interface{}, bool, error) {
+		return v, false, nil
+	}
+	incr := func(v interface{}, exists bool) (interface{}, bool, error) {
+		if !exists {
+			return v, false, nil
+		}
+		n, err := jsonIncr(v, "1")
+		return n, true, err
+	}
+
+	doc := `{"a":{"b":1},"l":[1,2,3]}`
+	cases := []struct {
+		path string
+		fn   jsonVisit
+		want string
+		n    int
+	}{
+		{"$.a.b", set, `{"a":{"b":7},"l":[1,2,3]}`, 1},
+		{"$.a.c", set, `{"a":{"b":1,"c":7},"l":[1,2,3]}`, 0},
+		{"$.x.c", set, doc, 0},
+		{"$.l[-1]", set, `{"a":{"b":1},"l":[1,2,7]}`, 1},
+		{"$.l[5]", set, doc, 0},
+		{"$.l[*]", incr, `{"a":{"b":1},"l":[2,3,4]}`, 3},
+		{"$['l'][0]", del, `{"a":{"b":1},"l":[2,3]}`, 1},
+		{"$.a", del, `{"l":[1,2,3]}`, 1},
+		{"$.l.x", del, doc, 0},
+	}
+	for _, c := range cases {
+		got, n := applyJSON(t, doc, c.path, c.fn)
+		if got != c.want || n != c.n {
+			t.Errorf("%s: got %s (%d), want %s (%d)", c.path, got, n, c.want, c.n)
+		}
+	}
+}
+
+func Test_JSONIncr(t *testing.T) {
+	cases := []struct{ v, by, want string }{
+		{"1", "2", "3"},
+		{"1.5", "1", "2.5"},
+		{"9007199254740993", "1", "9007199254740994"},
+	}
+	for _, c := range cases {
+		got, err := jsonIncr(json.Number(c.v), json.Number(c.by))
+		if err != nil || string(got) != c.want {
+			t.Errorf("jsonIncr(%s, %s) = %s, %v, want %s", c.v, c.by, got, err, c.want)
+		}
+	}
+	if _, err := jsonIncr("x", "1"); err == nil {
+		t.Errorf("jsonIncr on a string should fail")
+	}
+}
+
+func Test_JSONCompressed(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+	err := handler.initCompression(map[string]compressionInfo{
+		"reports": {Prefix: "report:", Algorithm: "gzip", MinSize: 16},
+	})
+	if err != nil {
+		t.Fatalf("initCompression Error:%v", err.Error())
+	}
+	_, client, _ := handler.keyClient(nil, "report:1")
+
+	doc := `{"status":"` + strings.Repeat("running ", 20) + `","failed":1}`
+	serveTest("/json/{key}", "PUT", handler.setJSON, "/json/report:1", "value="+url.QueryEscape(doc))
+	if id, _ := storedAlgorithm(client.Get("report:1").Val()); id != compressGzip {
+		t.Fatalf("document stored with algorithm %d", id)
+	}
+
+	w := serveTest("/json/{key}/numincrby", "POST", handler.incrJSON, "/json/report:1/numincrby", "path=$.failed&by=2")
+	if !strings.Contains(w.Body.String(), `[3]`) {
+		t.Errorf("numincrby: %s", w.Body.String())
+	}
+	w = serveTest("/json/{key}", "GET", handler.getJSON, "/json/report:1?path=$.failed", "")
+	if !strings.Contains(w.Body.String(), `"val":[3]`) {
+		t.Errorf("get: %s", w.Body.String())
+	}
+	if id, _ := storedAlgorithm(client.Get("report:1").Val()); id != compressGzip {
+		t.Errorf("update stored with algorithm %d", id)
+	}
+}
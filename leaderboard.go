@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// A leaderboard lives on the shard its name hashes to:
+//
+//	leaderboard:<name>                 zset member -> score (all time)
+//	leaderboard:<name>:d:<yyyymmdd>    daily board
+//	leaderboard:<name>:w:<yyyy>-<ww>   weekly board (ISO week)
+//	leaderboard:<name>:meta            hash member -> metadata
+//	leaderboard:<name>:conf            hash order, policy, keep
+//
+// Periods are in UTC. A windowed board expires "keep" periods after it
+// closes, so the previous day or week can still be read.
+const (
+	defaultLeaderboardPolicy = "best"
+	defaultLeaderboardKeep   = 1
+	defaultLeaderboardCount  = 10
+	maxLeaderboardAround     = 100
+)
+
+func leaderboardKey(name, part string) string {
+	if part == "" {
+		return "leaderboard:" + name
+	}
+	return "leaderboard:" + name + ":" + part
+}
+
+// KEYS: meta, board... ARGV: member, score, policy, asc ("1"), meta or "",
+// then the expire time in ms (0 for none) of each board.
+// Returns the member's resulting score on each board.
+var leaderboardSubmitScript = NewLuaScript(`
+local member, score, policy = ARGV[1], tonumber(ARGV[2]), ARGV[3]
+local asc = ARGV[4] == '1'
+if ARGV[5] ~= '' then
+	redis.call('HSET', KEYS[1], member, ARGV[5])
+end
+local scores = {}
+for i = 2, #KEYS do
+	local cur = tonumber(redis.call('ZSCORE', KEYS[i], member))
+	local new = score
+	if policy == 'sum' then
+		new = (cur or 0) + score
+	elseif policy == 'best' and cur then
+		if (asc and cur < score) or (not asc and cur > score) then
+			new = cur
+		end
+	end
+	if new ~= cur then
+		redis.call('ZADD', KEYS[i], new, member)
+	end
+	local exp = tonumber(ARGV[4 + i])
+	if exp > 0 then
+		redis.call('PEXPIREAT', KEYS[i], exp)
+	end
+	scores[#scores + 1] = tostring(new)
+end
+return scores
+`)
+
+type leaderboardConf struct {
+	// Lowest score ranks first, e.g. for race times.
+	Asc    bool
+	Policy string
+	Keep   int
+}
+
+type leaderboardEntry struct {
+	Rank   int64   `json:"rank"`
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	Meta   string  `json:"meta,omitempty"`
+}
+
+func leaderboardPolicy(policy string) bool {
+	return policy == "best" || policy == "latest" || policy == "sum"
+}
+
+func getLeaderboardConf(r *http.Request, shard string, client *redis.Client, name string) (leaderboardConf, error) {
+	conf := leaderboardConf{Policy: defaultLeaderboardPolicy, Keep: defaultLeaderboardKeep}
+	done := traceRedis(r, shard, "HMGET", leaderboardKey(name, "conf"))
+	vals, err := client.HMGet(leaderboardKey(name, "conf"), "order", "policy", "keep").Result()
+	done(err)
+	if err != nil {
+		return conf, err
+	}
+	conf.Asc = replyString(vals[0]) == "asc"
+	if p := replyString(vals[1]); p != "" {
+		conf.Policy = p
+	}
+	if vals[2] != nil {
+		conf.Keep = int(replyInt(vals[2]))
+	}
+	return conf, nil
+}
+
+// leaderboardPeriod returns the key part of the window containing t and when
+// that window's board should expire. The all-time board ("" or "all") never
+// expires.
+func leaderboardPeriod(window string, t time.Time, keep int) (string, time.Time, error) {
+	t = t.UTC()
+	switch window {
+	case "", "all":
+		return "", time.Time{}, nil
+	case "daily":
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return "d:" + start.Format("20060102"), start.AddDate(0, 0, 1+keep), nil
+	case "weekly":
+		year, week := t.ISOWeek()
+		// ISO weeks start on Monday.
+		offset := (int(t.Weekday()) + 6) % 7
+		start := time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+		return fmt.Sprintf("w:%04d-%02d", year, week), start.AddDate(0, 0, 7*(1+keep)), nil
+	}
+	return "", time.Time{}, fmt.Errorf("unknown window '%s'", window)
+}
+
+// leaderboardTime is the moment whose period is read: now, or "at" (unix
+// seconds) to look at a past day or week.
+func (this *CacheRequestHandler) leaderboardTime(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	at := this.GetFormValue(w, r, "at")
+	if at == "" {
+		return time.Now(), true
+	}
+	ts, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		ErrorParam(w, "at")
+		return time.Time{}, false
+	}
+	return time.Unix(ts, 0), true
+}
+
+// leaderboardBoard resolves the "window" of a read to its board key.
+func (this *CacheRequestHandler) leaderboardBoard(w http.ResponseWriter, r *http.Request, name string, conf leaderboardConf) (string, bool) {
+	t, ok := this.leaderboardTime(w, r)
+	if !ok {
+		return "", false
+	}
+	part, _, err := leaderboardPeriod(this.GetFormValue(w, r, "window"), t, conf.Keep)
+	if err != nil {
+		ErrorParam(w, "window")
+		return "", false
+	}
+	return leaderboardKey(name, part), true
+}
+
+// leaderboardEntries ranks vals, which start at zero based position start,
+// and joins their metadata when withMeta is set.
+func leaderboardEntries(r *http.Request, shard string, client *redis.Client, name string, start int64, vals []redis.Z, withMeta bool) ([]leaderboardEntry, error) {
+	entries := make([]leaderboardEntry, len(vals))
+	members := make([]string, len(vals))
+	for i, z := range vals {
+		members[i] = replyString(z.Member)
+		entries[i] = leaderboardEntry{Rank: start + int64(i) + 1, Member: members[i], Score: z.Score}
+	}
+	if !withMeta || len(members) == 0 {
+		return entries, nil
+	}
+
+	done := traceRedis(r, shard, "HMGET", leaderboardKey(name, "meta"))
+	metas, err := client.HMGet(leaderboardKey(name, "meta"), members...).Result()
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range metas {
+		entries[i].Meta = replyString(m)
+	}
+	return entries, nil
+}
+
+func leaderboardRange(r *http.Request, shard string, client *redis.Client, key string, conf leaderboardConf, start, stop int64) ([]redis.Z, error) {
+	if conf.Asc {
+		done := traceRedis(r, shard, "ZRANGE", key)
+		vals, err := client.ZRangeWithScores(key, start, stop).Result()
+		done(err)
+		return vals, err
+	}
+	done := traceRedis(r, shard, "ZREVRANGE", key)
+	vals, err := client.ZRevRangeWithScores(key, start, stop).Result()
+	done(err)
+	return vals, err
+}
+
+// Sets how the board ranks: "order" desc (default) or asc, the default
+// submit "policy" and how many closed periods windowed boards "keep".
+// curl -X PUT -d "order=asc&policy=best&keep=7" /leaderboard/lap
+func (this *CacheRequestHandler) configLeaderboard(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	conf := map[string]string{}
+	if order := this.GetFormValue(w, r, "order"); order != "" {
+		if order != "asc" && order != "desc" {
+			ErrorParam(w, "order")
+			return
+		}
+		conf["order"] = order
+	}
+	if policy := this.GetFormValue(w, r, "policy"); policy != "" {
+		if !leaderboardPolicy(policy) {
+			ErrorParam(w, "policy")
+			return
+		}
+		conf["policy"] = policy
+	}
+	if keep := this.GetFormValue(w, r, "keep"); keep != "" {
+		if n, err := strconv.Atoi(keep); err != nil || n < 0 {
+			ErrorParam(w, "keep")
+			return
+		}
+		conf["keep"] = keep
+	}
+	if len(conf) == 0 {
+		ErrorParam(w, "order', 'policy' or 'keep")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "HMSET", leaderboardKey(name, "conf"))
+	err = client.HMSet(leaderboardKey(name, "conf"), conf).Err()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, nil)
+}
+
+// Submits a score to every "window" given (all, daily, weekly; default
+// all). "policy" best keeps the better score, latest overwrites and sum
+// adds. "meta" is stored as the member's metadata.
+// curl -d "member=alice&score=120&window=all&window=daily&meta={\"team\":\"qa\"}" /leaderboard/lap
+func (this *CacheRequestHandler) submitLeaderboard(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	member := this.GetFormValue(w, r, "member")
+	if member == "" {
+		ErrorParam(w, "member")
+		return
+	}
+	score := this.GetFormValue(w, r, "score")
+	if _, err := strconv.ParseFloat(score, 64); err != nil {
+		ErrorParam(w, "score")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	conf, err := getLeaderboardConf(r, shard, client, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	policy := this.GetFormValue(w, r, "policy")
+	if policy == "" {
+		policy = conf.Policy
+	} else if !leaderboardPolicy(policy) {
+		ErrorParam(w, "policy")
+		return
+	}
+
+	windows := r.Form["window"]
+	if len(windows) == 0 {
+		windows = []string{"all"}
+	}
+	now := time.Now()
+	keys := []string{leaderboardKey(name, "meta")}
+	exps := []interface{}{}
+	for _, window := range windows {
+		part, exp, err := leaderboardPeriod(window, now, conf.Keep)
+		if err != nil {
+			ErrorParam(w, "window")
+			return
+		}
+		keys = append(keys, leaderboardKey(name, part))
+		if exp.IsZero() {
+			exps = append(exps, 0)
+		} else {
+			exps = append(exps, msTime(exp))
+		}
+	}
+
+	asc := "0"
+	if conf.Asc {
+		asc = "1"
+	}
+	args := append([]interface{}{member, score, policy, asc, this.GetFormValue(w, r, "meta")}, exps...)
+	done := traceRedis(r, shard, "EVALSHA", keys[0])
+	val, err := leaderboardSubmitScript.Run(client, keys, args...).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	scores := map[string]float64{}
+	vals, _ := val.([]interface{})
+	for i, v := range vals {
+		if i < len(windows) {
+			scores[windows[i]], _ = strconv.ParseFloat(replyString(v), 64)
+		}
+	}
+	ErrorNil(w, scores)
+}
+
+// Returns a page of the board, best first, with metadata when "meta=1".
+// curl "/leaderboard/lap?window=daily&start=0&count=10&meta=1"
+func (this *CacheRequestHandler) getLeaderboard(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	start, count := int64(0), int64(defaultLeaderboardCount)
+	if v := this.GetFormValue(w, r, "start"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			ErrorParam(w, "start")
+			return
+		}
+		start = n
+	}
+	if v := this.GetFormValue(w, r, "count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || (this.max_full_read > 0 && n > this.max_full_read) {
+			ErrorParam(w, "count")
+			return
+		}
+		count = n
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	conf, err := getLeaderboardConf(r, shard, client, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	key, ok := this.leaderboardBoard(w, r, name, conf)
+	if !ok {
+		return
+	}
+
+	vals, err := leaderboardRange(r, shard, client, key, conf, start, start+count-1)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	entries, err := leaderboardEntries(r, shard, client, name, start, vals, this.GetFormValue(w, r, "meta") == "1")
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, entries)
+}
+
+// Returns the member's rank and score with "around" neighbours on each
+// side.
+// curl "/leaderboard/lap/member/alice?window=weekly&around=2&meta=1"
+func (this *CacheRequestHandler) getLeaderboardMember(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	name, member := vars["name"], vars["member"]
+	around := int64(0)
+	if v := this.GetFormValue(w, r, "around"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || n > maxLeaderboardAround {
+			ErrorParam(w, "around")
+			return
+		}
+		around = n
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	conf, err := getLeaderboardConf(r, shard, client, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	key, ok := this.leaderboardBoard(w, r, name, conf)
+	if !ok {
+		return
+	}
+
+	var rank int64
+	if conf.Asc {
+		done := traceRedis(r, shard, "ZRANK", key)
+		rank, err = client.ZRank(key, member).Result()
+		done(err)
+	} else {
+		done := traceRedis(r, shard, "ZREVRANK", key)
+		rank, err = client.ZRevRank(key, member).Result()
+		done(err)
+	}
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	start := rank - around
+	if start < 0 {
+		start = 0
+	}
+	vals, err := leaderboardRange(r, shard, client, key, conf, start, rank+around)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	entries, err := leaderboardEntries(r, shard, client, name, start, vals, this.GetFormValue(w, r, "meta") == "1")
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	res := map[string]interface{}{"rank": rank + 1, "neighbours": entries}
+	for _, e := range entries {
+		if e.Member == member {
+			res["score"] = e.Score
+		}
+	}
+	ErrorNil(w, res)
+}
+
+// Resets the board of "window" (default all). "meta=1" also drops the
+// member metadata and "conf=1" the board settings.
+// curl -X DELETE "/leaderboard/lap?window=daily"
+func (this *CacheRequestHandler) resetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	conf, err := getLeaderboardConf(r, shard, client, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	key, ok := this.leaderboardBoard(w, r, name, conf)
+	if !ok {
+		return
+	}
+
+	keys := []string{key}
+	if this.GetFormValue(w, r, "meta") == "1" {
+		keys = append(keys, leaderboardKey(name, "meta"))
+	}
+	if this.GetFormValue(w, r, "conf") == "1" {
+		keys = append(keys, leaderboardKey(name, "conf"))
+	}
+	done := traceRedis(r, shard, "DEL", keys[0])
+	val, err := client.Del(keys...).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
+}
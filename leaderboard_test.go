@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_LeaderboardPeriod(t *testing.T) {
+	at := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC) // Sunday, ISO week 2016-52
+	cases := []struct {
+		window string
+		keep   int
+		part   string
+		exp    time.Time
+	}{
+		{"all", 1, "", time.Time{}},
+		{"daily", 1, "d:20170101", time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"daily", 0, "d:20170101", time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"weekly", 1, "w:2016-52", time.Date(2017, 1, 9, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		part, exp, err := leaderboardPeriod(c.window, at, c.keep)
+		if err != nil {
+			t.Fatalf("%s Error:%v", c.window, err.Error())
+		}
+		if part != c.part || !exp.Equal(c.exp) {
+			t.Errorf("%s keep %d: got %q %v, want %q %v", c.window, c.keep, part, exp, c.part, c.exp)
+		}
+	}
+	if _, _, err := leaderboardPeriod("monthly", at, 1); err == nil {
+		t.Errorf("monthly should fail")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The HTTP listener serves TLS when [listen] has a cert and key, with
+// HTTP/2 negotiated unless disabled. The cert, key and client CA files are
+// checked every tlsReloadInterval and reloaded when they change, so a
+// renewed certificate needs no restart. With a client CA, verified client
+// certificates authenticate as a principal, see auth.go.
+const (
+	defaultListen     = ":9090"
+	tlsReloadInterval = 10 * time.Second
+)
+
+type listenInfo struct {
+	// Defaults to ":9090".
+	Address string
+	Cert    string
+	Key     string
+	// CA bundle verifying client certificates.
+	ClientCA string
+	// "require" (default) refuses clients without a valid certificate,
+	// "request" lets them authenticate otherwise.
+	ClientAuth string
+	// Certificate CN, DNS name or email to principal; other verified
+	// certificates authenticate as their CN.
+	Principals   map[string]string
+	DisableHttp2 bool
+	// Origins (scheme://host[:port]) whose pages may open WebSocket
+	// subscriptions besides pages of the server's own host.
+	Origins []string
+}
+
+type tlsReloader struct {
+	info listenInfo
+
+	mu     sync.RWMutex
+	config *tls.Config
+	mtimes []time.Time
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// validate checks that the TLS settings make sense together.
+func (info listenInfo) validate() error {
+	switch info.ClientAuth {
+	case "", "require", "request":
+	default:
+		return fmt.Errorf("bad clientauth '%s'", info.ClientAuth)
+	}
+	if (info.Cert == "") != (info.Key == "") {
+		return fmt.Errorf("cert and key go together")
+	}
+	if info.ClientCA != "" && info.Cert == "" {
+		return fmt.Errorf("clientca needs cert and key")
+	}
+	if info.ClientCA == "" && (info.ClientAuth != "" || len(info.Principals) > 0) {
+		return fmt.Errorf("clientauth and principals need clientca")
+	}
+	return nil
+}
+
+func newTLSReloader(info listenInfo) (*tlsReloader, error) {
+	if err := info.validate(); err != nil {
+		return nil, err
+	}
+	t := &tlsReloader{info: info}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tlsReloader) files() []string {
+	files := []string{t.info.Cert, t.info.Key}
+	if t.info.ClientCA != "" {
+		files = append(files, t.info.ClientCA)
+	}
+	return files
+}
+
+// load rebuilds the TLS config if one of its files changed.
+func (t *tlsReloader) load() error {
+	mtimes := []time.Time{}
+	for _, f := range t.files() {
+		st, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		mtimes = append(mtimes, st.ModTime())
+	}
+	t.mu.RLock()
+	unchanged := t.config != nil
+	for i := range mtimes {
+		unchanged = unchanged && mtimes[i].Equal(t.mtimes[i])
+	}
+	t.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.info.Cert, t.info.Key)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if t.info.DisableHttp2 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if t.info.ClientCA != "" {
+		pool, err := loadCertPool(t.info.ClientCA)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if t.info.ClientAuth == "request" {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	t.mu.Lock()
+	t.config, t.mtimes = config, mtimes
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *tlsReloader) current() *tls.Config {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.config
+}
+
+func (t *tlsReloader) reloadLoop() {
+	for range time.Tick(tlsReloadInterval) {
+		if err := t.load(); err != nil {
+			logError("tls reload", "err", err)
+		}
+	}
+}
+
+// serve runs the HTTP listener until it fails.
+func serve(info listenInfo, handler http.Handler) error {
+	if info.Address == "" {
+		info.Address = defaultListen
+	}
+	srv := &http.Server{Addr: info.Address, Handler: handler}
+	if info.Cert == "" {
+		return srv.ListenAndServe()
+	}
+
+	t, err := newTLSReloader(info)
+	if err != nil {
+		return err
+	}
+	go t.reloadLoop()
+	srv.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &t.current().Certificates[0], nil
+		},
+		NextProtos: t.current().NextProtos,
+	}
+	if info.DisableHttp2 {
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert issues a certificate for cn, signed by ca or self-signed.
+func newTestCert(t *testing.T, cn string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	cert_file := filepath.Join(dir, name+".crt")
+	key_file := filepath.Join(dir, name+".key")
+	key_der, _ := x509.MarshalECPrivateKey(c.key)
+	if err := ioutil.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert_file, key_file
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func Test_ListenValidate(t *testing.T) {
+	good := []listenInfo{
+		{},
+		{Cert: "c", Key: "k"},
+		{Cert: "c", Key: "k", ClientCA: "ca", ClientAuth: "request", Principals: map[string]string{"a": "b"}},
+	}
+	for _, info := range good {
+		if err := info.validate(); err != nil {
+			t.Errorf("%+v: %v", info, err)
+		}
+	}
+	bad := []listenInfo{
+		{Cert: "c"},
+		{Key: "k"},
+		{ClientCA: "ca"},
+		{Cert: "c", Key: "k", ClientCA: "ca", ClientAuth: "optional"},
+		{Cert: "c", Key: "k", ClientAuth: "request"},
+		{Cert: "c", Key: "k", Principals: map[string]string{"a": "b"}},
+	}
+	for _, info := range bad {
+		if err := info.validate(); err == nil {
+			t.Errorf("%+v should fail", info)
+		}
+	}
+}
+
+func Test_TLSReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	cert_file, key_file := newTestCert(t, "one", ca).write(t, dir, "server")
+
+	r, err := newTLSReloader(listenInfo{Cert: cert_file, Key: key_file})
+	if err != nil {
+		t.Fatalf("newTLSReloader Error:%v", err.Error())
+	}
+	first := r.current()
+	if err := r.load(); err != nil || r.current() != first {
+		t.Errorf("unchanged files reloaded: %v", err)
+	}
+
+	newTestCert(t, "two", ca).write(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cert_file, later, later)
+	os.Chtimes(key_file, later, later)
+	if err := r.load(); err != nil {
+		t.Fatalf("load Error:%v", err.Error())
+	}
+	leaf, _ := x509.ParseCertificate(r.current().Certificates[0].Certificate[0])
+	if leaf.Subject.CommonName != "two" {
+		t.Errorf("serving %s after reload", leaf.Subject.CommonName)
+	}
+
+	// A broken renewal keeps the last good config.
+	ioutil.WriteFile(key_file, []byte("junk"), 0600)
+	os.Chtimes(key_file, later.Add(time.Minute), later.Add(time.Minute))
+	if err := r.load(); err == nil {
+		t.Errorf("junk key should fail")
+	}
+	if r.current() == nil || len(r.current().Certificates) != 1 {
+		t.Errorf("lost the config")
+	}
+}
+
+func Test_TLSClientAuth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	ca_file, _ := ca.write(t, dir, "ca")
+	cert_file, key_file := newTestCert(t, "localhost", ca).write(t, dir, "server")
+	client := newTestCert(t, "svc-a", ca)
+	stranger := newTestCert(t, "svc-b", newTestCert(t, "other-ca", nil))
+
+	auth := &authenticator{cert_auth: true, cert_principals: map[string]string{"svc-a": "billing"}}
+	for _, mode := range []string{"require", "request"} {
+		r, err := newTLSReloader(listenInfo{Cert: cert_file, Key: key_file, ClientCA: ca_file, ClientAuth: mode})
+		if err != nil {
+			t.Fatalf("newTLSReloader Error:%v", err.Error())
+		}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(auth.certPrincipal(req)))
+		}))
+		srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		srv.TLS = r.current()
+		srv.StartTLS()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		get := func(cert *testCert) (string, error) {
+			config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if cert != nil {
+				config.Certificates = []tls.Certificate{cert.tlsCert()}
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			resp, err := c.Get(srv.URL)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			return string(b), nil
+		}
+
+		if p, err := get(client); err != nil || p != "billing" {
+			t.Errorf("%s: client cert got %q, %v", mode, p, err)
+		}
+		// The client holds back a certificate the server's CAs did not
+		// issue, so it never authenticates.
+		if p, err := get(stranger); (mode == "require") != (err != nil) || p != "" {
+			t.Errorf("%s: cert from another CA got %q, %v", mode, p, err)
+		}
+		p, err := get(nil)
+		if mode == "require" && err == nil {
+			t.Errorf("require: no cert accepted")
+		}
+		if mode == "request" && (err != nil || p != "") {
+			t.Errorf("request: no cert got %q, %v", p, err)
+		}
+		srv.Close()
+	}
+}
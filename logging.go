@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Logs are JSON lines on stderr: time, level and message, then the
+// key/value pairs of the call. Every request is logged at info (5xx at
+// error) with its id, route, the shards it used, status and latency; the
+// id comes from X-Request-Id when the caller sent a usable one and is
+// echoed back. [log] level = "warn" keeps only failures.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+type loggingInfo struct {
+	// "debug", "info" (default), "warn" or "error".
+	Level string
+}
+
+type structLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level logLevel
+}
+
+var logger = &structLogger{out: os.Stderr, level: levelInfo}
+
+func parseLogLevel(s string) (logLevel, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("bad level '%s'", s)
+}
+
+func (l *structLogger) log(level logLevel, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{"time":"%s","level":"%s","msg":`, time.Now().UTC().Format(time.RFC3339Nano), logLevelNames[level])
+	writeJSON(&b, msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		b.WriteByte(',')
+		writeJSON(&b, fmt.Sprint(kv[i]))
+		b.WriteByte(':')
+		val := kv[i+1]
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		writeJSON(&b, val)
+	}
+	b.WriteString("}\n")
+
+	l.mu.Lock()
+	l.out.Write(b.Bytes())
+	l.mu.Unlock()
+}
+
+func writeJSON(b *bytes.Buffer, val interface{}) {
+	out, err := json.Marshal(val)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprint(val))
+	}
+	b.Write(out)
+}
+
+func logDebug(msg string, kv ...interface{}) { logger.log(levelDebug, msg, kv) }
+func logInfo(msg string, kv ...interface{})  { logger.log(levelInfo, msg, kv) }
+func logWarn(msg string, kv ...interface{})  { logger.log(levelWarn, msg, kv) }
+func logError(msg string, kv ...interface{}) { logger.log(levelError, msg, kv) }
+
+func logFatal(msg string, kv ...interface{}) {
+	logger.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+// requestInfo follows a request through the handlers for its log line.
+type requestInfo struct {
+	id string
+
+	mu     sync.Mutex
+	shards []string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoOf(r *http.Request) *requestInfo {
+	if r == nil {
+		return nil
+	}
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestID returns the id of r, "" outside logRequests.
+func requestID(r *http.Request) string {
+	if info := requestInfoOf(r); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// noteShard records that r used shard.
+func noteShard(r *http.Request, shard string) {
+	info := requestInfoOf(r)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	if !inStrings(info.shards, shard) {
+		info.shards = append(info.shards, shard)
+	}
+	info.mu.Unlock()
+}
+
+// validRequestID accepts short printable ids so callers cannot forge log
+// structure.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequests logs every request once it is served, labelled with the
+// route of router like measure.
+func (this *CacheRequestHandler) logRequests(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = randomHex(8)
+		}
+		w.Header().Set("X-Request-Id", id)
+		info := &requestInfo{id: id, shards: []string{}}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		route := routeOf(router, r)
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		info.mu.Lock()
+		shards := info.shards
+		info.mu.Unlock()
+
+		level := levelInfo
+		if sw.code >= 500 {
+			level = levelError
+		}
+		logger.log(level, "request", []interface{}{
+			"request_id", id,
+			"method", r.Method,
+			"route", route,
+			"shards", shards,
+			"status", sw.code,
+			"latency_ms", time.Since(start).Seconds() * 1000,
+		})
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+func Test_StructLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := &structLogger{out: &buf, level: levelInfo}
+	l.log(levelDebug, "hidden", nil)
+	l.log(levelError, "redis ping", []interface{}{"shard", "main", "err", fmt.Errorf("refused"), "n", 3})
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if line["level"] != "error" || line["msg"] != "redis ping" || line["shard"] != "main" || line["err"] != "refused" || line["n"] != 3.0 {
+		t.Errorf("line %s", buf.String())
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("debug line logged at info: %s", buf.String())
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Errorf("accepted level loud")
+	}
+}
+
+func Test_RequestID(t *testing.T) {
+	for id, ok := range map[string]bool{
+		"abc-123":                 true,
+		"":                        false,
+		"a b":                     false,
+		`x","level":"error`:       false,
+		strings.Repeat("a", 65):   false,
+		"7f1c9e2a-ingress-gw-eu1": true,
+	} {
+		if validRequestID(id) != ok {
+			t.Errorf("%q: want %v", id, ok)
+		}
+	}
+}
+
+func Test_RequestShards(t *testing.T) {
+	handler := new(CacheRequestHandler)
+	handler.master_hashRing = NewConsisten()
+	handler.master_clients = map[string]*redis.Client{"main": nil}
+	handler.addToRings("main")
+	handler.checkRings()
+
+	var buf bytes.Buffer
+	logger.mu.Lock()
+	out := logger.out
+	logger.out = &buf
+	logger.mu.Unlock()
+	defer func() {
+		logger.mu.Lock()
+		logger.out = out
+		logger.mu.Unlock()
+	}()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.keyClient(r, "user:1")
+	})
+	handler.logRequests(mux.NewRouter(), next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/string?key=user:1", nil))
+
+	var line struct{ Shards []string }
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if len(line.Shards) != 1 || line.Shards[0] != "main" {
+		t.Errorf("line %s", buf.String())
+	}
+}
+
+func Test_RotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		"audit.log":   "four\nfive\n",
+		"audit.log.1": "three\n",
+		"audit.log.2": "one\ntwo\n",
+	} {
+		got, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		if string(got) != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("kept more than 2 rotated files")
+	}
+}
+
+func Test_Audit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := newAuditor(auditInfo{File: path, Keys: "redact"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	this := &CacheRequestHandler{auditor: a}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replyStatus(w, http.StatusForbidden)
+	})
+	h := this.audit(mux.NewRouter(), next)
+
+	req := httptest.NewRequest("POST", "/string", strings.NewReader("key=user:1&value=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	// Reads are not audited.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/string?key=user:1", nil))
+
+	out, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log %q", out)
+	}
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Method != "POST" || rec.Command != "string" || rec.Status != http.StatusForbidden ||
+		len(rec.Keys) != 1 || rec.Keys[0] != "redacted" || rec.Principal != "-" {
+		t.Errorf("record %+v", rec)
+	}
+	if strings.Contains(string(out), "secret") || strings.Contains(string(out), "user:1") {
+		t.Errorf("audit log leaks data: %s", out)
+	}
+}
+
+func Test_AuditRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	handler := new(CacheRequestHandler)
+	cfg := cacheConfig{Namespace: map[string]namespaceInfo{"billing": {}, "full": {MaxKeys: 1}}}
+	if err := handler.initNamespaces(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	handler.namespaces["full"].keys = 1
+	if handler.auditor, err = newAuditor(auditInfo{File: path, Keys: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("secret-key"))
+	handler.auth, err = newAuthenticator(authInfo{},
+		map[string]apiKeyInfo{"ci": {Sha256: hex.EncodeToString(sum[:])}},
+		map[string]aclInfo{"ci": {Write: []string{"*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/string", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+	serve_mux := http.NewServeMux()
+	serve_mux.Handle("/", handler.namespaceHandler(router, handler.authorize(router)))
+	h := handler.audit(router, handler.authenticate(serve_mux))
+
+	for _, c := range []struct {
+		method, path, api_key string
+	}{
+		{"POST", "/string", ""},
+		{"POST", "/ns/other/string", "secret-key"},
+		{"POST", "/ns/full/string", "secret-key"},
+		{"POST", "/ns/billing/string", "secret-key"},
+		{"GET", "/debug/pprof/", "secret-key"},
+	} {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader("key=user:1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.api_key != "" {
+			req.Header.Set("X-API-Key", c.api_key)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	out, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	want := []struct {
+		principal, command, key string
+		status                  int
+	}{
+		{"-", "string", "user:1", http.StatusUnauthorized},
+		{"ci", "string", "user:1", http.StatusNotFound},
+		{"ci", "string", "full:user:1", http.StatusInsufficientStorage},
+		{"ci", "string", "billing:user:1", http.StatusOK},
+		{"ci", "debug", "", http.StatusForbidden},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("audit log %q", out)
+	}
+	for i, w := range want {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(lines[i]), &rec); err != nil {
+			t.Fatal(err)
+		}
+		key := ""
+		if len(rec.Keys) > 0 {
+			key = rec.Keys[0]
+		}
+		if rec.Principal != w.principal || rec.Command != w.command || key != w.key || rec.Status != w.status {
+			t.Errorf("record %d: %+v", i, rec)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	_ "net/http/pprof"
 
@@ -13,10 +12,24 @@ import (
 )
 
 type cacheConfig struct {
-	Title      string
-	Owner      ownerInfo
-	Redis      map[string]redisInfo
-	Kubernetes K8sInfo
+	Title       string
+	Owner       ownerInfo
+	Redis       map[string]redisInfo
+	Kubernetes  K8sInfo
+	Limit       limitInfo
+	Ratelimit   map[string]rateLimitInfo
+	Compression map[string]compressionInfo
+	Encryption  encryptionInfo
+	Namespace   map[string]namespaceInfo
+	Group       map[string]groupInfo
+	Auth        authInfo
+	Apikey      map[string]apiKeyInfo
+	Acl         map[string]aclInfo
+	Listen      listenInfo
+	Tracing     tracingInfo
+	Log         loggingInfo
+	Audit       auditInfo
+	Schedule    scheduleInfo
 	//	Test       map[string]testInfo
 }
 
@@ -25,11 +38,29 @@ type ownerInfo struct {
 }
 
 type redisInfo struct {
-	Nodelabel  string
-	MasterName string
-	Port       int
-	Password   string
-	Db         int
+	Nodelabel        string
+	MasterName       string
+	Port             int
+	Password         string
+	SentinelPassword string
+	Db               int
+	// TLS to the sentinels and the master, with an optional CA and client
+	// certificate.
+	Tls           bool
+	TlsCA         string
+	TlsCert       string
+	TlsKey        string
+	TlsServerName string
+}
+
+type limitInfo struct {
+	// Largest hash/set/zset returned by a full read; 0 uses the default,
+	// a negative value disables the check.
+	MaxFullRead int64
+	// Connections per shard reserved for blocking pops and long polls.
+	MaxBlocking int
+	// Seconds between namespace usage scans; 0 uses the default.
+	QuotaScan int
 }
 
 type K8sInfo struct {
@@ -45,11 +76,10 @@ func ReadCfg() cacheConfig {
 		cfg_path = *cfg
 	}
 	var config cacheConfig
-	fmt.Println(cfg_path)
+	logInfo("config", "path", cfg_path)
 	if _, err := toml.DecodeFile(cfg_path, &config); err != nil {
-		log.Fatal(err)
+		logFatal("config", "path", cfg_path, "err", err)
 	}
-	fmt.Println(config)
 	return config
 }
 
@@ -59,9 +89,46 @@ var router = mux.NewRouter()
 
 type CacheRequestHandler struct {
 	k8s_nodes map[string][]string
-	// Master for write.
+	// Master for write. The shard maps are filled by Init and fixed once
+	// it starts the background loops, which range over them unlocked.
 	master_clients  map[string]*redis.Client
 	master_hashRing *Consistent
+	// Backend groups, their prefixes longest first, the groups of each
+	// grouped shard, and whether every configured shard is grouped.
+	groups         map[string]*backendGroup
+	group_prefixes []groupPrefix
+	grouped        map[string][]*backendGroup
+	all_grouped    bool
+	// Dedicated pools for blocking commands.
+	block_clients map[string]*redis.Client
+	shards_fixed  bool
+
+	max_full_read int64
+	max_blocking  int
+
+	pubsub *pubsubHub
+	// Cross-origin pages allowed to open WebSocket subscriptions.
+	ws_origins []string
+
+	// Rate limit definitions from the config.
+	rate_limits map[string]rateLimitInfo
+	// Value compression rules, longest prefix first.
+	compressors []*compressor
+	// Value encryption; nil when no keyring is configured.
+	encryptor *encryptor
+	// Namespaces from the config and how often their usage is scanned.
+	namespaces map[string]*namespace
+	quota_scan int
+	// Authentication and acls; nil when no credentials are configured.
+	auth *authenticator
+
+	request_metrics *requestMetrics
+	// OTLP span exporter; nil when tracing is off.
+	tracer *tracer
+	// Audit log; nil without [audit] file.
+	auditor *auditor
+	// Webhook allowlist and delivery attempts of scheduled jobs.
+	schedule scheduleInfo
 
 	// K8s Node.
 	//node_hashRing *Consistent
@@ -88,7 +155,7 @@ func main() {
 	request_serv := new(CacheRequestHandler)
 	err := request_serv.Init(cfg)
 	if err != nil {
-		fmt.Println("Redis Link Error.")
+		logError("redis link", "err", err)
 		return
 	}
 
@@ -99,15 +166,25 @@ func main() {
 	router.HandleFunc("/key", request_serv.getKey).Methods("GET")
 
 	router.HandleFunc("/string", request_serv.setString).Methods("POST")
-	router.HandleFunc("/string/{key}", request_serv.updateString).Methods("GET")
+	router.HandleFunc("/string/{key}", request_serv.readString).Methods("GET")
+	router.HandleFunc("/string/{key}", request_serv.putString).Methods("PUT")
 	router.HandleFunc("/string", request_serv.getString).Methods("GET")
 
+	router.HandleFunc("/json/{key}", request_serv.getJSON).Methods("GET")
+	router.HandleFunc("/json/{key}", request_serv.setJSON).Methods("PUT")
+	router.HandleFunc("/json/{key}", request_serv.delJSON).Methods("DELETE")
+	router.HandleFunc("/json/{key}/arrappend", request_serv.appendJSON).Methods("POST")
+	router.HandleFunc("/json/{key}/numincrby", request_serv.incrJSON).Methods("POST")
+
 	// curl -d "key=test&v0 0 v1 1" /hash
 	router.HandleFunc("/hash", request_serv.setHash).Methods("POST")
 	router.HandleFunc("/hash", request_serv.getHash).Methods("GET")
 	router.HandleFunc("/hash/{key:.*}", request_serv.updateHash).Methods("PUT")
 	router.HandleFunc("/hash/{key}/{field}", request_serv.delHash).Methods("DELETE")
 
+	// curl "/set/ops?type=sunion&key=a&key=b" | -d "type=sunionstore&destination=c&key=a&key=b"
+	router.HandleFunc("/set/ops", request_serv.getSetOps).Methods("GET")
+	router.HandleFunc("/set/ops", request_serv.storeSetOps).Methods("POST")
 	router.HandleFunc("/set", request_serv.setSet).Methods("POST")
 	router.HandleFunc("/set", request_serv.getSet).Methods("GET")
 	router.HandleFunc("/set/{key0}/{key1}", request_serv.updateSet).Methods("PUT")
@@ -116,7 +193,77 @@ func main() {
 
 	router.HandleFunc("/zset", request_serv.setZset).Methods("POST")
 	router.HandleFunc("/zset", request_serv.getZset).Methods("GET")
+	router.HandleFunc("/zset/{key}/pop", request_serv.popZset).Methods("GET")
+	router.HandleFunc("/geo/{key}", request_serv.addGeo).Methods("POST")
+	router.HandleFunc("/geo/{key}", request_serv.getGeo).Methods("GET")
+	router.HandleFunc("/geo/{key}", request_serv.delGeo).Methods("DELETE")
 	router.HandleFunc("/list", request_serv.setList).Methods("POST")
+	router.HandleFunc("/list/{key}/pop", request_serv.popList).Methods("GET")
+
+	router.HandleFunc("/stream/{key}", request_serv.addStream).Methods("POST")
+	router.HandleFunc("/stream/{key}", request_serv.getStream).Methods("GET")
+	router.HandleFunc("/stream/{key}/group", request_serv.createStreamGroup).Methods("POST")
+	router.HandleFunc("/stream/{key}/group/{group}", request_serv.readStreamGroup).Methods("GET")
+	router.HandleFunc("/stream/{key}/group/{group}", request_serv.delStreamGroup).Methods("DELETE")
+	router.HandleFunc("/stream/{key}/group/{group}/ack", request_serv.ackStreamGroup).Methods("POST")
+	router.HandleFunc("/stream/{key}/group/{group}/pending", request_serv.pendingStreamGroup).Methods("GET")
+	router.HandleFunc("/stream/{key}/group/{group}/claim", request_serv.claimStreamGroup).Methods("POST")
+
+	router.HandleFunc("/queue/{name}", request_serv.enqueue).Methods("POST")
+	router.HandleFunc("/queue/{name}", request_serv.configQueue).Methods("PUT")
+	router.HandleFunc("/queue/{name}", request_serv.getQueue).Methods("GET")
+	router.HandleFunc("/queue/{name}", request_serv.delQueue).Methods("DELETE")
+	router.HandleFunc("/queue/{name}/dequeue", request_serv.dequeue).Methods("POST")
+	router.HandleFunc("/queue/{name}/ack", request_serv.ackQueue).Methods("POST")
+	router.HandleFunc("/queue/{name}/nack", request_serv.nackQueue).Methods("POST")
+	router.HandleFunc("/queue/{name}/extend", request_serv.extendQueue).Methods("POST")
+	router.HandleFunc("/queue/{name}/dead", request_serv.getDeadQueue).Methods("GET")
+	router.HandleFunc("/queue/{name}/dead/requeue", request_serv.redriveQueue).Methods("POST")
+
+	router.HandleFunc("/schedule/{name}", request_serv.addSchedule).Methods("POST")
+	router.HandleFunc("/schedule/{name}", request_serv.listSchedule).Methods("GET")
+	router.HandleFunc("/schedule/{name}/{id}", request_serv.getSchedule).Methods("GET")
+	router.HandleFunc("/schedule/{name}/{id}", request_serv.updateSchedule).Methods("PUT")
+	router.HandleFunc("/schedule/{name}/{id}", request_serv.delSchedule).Methods("DELETE")
+
+	router.HandleFunc("/lock/{name}", request_serv.acquireLock).Methods("POST")
+	router.HandleFunc("/lock/{name}", request_serv.extendLock).Methods("PUT")
+	router.HandleFunc("/lock/{name}", request_serv.releaseLock).Methods("DELETE")
+	router.HandleFunc("/lock/{name}", request_serv.getLock).Methods("GET")
+
+	router.HandleFunc("/ratelimit/{bucket}/take", request_serv.takeRateLimit).Methods("POST")
+	router.HandleFunc("/ratelimit/{bucket}", request_serv.setRateLimit).Methods("PUT")
+	router.HandleFunc("/ratelimit/{bucket}", request_serv.getRateLimit).Methods("GET")
+	router.HandleFunc("/ratelimit/{bucket}", request_serv.delRateLimit).Methods("DELETE")
+
+	router.HandleFunc("/leaderboard/{name}", request_serv.submitLeaderboard).Methods("POST")
+	router.HandleFunc("/leaderboard/{name}", request_serv.configLeaderboard).Methods("PUT")
+	router.HandleFunc("/leaderboard/{name}", request_serv.getLeaderboard).Methods("GET")
+	router.HandleFunc("/leaderboard/{name}", request_serv.resetLeaderboard).Methods("DELETE")
+	router.HandleFunc("/leaderboard/{name}/member/{member}", request_serv.getLeaderboardMember).Methods("GET")
+
+	router.HandleFunc("/hll", request_serv.countHLL).Methods("GET")
+	router.HandleFunc("/hll/{key}", request_serv.addHLL).Methods("POST")
+	router.HandleFunc("/hll/{key}/merge", request_serv.mergeHLL).Methods("POST")
+
+	router.HandleFunc("/bitmap/{key}", request_serv.setBitmap).Methods("PUT")
+	router.HandleFunc("/bitmap/{key}", request_serv.getBitmap).Methods("GET")
+	router.HandleFunc("/bitmap/{key}/bitop", request_serv.opBitmap).Methods("POST")
+
+	router.HandleFunc("/bloom/{name}", request_serv.createBloom).Methods("PUT")
+	router.HandleFunc("/bloom/{name}", request_serv.addBloom).Methods("POST")
+	router.HandleFunc("/bloom/{name}", request_serv.getBloom).Methods("GET")
+	router.HandleFunc("/bloom/{name}", request_serv.delBloom).Methods("DELETE")
+	router.HandleFunc("/bloom/{name}/check", request_serv.checkBloom).Methods("GET")
+
+	router.HandleFunc("/compression", request_serv.getCompression).Methods("GET")
+	router.HandleFunc("/encryption", request_serv.getEncryption).Methods("GET")
+	router.HandleFunc("/encryption/reencrypt", request_serv.startReencrypt).Methods("POST")
+	router.HandleFunc("/namespace", request_serv.getNamespaces).Methods("GET")
+	router.HandleFunc("/metrics", request_serv.getMetrics).Methods("GET")
+
+	router.HandleFunc("/publish/{channel}", request_serv.publish).Methods("POST")
+	router.HandleFunc("/subscribe", request_serv.subscribe).Methods("GET")
 
 	// curl /hash?key=test | /hash?key=test&field=v0
 
@@ -126,12 +273,17 @@ func main() {
 
 	router.HandleFunc("/server", request_serv.ServerAdd).Methods("POST")
 	router.HandleFunc("/server", request_serv.ServerGet).Methods("GET")
+	router.HandleFunc("/group", request_serv.getGroups).Methods("GET")
 
 	//router.HandleFunc("/del", request_serv.del).Methods("DELETE")
 
 	// Later.
 	router.HandleFunc("/sync", request_serv.RedisSync).Methods("POST")
 
-	http.Handle("/", router)
-	http.ListenAndServe(":9090", nil)
+	// /ns/{ns}/... and X-Cache-Namespace requests are rewritten before the
+	// acl check, so it sees the stored keys.
+	http.Handle("/", request_serv.namespaceHandler(router, request_serv.authorize(router)))
+	// Audited before authentication so refused requests are recorded.
+	err = serve(cfg.Listen, request_serv.logRequests(router, request_serv.trace(router, request_serv.measure(router, request_serv.audit(router, request_serv.authenticate(http.DefaultServeMux))))))
+	logFatal("listen", "err", err)
 }
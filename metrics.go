@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// /metrics exports, in the Prometheus text format:
+//
+//   - requests and their latency per route template, method and status;
+//   - per shard: PING latency, key count, and the command calls, time and
+//     failures Redis counts in INFO commandstats, each shard given
+//     metricsShardTimeout to answer;
+//   - the latency of the commands the proxy sent, per shard and command,
+//     timed where traceRedis wraps them;
+//   - the pool stats of the master and blocking clients;
+//   - the members of every hash ring with their vnodes and the share of
+//     the hash space they own, the expected share of keys.
+const metricsPrefix = "fxqa_cache_"
+
+// Request latency histogram buckets in seconds.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Longest a scrape waits for the PING, DBSIZE and INFO of a shard; slower
+// shards are reported down.
+const metricsShardTimeout = 2 * time.Second
+
+type requestLabels struct {
+	route  string
+	method string
+	code   string
+}
+
+type requestSeries struct {
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+type requestMetrics struct {
+	mu     sync.Mutex
+	series map[requestLabels]*requestSeries
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{series: make(map[requestLabels]*requestSeries)}
+}
+
+func newRequestSeries() *requestSeries {
+	return &requestSeries{buckets: make([]uint64, len(latencyBuckets))}
+}
+
+func (s *requestSeries) add(d time.Duration) {
+	secs := d.Seconds()
+	s.count++
+	s.sum += secs
+	for i, b := range latencyBuckets {
+		if secs <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+// write writes s as histogram name with the labels base.
+func (s *requestSeries) write(w io.Writer, name, base string) {
+	for i, b := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, base, strconv.FormatFloat(b, 'g', -1, 64), s.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, base, s.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, base, s.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, base, s.count)
+}
+
+func (m *requestMetrics) observe(l requestLabels, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[l]
+	if !ok {
+		s = newRequestSeries()
+		m.series[l] = s
+	}
+	s.add(d)
+}
+
+func (m *requestMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]requestLabels, 0, len(m.series))
+	for l := range m.series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+
+	name := metricsPrefix + "http_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s HTTP requests by route, method and status.\n# TYPE %s histogram\n", name, name)
+	for _, l := range labels {
+		s := m.series[l]
+		base := fmt.Sprintf(`route=%s,method=%s,code=%s`, promLabel(l.route), promLabel(l.method), promLabel(l.code))
+		s.write(w, name, base)
+	}
+}
+
+type commandLabels struct {
+	shard string
+	cmd   string
+}
+
+// commandMetrics times the Redis commands of the proxy; traceRedis feeds
+// it so background work is counted too.
+type commandMetrics struct {
+	mu     sync.Mutex
+	series map[commandLabels]*requestSeries
+}
+
+var redisCommandMetrics = &commandMetrics{series: make(map[commandLabels]*requestSeries)}
+
+func (m *commandMetrics) observe(l commandLabels, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[l]
+	if !ok {
+		s = newRequestSeries()
+		m.series[l] = s
+	}
+	s.add(d)
+}
+
+func (m *commandMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]commandLabels, 0, len(m.series))
+	for l := range m.series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.shard != b.shard {
+			return a.shard < b.shard
+		}
+		return a.cmd < b.cmd
+	})
+
+	name := metricsPrefix + "redis_client_command_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Redis commands sent by the proxy, by shard and command.\n# TYPE %s histogram\n", name, name)
+	for _, l := range labels {
+		m.series[l].write(w, name, "shard="+promLabel(l.shard)+",cmd="+promLabel(l.cmd))
+	}
+}
+
+func promLabel(v string) string {
+	return strconv.Quote(v)
+}
+
+// statusWriter records the status of a response, keeping the Flusher and
+// Hijacker of the underlying writer for streams and websockets.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijack not supported")
+	}
+	if s.code == 0 {
+		s.code = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// measure times every request, labelled with the route of router it was
+// served by (after any namespace rewrite) or "other".
+func (this *CacheRequestHandler) measure(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		this.request_metrics.observe(requestLabels{routeOf(router, r), r.Method, strconv.Itoa(sw.code)}, time.Since(start))
+	})
+}
+
+// routeOf returns the template of the route of router r matches, "other"
+// when none does.
+func routeOf(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if tpl, err := match.Route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "other"
+}
+
+// commandStats parses INFO commandstats into calls, seconds and failures
+// per command.
+func commandStats(info string) map[string][3]float64 {
+	stats := make(map[string][3]float64)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "cmdstat_") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		var s [3]float64
+		for _, kv := range strings.Split(line[i+1:], ",") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseFloat(p[1], 64)
+			switch p[0] {
+			case "calls":
+				s[0] = v
+			case "usec":
+				s[1] = v / 1e6
+			case "failed_calls", "rejected_calls":
+				s[2] += v
+			}
+		}
+		stats[line[len("cmdstat_"):i]] = s
+	}
+	return stats
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+func (this *CacheRequestHandler) writeShardMetrics(w io.Writer) {
+	shards := make([]string, 0, len(this.master_clients))
+	for name := range this.master_clients {
+		shards = append(shards, name)
+	}
+	sort.Strings(shards)
+
+	writeMetricHeader(w, "redis_up", "gauge", "Whether the shard answered PING.")
+	writeMetricHeader(w, "redis_ping_seconds", "gauge", "PING round trip from the proxy.")
+	writeMetricHeader(w, "redis_keys", "gauge", "Keys on the shard (DBSIZE).")
+	writeMetricHeader(w, "redis_command_calls_total", "counter", "Commands run by the shard.")
+	writeMetricHeader(w, "redis_command_seconds_total", "counter", "Time the shard spent in commands.")
+	writeMetricHeader(w, "redis_command_failed_total", "counter", "Commands the shard rejected or failed.")
+	// Shards are asked in parallel; one that does not answer within
+	// metricsShardTimeout is reported down and its late reply dropped.
+	outs := make([]chan []byte, len(shards))
+	for i, shard := range shards {
+		outs[i] = make(chan []byte, 1)
+		go func(out chan []byte, shard string, client *redis.Client) {
+			out <- shardMetrics(shard, client)
+		}(outs[i], shard, this.master_clients[shard])
+	}
+	timeout := time.After(metricsShardTimeout)
+	for i, shard := range shards {
+		select {
+		case b := <-outs[i]:
+			w.Write(b)
+		case <-timeout:
+			fmt.Fprintf(w, "%sredis_up{shard=%s} 0\n", metricsPrefix, promLabel(shard))
+		}
+	}
+
+	writeMetricHeader(w, "pool_requests_total", "counter", "Connections taken from the pool.")
+	writeMetricHeader(w, "pool_hits_total", "counter", "Connections reused from the pool.")
+	writeMetricHeader(w, "pool_misses_total", "counter", "Connections the pool had to dial.")
+	writeMetricHeader(w, "pool_timeouts_total", "counter", "Waits for a free connection that timed out.")
+	writeMetricHeader(w, "pool_conns", "gauge", "Connections in the pool.")
+	writeMetricHeader(w, "pool_idle_conns", "gauge", "Idle connections in the pool.")
+	for _, shard := range shards {
+		for _, pool := range []string{"master", "block"} {
+			client := this.master_clients[shard]
+			if pool == "block" {
+				client = this.block_clients[shard]
+			}
+			if client == nil {
+				continue
+			}
+			s := client.PoolStats()
+			l := "shard=" + promLabel(shard) + ",pool=" + promLabel(pool)
+			fmt.Fprintf(w, "%spool_requests_total{%s} %d\n", metricsPrefix, l, s.Requests)
+			fmt.Fprintf(w, "%spool_hits_total{%s} %d\n", metricsPrefix, l, s.Hits)
+			fmt.Fprintf(w, "%spool_misses_total{%s} %d\n", metricsPrefix, l, s.Requests-s.Hits)
+			fmt.Fprintf(w, "%spool_timeouts_total{%s} %d\n", metricsPrefix, l, s.Timeouts)
+			fmt.Fprintf(w, "%spool_conns{%s} %d\n", metricsPrefix, l, s.TotalConns)
+			fmt.Fprintf(w, "%spool_idle_conns{%s} %d\n", metricsPrefix, l, s.FreeConns)
+		}
+	}
+}
+
+// shardMetrics returns the PING, DBSIZE and INFO commandstats lines of a
+// shard.
+func shardMetrics(shard string, client *redis.Client) []byte {
+	var w bytes.Buffer
+	l := "shard=" + promLabel(shard)
+
+	start := time.Now()
+	if err := client.Ping().Err(); err != nil {
+		fmt.Fprintf(&w, "%sredis_up{%s} 0\n", metricsPrefix, l)
+		return w.Bytes()
+	}
+	fmt.Fprintf(&w, "%sredis_up{%s} 1\n", metricsPrefix, l)
+	fmt.Fprintf(&w, "%sredis_ping_seconds{%s} %g\n", metricsPrefix, l, time.Since(start).Seconds())
+
+	if n, err := client.DbSize().Result(); err == nil {
+		fmt.Fprintf(&w, "%sredis_keys{%s} %d\n", metricsPrefix, l, n)
+	}
+
+	cmd := redis.NewStringCmd("INFO", "commandstats")
+	client.Process(cmd)
+	info, err := cmd.Result()
+	if err != nil {
+		return w.Bytes()
+	}
+	stats := commandStats(info)
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := stats[name]
+		cl := l + ",cmd=" + promLabel(name)
+		fmt.Fprintf(&w, "%sredis_command_calls_total{%s} %g\n", metricsPrefix, cl, s[0])
+		fmt.Fprintf(&w, "%sredis_command_seconds_total{%s} %g\n", metricsPrefix, cl, s[1])
+		fmt.Fprintf(&w, "%sredis_command_failed_total{%s} %g\n", metricsPrefix, cl, s[2])
+	}
+	return w.Bytes()
+}
+
+func (this *CacheRequestHandler) writeRingMetrics(w io.Writer) {
+	rings := map[string]*Consistent{"": this.master_hashRing}
+	for name, g := range this.groups {
+		rings[name] = g.ring
+	}
+	names := make([]string, 0, len(rings))
+	for name := range rings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeMetricHeader(w, "ring_vnodes", "gauge", "Virtual nodes of a shard in a hash ring; the default ring is \"\".")
+	writeMetricHeader(w, "ring_key_share", "gauge", "Share of the hash space, and so of the keys, a shard owns in a ring.")
+	for _, name := range names {
+		counts, shares := rings[name].Vnodes()
+		members := make([]string, 0, len(counts))
+		for m := range counts {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		for _, m := range members {
+			l := "ring=" + promLabel(name) + ",shard=" + promLabel(m)
+			fmt.Fprintf(w, "%sring_vnodes{%s} %d\n", metricsPrefix, l, counts[m])
+			fmt.Fprintf(w, "%sring_key_share{%s} %g\n", metricsPrefix, l, shares[m])
+		}
+	}
+}
+
+// curl /metrics
+func (this *CacheRequestHandler) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	this.request_metrics.write(w)
+	redisCommandMetrics.write(w)
+	this.writeShardMetrics(w)
+	this.writeRingMetrics(w)
+}
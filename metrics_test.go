@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_CommandStats(t *testing.T) {
+	info := "# Commandstats\r\n" +
+		"cmdstat_get:calls=10,usec=2500,usec_per_call=250.00,rejected_calls=1,failed_calls=2\r\n" +
+		"cmdstat_set:calls=4,usec=40,usec_per_call=10.00\r\n"
+	stats := commandStats(info)
+	if s := stats["get"]; s[0] != 10 || s[1] != 0.0025 || s[2] != 3 {
+		t.Errorf("get: %v", s)
+	}
+	if s := stats["set"]; s[0] != 4 || s[2] != 0 {
+		t.Errorf("set: %v", s)
+	}
+}
+
+func Test_RingShares(t *testing.T) {
+	ring := NewConsisten()
+	for _, name := range []string{"main", "child0", "child1"} {
+		ring.Add(name)
+	}
+	counts, shares := ring.Vnodes()
+	total := 0.0
+	for name, share := range shares {
+		if counts[name] != 150 {
+			t.Errorf("%s: %d vnodes", name, counts[name])
+		}
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("shares sum to %g", total)
+	}
+
+	// The shares should predict where keys land.
+	hits := map[string]float64{}
+	n := 30000
+	for i := 0; i < n; i++ {
+		hits[ring.Get("key:"+strconv.Itoa(i))]++
+	}
+	for name, share := range shares {
+		if math.Abs(hits[name]/float64(n)-share) > 0.03 {
+			t.Errorf("%s: share %.3f, got %.3f of the keys", name, share, hits[name]/float64(n))
+		}
+	}
+}
+
+func Test_RequestMetrics(t *testing.T) {
+	m := newRequestMetrics()
+	m.observe(requestLabels{"/string/{key}", "GET", "200"}, 20*time.Millisecond)
+	m.observe(requestLabels{"/string/{key}", "GET", "200"}, 2*time.Second)
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`fxqa_cache_http_request_duration_seconds_bucket{route="/string/{key}",method="GET",code="200",le="0.025"} 1`,
+		`fxqa_cache_http_request_duration_seconds_bucket{route="/string/{key}",method="GET",code="200",le="+Inf"} 2`,
+		`fxqa_cache_http_request_duration_seconds_count{route="/string/{key}",method="GET",code="200"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+}
+
+func Test_CommandMetrics(t *testing.T) {
+	done := traceRedis(nil, "metrics-test", "GET", "user:1")
+	done(nil)
+
+	var buf bytes.Buffer
+	redisCommandMetrics.write(&buf)
+	want := `fxqa_cache_redis_client_command_duration_seconds_count{shard="metrics-test",cmd="GET"} 1`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("missing %s in\n%s", want, buf.String())
+	}
+}
+
+func Test_ShardMetricsTimeout(t *testing.T) {
+	// Accepts connections and never answers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String(), ReadTimeout: time.Minute})
+	defer client.Close()
+	handler := &CacheRequestHandler{master_clients: map[string]*redis.Client{"slow": client}}
+
+	start := time.Now()
+	var buf bytes.Buffer
+	handler.writeShardMetrics(&buf)
+	if d := time.Since(start); d > metricsShardTimeout+time.Second {
+		t.Errorf("scrape took %v", d)
+	}
+	if !strings.Contains(buf.String(), `fxqa_cache_redis_up{shard="slow"} 0`) {
+		t.Errorf("slow shard not down:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// A namespace is selected with a /ns/{ns}/... path prefix or the
+// X-Cache-Namespace header. Its requests are served by the usual routes
+// after the keys they name (path variables and form fields) are given the
+// namespace prefix, and its limits are applied to every write:
+//
+//	/ns/billing/string/invoice:7  ->  /string/billing:invoice:7
+//
+// Usage is measured by scanning the prefix every quota scan interval, with
+// the bytes written since the last scan added in between, so a namespace
+// can overshoot its quota by what it writes within one interval.
+const (
+	nsPathPrefix = "/ns/"
+	nsHeader     = "X-Cache-Namespace"
+
+	defaultQuotaScan = 60
+	quotaScanPage    = 1000
+)
+
+// Path variables and form fields that hold keys, queue or channel names.
+var (
+	nsPathVars   = []string{"key", "key0", "key1", "name", "bucket", "channel"}
+	nsFormFields = []string{"key", "destination", "newkey", "queue", "channel", "pattern"}
+)
+
+// Key families of the queue, schedule, lock, rate limit, leaderboard and
+// Bloom filter endpoints, whose keys are <family><name>... for the name the
+// request gave. Namespace usage and ACL prefixes go by that name.
+var keyFamilies = []string{"queue:", "schedule:", "lock:", "ratelimit:def:", "ratelimit:", "leaderboard:", "bloom:"}
+
+// ownerKey returns the name a stored key belongs to: the name inside a
+// key family, or the key itself. The queue and schedule registries belong
+// to no name.
+func ownerKey(key string) string {
+	if key == queueNamesKey || key == scheduleNamesKey {
+		return key
+	}
+	for _, family := range keyFamilies {
+		if strings.HasPrefix(key, family) {
+			return key[len(family):]
+		}
+	}
+	return key
+}
+
+type namespaceInfo struct {
+	// Key prefix; defaults to "<ns>:".
+	Prefix string
+	// Seconds applied when a write omits "expire"; 0 uses MaxTTL.
+	DefaultTTL int
+	// Largest "expire" accepted; 0 allows keys without expire.
+	MaxTTL int
+	// Largest value or member in bytes; 0 is unlimited.
+	MaxValueSize int
+	// Writes are refused once usage reaches these; 0 is unlimited.
+	MaxKeys  int64
+	MaxBytes int64
+	// Compression algorithm of the namespace, as in [compression].
+	Compression string
+	// Backend group storing the namespace, see [group].
+	Group string
+}
+
+type namespace struct {
+	name string
+	info namespaceInfo
+
+	// Usage, updated atomically.
+	keys    int64
+	bytes   int64
+	scanned int64
+}
+
+type namespaceStats struct {
+	Name         string `json:"name"`
+	Prefix       string `json:"prefix"`
+	DefaultTTL   int    `json:"default_ttl"`
+	MaxTTL       int    `json:"max_ttl"`
+	MaxValueSize int    `json:"max_value_size"`
+	MaxKeys      int64  `json:"max_keys"`
+	MaxBytes     int64  `json:"max_bytes"`
+	Keys         int64  `json:"keys"`
+	Bytes        int64  `json:"bytes"`
+	Scanned      int64  `json:"scanned"`
+}
+
+// initNamespaces checks the namespaces and adds a compression rule for
+// those that name an algorithm.
+func (this *CacheRequestHandler) initNamespaces(cfg *cacheConfig) error {
+	this.namespaces = make(map[string]*namespace)
+	for name, info := range cfg.Namespace {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("bad namespace name '%s'", name)
+		}
+		if info.Prefix == "" {
+			info.Prefix = name + ":"
+		}
+		if strings.Contains(info.Prefix, "/") {
+			return fmt.Errorf("namespace %s: prefix may not contain '/'", name)
+		}
+		if info.DefaultTTL < 0 || info.MaxTTL < 0 || (info.MaxTTL > 0 && info.DefaultTTL > info.MaxTTL) {
+			return fmt.Errorf("namespace %s: bad ttl", name)
+		}
+		if info.DefaultTTL == 0 {
+			info.DefaultTTL = info.MaxTTL
+		}
+		if info.Compression != "" {
+			if cfg.Compression == nil {
+				cfg.Compression = make(map[string]compressionInfo)
+			}
+			cfg.Compression["ns:"+name] = compressionInfo{Prefix: info.Prefix, Algorithm: info.Compression}
+		}
+		this.namespaces[name] = &namespace{name: name, info: info}
+	}
+
+	this.quota_scan = cfg.Limit.QuotaScan
+	if this.quota_scan <= 0 {
+		this.quota_scan = defaultQuotaScan
+	}
+	return nil
+}
+
+// nsPath splits a /ns/{ns}/... path into the namespace and the rest of
+// the path; name is "" for other paths and ok false for a bare /ns/{ns}.
+func nsPath(path string) (name, rest string, ok bool) {
+	if !strings.HasPrefix(path, nsPathPrefix) {
+		return "", path, true
+	}
+	rest = path[len(nsPathPrefix):]
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return "", path, false
+	}
+	return rest[:i], rest[i:], true
+}
+
+// requestNamespace returns the namespace a request is addressed to and
+// strips its path prefix; ok is false for an unknown namespace.
+func (this *CacheRequestHandler) requestNamespace(r *http.Request) (*namespace, bool) {
+	name := r.Header.Get(nsHeader)
+	if strings.HasPrefix(r.URL.Path, nsPathPrefix) {
+		path_ns, rest, ok := nsPath(r.URL.Path)
+		if !ok {
+			return nil, false
+		}
+		name = path_ns
+		r.URL.Path = rest
+		r.URL.RawPath = ""
+	}
+	if name == "" {
+		return nil, true
+	}
+	ns, ok := this.namespaces[name]
+	return ns, ok
+}
+
+// namespaceHandler rewrites namespaced requests for router and passes
+// every request on to next.
+func (this *CacheRequestHandler) namespaceHandler(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ns, ok := this.requestNamespace(r)
+		if !ok {
+			replyStatus(w, http.StatusNotFound)
+			ErrorParam(w, "namespace")
+			return
+		}
+		if ns == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.ParseMultipartForm(32 << 20)
+		var match mux.RouteMatch
+		vars := map[string]string{}
+		if router.Match(r, &match) && match.Route != nil {
+			pairs := []string{}
+			for k, v := range match.Vars {
+				if inStrings(nsPathVars, k) {
+					v = ns.info.Prefix + v
+				}
+				vars[k] = v
+				pairs = append(pairs, k, v)
+			}
+			u, err := match.Route.URL(pairs...)
+			if err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+			r.URL.Path = u.Path
+		}
+		for _, field := range nsFormFields {
+			for i, v := range r.Form[field] {
+				if v != "" {
+					r.Form[field][i] = ns.info.Prefix + v
+				}
+			}
+		}
+		noteAudit(r)
+
+		write := match.Route != nil && isWriteRoute(r.Method, match.Route)
+		if write && !this.checkNamespaceWrite(w, r, ns) {
+			return
+		}
+		next.ServeHTTP(w, r)
+		if write && ns.info.DefaultTTL > 0 {
+			this.expireNamespaceKeys(r, ns, requestKeys(r, vars))
+		}
+	})
+}
+
+// Commands whose keys are kept until deleted, which a namespace with a
+// max ttl refuses to create. Locks count too: their fence counter outlives
+// the lock.
+var nsPersistentCommands = map[string]bool{
+	"queue": true, "schedule": true, "lock": true, "ratelimit": true, "leaderboard": true, "bloom": true,
+}
+
+// KEYS: key. ARGV: seconds.
+var expirePersistentScript = NewLuaScript(`
+if redis.call('PTTL', KEYS[1]) == -1 then
+	return redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// expireNamespaceKeys gives the keys a namespace write named the default
+// ttl if the handler left them without one, as the writes that take no
+// "expire" (SADD, XADD, pops into a destination, ...) do.
+func (this *CacheRequestHandler) expireNamespaceKeys(r *http.Request, ns *namespace, keys []string) {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, ns.info.Prefix) {
+			continue
+		}
+		name, client, err := this.keyClient(r, key)
+		if err != nil {
+			continue
+		}
+		done := traceRedis(r, name, "EXPIRE", key)
+		err = expirePersistentScript.Run(client, []string{key}, ns.info.DefaultTTL).Err()
+		done(err)
+		if err != nil {
+			logError("namespace expire", "key", key, "err", err)
+		}
+	}
+}
+
+func inStrings(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNamespaceWrite applies the namespace limits to a write and counts
+// its size; false means the reply was sent.
+func (this *CacheRequestHandler) checkNamespaceWrite(w http.ResponseWriter, r *http.Request, ns *namespace) bool {
+	info := ns.info
+	if (info.MaxKeys > 0 && atomic.LoadInt64(&ns.keys) >= info.MaxKeys) ||
+		(info.MaxBytes > 0 && atomic.LoadInt64(&ns.bytes) >= info.MaxBytes) {
+		replyStatus(w, http.StatusInsufficientStorage)
+		ErrorExcu(w, fmt.Errorf("namespace %s is over quota", ns.name))
+		return false
+	}
+
+	if info.MaxTTL > 0 {
+		cmd := commandOf(r.URL.Path)
+		if nsPersistentCommands[cmd] && r.Method != "DELETE" &&
+			!(cmd == "ratelimit" && strings.HasSuffix(r.URL.Path, "/take")) {
+			replyStatus(w, http.StatusForbidden)
+			ErrorExcu(w, fmt.Errorf("namespace %s keeps keys at most %ds, %s keys do not expire", ns.name, info.MaxTTL, cmd))
+			return false
+		}
+		switch this.GetFormValue(w, r, "type") {
+		case "persist":
+			ErrorParam(w, "type")
+			return false
+		case "expireat":
+			ts, err := strconv.ParseInt(this.GetFormValue(w, r, "timestamp"), 10, 64)
+			if err != nil || ts > time.Now().Unix()+int64(info.MaxTTL) {
+				ErrorParam(w, "timestamp")
+				return false
+			}
+		}
+	}
+	exp := this.GetFormValue(w, r, "expire")
+	if exp == "" && info.DefaultTTL > 0 {
+		r.Form["expire"] = []string{strconv.Itoa(info.DefaultTTL)}
+	} else if exp != "" && info.MaxTTL > 0 {
+		n, err := strconv.Atoi(exp)
+		if err != nil || n <= 0 || n > info.MaxTTL {
+			ErrorParam(w, "expire")
+			return false
+		}
+	}
+
+	size := int64(0)
+	for _, field := range []string{"value", "member"} {
+		for _, v := range r.Form[field] {
+			if info.MaxValueSize > 0 && len(v) > info.MaxValueSize {
+				replyStatus(w, http.StatusRequestEntityTooLarge)
+				ErrorParam(w, field)
+				return false
+			}
+			size += int64(len(v))
+		}
+	}
+	if isOctetStream(r) || strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		// A raw body: octet-stream strings and JSON documents.
+		if info.MaxValueSize > 0 {
+			if r.ContentLength > int64(info.MaxValueSize) {
+				replyStatus(w, http.StatusRequestEntityTooLarge)
+				ErrorParam(w, "body")
+				return false
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(info.MaxValueSize))
+		}
+		size += r.ContentLength
+	}
+	atomic.AddInt64(&ns.bytes, size)
+	return true
+}
+
+// quotaLoop measures the namespaces every quota scan interval.
+func (this *CacheRequestHandler) quotaLoop() {
+	for {
+		for _, ns := range this.namespaces {
+			if err := this.scanNamespace(ns); err != nil {
+				logError("namespace scan", "namespace", ns.name, "err", err)
+			}
+		}
+		time.Sleep(time.Duration(this.quota_scan) * time.Second)
+	}
+}
+
+// scanNamespace counts the keys under the namespace prefix, and those of
+// the key families for names under it, on every shard and sums their
+// MEMORY USAGE, sent in one pipeline per SCAN page.
+func (this *CacheRequestHandler) scanNamespace(ns *namespace) error {
+	patterns := []string{ns.info.Prefix + "*"}
+	for _, family := range keyFamilies {
+		patterns = append(patterns, family+ns.info.Prefix+"*")
+	}
+	var keys, bytes int64
+	for _, client := range this.master_clients {
+		for _, pattern := range patterns {
+			cursor := uint64(0)
+			for {
+				page, next, err := client.Scan(cursor, pattern, quotaScanPage).Result()
+				if err != nil {
+					return err
+				}
+				if err := pageUsage(client, page, &keys, &bytes); err != nil {
+					return err
+				}
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+		}
+	}
+	atomic.StoreInt64(&ns.keys, keys)
+	atomic.StoreInt64(&ns.bytes, bytes)
+	atomic.StoreInt64(&ns.scanned, time.Now().Unix())
+	return nil
+}
+
+// pageUsage adds the keys of page still present and their MEMORY USAGE to
+// keys and bytes.
+func pageUsage(client *redis.Client, page []string, keys, bytes *int64) error {
+	if len(page) == 0 {
+		return nil
+	}
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.IntCmd, len(page))
+	for i, key := range page {
+		cmds[i] = redis.NewIntCmd("MEMORY", "USAGE", key)
+		pipe.Process(cmds[i])
+	}
+	// Keys deleted since the SCAN fail the pipeline with redis.Nil; each
+	// reply is checked below.
+	pipe.Exec()
+	for _, cmd := range cmds {
+		n, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		*keys++
+		*bytes += n
+	}
+	return nil
+}
+
+// Returns the namespaces with their limits and last measured usage.
+// curl /namespace
+func (this *CacheRequestHandler) getNamespaces(w http.ResponseWriter, r *http.Request) {
+	stats := make([]namespaceStats, 0, len(this.namespaces))
+	for _, ns := range this.namespaces {
+		stats = append(stats, namespaceStats{
+			Name:         ns.name,
+			Prefix:       ns.info.Prefix,
+			DefaultTTL:   ns.info.DefaultTTL,
+			MaxTTL:       ns.info.MaxTTL,
+			MaxValueSize: ns.info.MaxValueSize,
+			MaxKeys:      ns.info.MaxKeys,
+			MaxBytes:     ns.info.MaxBytes,
+			Keys:         atomic.LoadInt64(&ns.keys),
+			Bytes:        atomic.LoadInt64(&ns.bytes),
+			Scanned:      atomic.LoadInt64(&ns.scanned),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	ErrorNil(w, stats)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func Test_NamespaceWrite(t *testing.T) {
+	handler := new(CacheRequestHandler)
+	cfg := cacheConfig{Namespace: map[string]namespaceInfo{
+		"billing": {MaxTTL: 3600, MaxValueSize: 8, MaxBytes: 20, Compression: "snappy"},
+	}}
+	if err := handler.initNamespaces(&cfg); err != nil {
+		t.Fatalf("initNamespaces Error:%v", err.Error())
+	}
+	ns := handler.namespaces["billing"]
+	if ns.info.Prefix != "billing:" || ns.info.DefaultTTL != 3600 {
+		t.Fatalf("defaults not applied: %+v", ns.info)
+	}
+	if cfg.Compression["ns:billing"].Prefix != "billing:" {
+		t.Errorf("namespace compression rule missing")
+	}
+
+	r := httptest.NewRequest("POST", "/ns/billing/string", nil)
+	got, ok := handler.requestNamespace(r)
+	if !ok || got != ns || r.URL.Path != "/string" {
+		t.Fatalf("requestNamespace: %v %v %s", got, ok, r.URL.Path)
+	}
+	r = httptest.NewRequest("GET", "/ns/other/string", nil)
+	if _, ok := handler.requestNamespace(r); ok {
+		t.Errorf("unknown namespace accepted")
+	}
+
+	write := func(form url.Values) (*http.Request, bool) {
+		r := httptest.NewRequest("POST", "/string", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ParseForm()
+		return r, handler.checkNamespaceWrite(httptest.NewRecorder(), r, ns)
+	}
+
+	r, ok = write(url.Values{"key": {"a"}, "value": {"12345678"}})
+	if !ok || r.Form.Get("expire") != "3600" {
+		t.Errorf("default expire not applied: %v %q", ok, r.Form.Get("expire"))
+	}
+	if _, ok := write(url.Values{"value": {"x"}, "expire": {"7200"}}); ok {
+		t.Errorf("expire above max accepted")
+	}
+	if _, ok := write(url.Values{"value": {"123456789"}}); ok {
+		t.Errorf("oversized value accepted")
+	}
+	if _, ok := write(url.Values{"key": {"a"}, "type": {"persist"}}); ok {
+		t.Errorf("persist accepted with a max ttl")
+	}
+
+	// 8 bytes counted so far, 20 allowed.
+	write(url.Values{"value": {"12345678"}})
+	write(url.Values{"value": {"12345678"}})
+	if _, ok := write(url.Values{"value": {"1"}}); ok {
+		t.Errorf("write over quota accepted")
+	}
+}
+
+func Test_ScanNamespace(t *testing.T) {
+	handler := testHandler(t, cacheConfig{
+		Redis:     map[string]redisInfo{"main": {}, "child0": {}},
+		Namespace: map[string]namespaceInfo{"billing": {}},
+	})
+	for i := 0; i < 25; i++ {
+		key := "billing:" + strconv.Itoa(i)
+		_, client, _ := handler.keyClient(nil, key)
+		client.Set(key, "value", 0)
+	}
+	// Subsystem keys count under the name they are for.
+	for _, key := range []string{"queue:billing:jobs:ready", "lock:billing:deploy", "ratelimit:def:billing:api", "queue:other:ready", "queue:names"} {
+		_, client, _ := handler.keyClient(nil, key)
+		client.Set(key, "value", 0)
+	}
+	_, client, _ := handler.keyClient(nil, "other")
+	client.Set("other", "value", 0)
+
+	ns := handler.namespaces["billing"]
+	if err := handler.scanNamespace(ns); err != nil {
+		t.Fatalf("scanNamespace Error:%v", err.Error())
+	}
+	if ns.keys != 28 || ns.bytes <= 0 || ns.scanned == 0 {
+		t.Errorf("keys %d bytes %d scanned %d", ns.keys, ns.bytes, ns.scanned)
+	}
+}
+
+func Test_NamespaceTTL(t *testing.T) {
+	handler := testHandler(t, cacheConfig{
+		Redis:     map[string]redisInfo{"main": {}},
+		Namespace: map[string]namespaceInfo{"billing": {MaxTTL: 3600}},
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/set/{key0}", handler.updateSet).Methods("PUT")
+	router.HandleFunc("/queue/{name}", handler.enqueue).Methods("POST")
+	router.HandleFunc("/queue/{name}", handler.delQueue).Methods("DELETE")
+	serve := handler.namespaceHandler(router, router)
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serve.ServeHTTP(w, r)
+		return w
+	}
+
+	send("PUT", "/ns/billing/set/s", "type=sadd&member=a")
+	_, client, _ := handler.keyClient(nil, "billing:s")
+	if ttl := client.TTL("billing:s").Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("sadd in a max ttl namespace left ttl %v", ttl)
+	}
+
+	if w := send("POST", "/ns/billing/queue/jobs", "value=x"); w.Code != http.StatusForbidden {
+		t.Errorf("enqueue in a max ttl namespace: %d %s", w.Code, w.Body.String())
+	}
+	if w := send("DELETE", "/ns/billing/queue/jobs", ""); w.Code == http.StatusForbidden {
+		t.Errorf("queue delete refused: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// Limit definitions come from [ratelimit.<bucket>] in the config file or
+// are registered through PUT /ratelimit/{bucket}, which stores them in
+// ratelimit:def:<bucket> on the bucket's shard. Config definitions win.
+// The state of each caller ("key") lives in ratelimit:<bucket>:k:<key> on
+// the shard that key hashes to. Bucket names have no ':', so the two never
+// meet.
+type rateLimitInfo struct {
+	Algorithm string `json:"algorithm"` // token_bucket or sliding_window
+	// token_bucket: bucket size and refill in tokens per second.
+	Capacity float64 `json:"capacity,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	// sliding_window: requests allowed per window seconds.
+	Limit  int64   `json:"limit,omitempty"`
+	Window float64 `json:"window,omitempty"`
+}
+
+func (l rateLimitInfo) validate() error {
+	switch l.Algorithm {
+	case "token_bucket":
+		if l.Capacity <= 0 || l.Rate <= 0 {
+			return fmt.Errorf("token_bucket needs capacity and rate")
+		}
+	case "sliding_window":
+		if l.Limit <= 0 || l.Window <= 0 {
+			return fmt.Errorf("sliding_window needs limit and window")
+		}
+	default:
+		return fmt.Errorf("unknown algorithm '%s'", l.Algorithm)
+	}
+	return nil
+}
+
+// max returns the most requests a full bucket or window allows.
+func (l rateLimitInfo) max() int64 {
+	if l.Algorithm == "token_bucket" {
+		return int64(l.Capacity)
+	}
+	return l.Limit
+}
+
+// KEYS: bucket hash. ARGV: capacity, rate per s, now ms, cost.
+// Returns allowed, remaining, ms until full, ms until cost is available.
+var tokenBucketScript = NewLuaScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or capacity
+local ts = tonumber(b[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+local full = math.ceil((capacity - tokens) * 1000 / rate)
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], full + 1000)
+local retry = 0
+if allowed == 0 then
+	retry = math.ceil((cost - tokens) * 1000 / rate)
+end
+return {allowed, math.floor(tokens), full, retry}
+`)
+
+// KEYS: log zset. ARGV: limit, window ms, now ms, cost, request id.
+// Returns allowed, remaining, ms until the window frees a slot, ms until
+// cost slots are free.
+var slidingWindowScript = NewLuaScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count + cost <= limit then
+	for i = 1, cost do
+		redis.call('ZADD', KEYS[1], now, ARGV[5] .. ':' .. i)
+	end
+	count = count + cost
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+local reset = 0
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+local retry = 0
+if allowed == 0 then
+	local n = count + cost - limit - 1
+	local e = redis.call('ZRANGE', KEYS[1], n, n, 'WITHSCORES')
+	if e[2] then
+		retry = tonumber(e[2]) + window - now
+	end
+end
+return {allowed, limit - count, reset, retry}
+`)
+
+type rateLimitResult struct {
+	Allowed    bool  `json:"allowed"`
+	Limit      int64 `json:"limit"`
+	Remaining  int64 `json:"remaining"`
+	Reset      int64 `json:"reset"`
+	RetryAfter int64 `json:"retry_after"`
+}
+
+func rateLimitDefKey(bucket string) string {
+	return "ratelimit:def:" + bucket
+}
+
+func rateLimitStateKey(bucket, key string) string {
+	return "ratelimit:" + bucket + ":k:" + key
+}
+
+// rateLimit returns the definition of bucket, from the config or the API.
+func (this *CacheRequestHandler) rateLimit(r *http.Request, bucket string) (rateLimitInfo, error) {
+	if l, ok := this.rate_limits[bucket]; ok {
+		return l, nil
+	}
+
+	shard, client, err := this.keyClient(r, rateLimitDefKey(bucket))
+	if err != nil {
+		return rateLimitInfo{}, err
+	}
+	done := traceRedis(r, shard, "HGETALL", rateLimitDefKey(bucket))
+	def, err := client.HGetAll(rateLimitDefKey(bucket)).Result()
+	done(err)
+	if err != nil {
+		return rateLimitInfo{}, err
+	}
+	if len(def) == 0 {
+		return rateLimitInfo{}, redis.Nil
+	}
+	l := rateLimitInfo{Algorithm: def["algorithm"]}
+	l.Capacity, _ = strconv.ParseFloat(def["capacity"], 64)
+	l.Rate, _ = strconv.ParseFloat(def["rate"], 64)
+	l.Limit, _ = strconv.ParseInt(def["limit"], 10, 64)
+	l.Window, _ = strconv.ParseFloat(def["window"], 64)
+	return l, nil
+}
+
+// Takes "cost" (default 1) from the bucket of caller "key". Denied takes
+// answer 429 with Retry-After.
+// curl -d "key=user42" /ratelimit/api/take
+func (this *CacheRequestHandler) takeRateLimit(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	bucket := mux.Vars(r)["bucket"]
+	l, err := this.rateLimit(r, bucket)
+	if err == redis.Nil {
+		ErrorParam(w, "bucket")
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	cost := int64(1)
+	if v := this.GetFormValue(w, r, "cost"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > l.max() {
+			ErrorParam(w, "cost")
+			return
+		}
+		cost = n
+	}
+
+	caller := this.GetFormValue(w, r, "key")
+	if caller == "" {
+		ErrorParam(w, "key")
+		return
+	}
+	key := rateLimitStateKey(bucket, caller)
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	now := msTime(time.Now())
+
+	done := traceRedis(r, shard, "EVALSHA", key)
+	var cmd *redis.Cmd
+	if l.Algorithm == "token_bucket" {
+		cmd = tokenBucketScript.Run(client, []string{key}, l.Capacity, l.Rate, now, cost)
+	} else {
+		window := int64(l.Window * 1000)
+		cmd = slidingWindowScript.Run(client, []string{key}, l.Limit, window, now, cost, newItemID())
+	}
+	val, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	vals, _ := val.([]interface{})
+	if len(vals) != 4 {
+		ErrorExcu(w, fmt.Errorf("unexpected rate limit reply"))
+		return
+	}
+
+	res := rateLimitResult{
+		Allowed:    replyInt(vals[0]) == 1,
+		Limit:      l.max(),
+		Remaining:  replyInt(vals[1]),
+		Reset:      int64(math.Ceil(float64(replyInt(vals[2])) / 1000)),
+		RetryAfter: int64(math.Ceil(float64(replyInt(vals[3])) / 1000)),
+	}
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(res.Limit, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(res.Reset, 10))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(res.RetryAfter, 10))
+		replyStatus(w, http.StatusTooManyRequests)
+	}
+	ErrorNil(w, res)
+}
+
+// curl -X PUT -d "algorithm=token_bucket&capacity=100&rate=10" /ratelimit/api
+// curl -X PUT -d "algorithm=sliding_window&limit=1000&window=3600" /ratelimit/api
+func (this *CacheRequestHandler) setRateLimit(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	bucket := mux.Vars(r)["bucket"]
+	if strings.Contains(bucket, ":") {
+		ErrorParam(w, "bucket")
+		return
+	}
+	if _, ok := this.rate_limits[bucket]; ok {
+		ErrorExcu(w, fmt.Errorf("bucket '%s' is defined in the config", bucket))
+		return
+	}
+
+	def := map[string]string{"algorithm": this.GetFormValue(w, r, "algorithm")}
+	l := rateLimitInfo{Algorithm: def["algorithm"]}
+	for _, field := range []string{"capacity", "rate", "limit", "window"} {
+		v := this.GetFormValue(w, r, field)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			ErrorParam(w, field)
+			return
+		}
+		def[field] = v
+		switch field {
+		case "capacity":
+			l.Capacity = f
+		case "rate":
+			l.Rate = f
+		case "limit":
+			l.Limit = int64(f)
+		case "window":
+			l.Window = f
+		}
+	}
+	if err := l.validate(); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	shard, client, err := this.keyClient(r, rateLimitDefKey(bucket))
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "HMSET", rateLimitDefKey(bucket))
+	err = client.HMSet(rateLimitDefKey(bucket), def).Err()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, nil)
+}
+
+// curl /ratelimit/api
+func (this *CacheRequestHandler) getRateLimit(w http.ResponseWriter, r *http.Request) {
+	l, err := this.rateLimit(r, mux.Vars(r)["bucket"])
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, l)
+}
+
+// curl -X DELETE /ratelimit/api
+func (this *CacheRequestHandler) delRateLimit(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)["bucket"]
+	shard, client, err := this.keyClient(r, rateLimitDefKey(bucket))
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "DEL", rateLimitDefKey(bucket))
+	val, err := client.Del(rateLimitDefKey(bucket)).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_RateLimitValidate(t *testing.T) {
+	good := []rateLimitInfo{
+		{Algorithm: "token_bucket", Capacity: 10, Rate: 1},
+		{Algorithm: "sliding_window", Limit: 100, Window: 60},
+	}
+	for _, l := range good {
+		if err := l.validate(); err != nil {
+			t.Errorf("%+v: %v", l, err)
+		}
+	}
+	bad := []rateLimitInfo{
+		{},
+		{Algorithm: "leaky"},
+		{Algorithm: "token_bucket", Capacity: 10},
+		{Algorithm: "token_bucket", Rate: 1},
+		{Algorithm: "sliding_window", Limit: 100},
+		{Algorithm: "sliding_window", Window: -1, Limit: 1},
+	}
+	for _, l := range bad {
+		if err := l.validate(); err == nil {
+			t.Errorf("%+v should fail", l)
+		}
+	}
+	if n := (rateLimitInfo{Algorithm: "token_bucket", Capacity: 10.5, Rate: 1}).max(); n != 10 {
+		t.Errorf("max %d", n)
+	}
+}
+
+func Test_RateLimitKeys(t *testing.T) {
+	if k := rateLimitDefKey("api"); k != "ratelimit:def:api" {
+		t.Errorf("def key %s", k)
+	}
+	if k := rateLimitStateKey("api", "def"); k != "ratelimit:api:k:def" {
+		t.Errorf("state key %s", k)
+	}
+	// A caller named like the definition cannot reach it.
+	for _, bucket := range []string{"api", "def"} {
+		for _, caller := range []string{"def", "api", "k:api", ""} {
+			if rateLimitStateKey(bucket, caller) == rateLimitDefKey(bucket) {
+				t.Errorf("%s/%s hits the definition", bucket, caller)
+			}
+		}
+	}
+}
+
+func Test_RateLimitTake(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+
+	w := serveTest("/ratelimit/{bucket}", "PUT", handler.setRateLimit, "/ratelimit/api", "algorithm=token_bucket&capacity=2&rate=0.001")
+	if !strings.Contains(w.Body.String(), `"_type":"0"`) {
+		t.Fatalf("set answered %s", w.Body.String())
+	}
+	w = serveTest("/ratelimit/{bucket}", "PUT", handler.setRateLimit, "/ratelimit/a:b", "algorithm=token_bucket&capacity=2&rate=1")
+	if !strings.Contains(w.Body.String(), "bucket") {
+		t.Errorf("bucket with ':' answered %s", w.Body.String())
+	}
+
+	take := func(body string) *httptest.ResponseRecorder {
+		return serveTest("/ratelimit/{bucket}/take", "POST", handler.takeRateLimit, "/ratelimit/api/take", body)
+	}
+	if w := take(""); !strings.Contains(w.Body.String(), "Param 'key'") {
+		t.Errorf("take without key answered %s", w.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		if w := take("key=def"); w.Code != http.StatusOK {
+			t.Fatalf("take %d answered %d %s", i, w.Code, w.Body.String())
+		}
+	}
+	if w := take("key=def"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("third take answered %d %s", w.Code, w.Body.String())
+	}
+	// The caller "def" left the definition alone.
+	if l, err := handler.rateLimit(nil, "api"); err != nil || l.Capacity != 2 {
+		t.Errorf("definition %+v, %v", l, err)
+	}
+	if w := take("key=other"); w.Code != http.StatusOK {
+		t.Errorf("other caller answered %d", w.Code)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// Sets the bits at every "offset" to "value" (0 or 1, default 1) and
+// returns their previous values.
+// curl -X PUT -d "offset=7&offset=42&value=1" /bitmap/runs:20170401
+func (this *CacheRequestHandler) setBitmap(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	offsets := r.Form["offset"]
+	if len(offsets) == 0 {
+		ErrorParam(w, "offset")
+		return
+	}
+	value := 1
+	if v := this.GetFormValue(w, r, "value"); v != "" {
+		if v != "0" && v != "1" {
+			ErrorParam(w, "value")
+			return
+		}
+		value, _ = strconv.Atoi(v)
+	}
+
+	// All offsets are checked before any bit is set.
+	ns := make([]int64, len(offsets))
+	for i, o := range offsets {
+		offset, err := strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < 0 {
+			ErrorParam(w, "offset")
+			return
+		}
+		ns[i] = offset
+	}
+
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.IntCmd, len(ns))
+	for i, offset := range ns {
+		cmds[i] = pipe.SetBit(key, offset, value)
+	}
+	done := traceRedis(r, shard, "SETBIT", key)
+	_, err = pipe.Exec()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	olds := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		olds[i] = cmd.Val()
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, shard, key, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, olds)
+}
+
+// curl "/bitmap/runs:20170401?type=getbit&offset=7"
+// curl "/bitmap/runs:20170401?type=bitcount&start=0&end=-1"
+// curl "/bitmap/runs:20170401?type=bitpos&bit=0"
+func (this *CacheRequestHandler) getBitmap(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	action_type := this.GetFormValue(w, r, "type")
+	if action_type == "getbit" {
+		offset, err := strconv.ParseInt(this.GetFormValue(w, r, "offset"), 10, 64)
+		if err != nil || offset < 0 {
+			ErrorParam(w, "offset")
+			return
+		}
+		done := traceRedis(r, shard, "GETBIT", key)
+		val, err := client.GetBit(key, offset).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
+	}
+
+	args := []interface{}{}
+	switch action_type {
+	case "bitcount":
+		args = append(args, "BITCOUNT", key)
+	case "bitpos":
+		bit := this.GetFormValue(w, r, "bit")
+		if bit != "0" && bit != "1" {
+			ErrorParam(w, "bit")
+			return
+		}
+		args = append(args, "BITPOS", key, bit)
+	default:
+		ErrorParam(w, "type")
+		return
+	}
+
+	// Optional byte range; "end" needs "start".
+	for _, param := range []string{"start", "end"} {
+		v := this.GetFormValue(w, r, param)
+		if v == "" {
+			break
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			ErrorParam(w, param)
+			return
+		}
+		args = append(args, n)
+	}
+	if action_type == "bitcount" && len(args) == 3 {
+		ErrorParam(w, "end")
+		return
+	}
+
+	cmd := redis.NewIntCmd(args...)
+	done := traceRedis(r, shard, strings.ToUpper(action_type), key)
+	client.Process(cmd)
+	val, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
+}
+
+// Stores "op" (and, or, xor, not) of the "key"s in {key} and returns its
+// length in bytes. Sources on other shards are copied to its shard first.
+// curl -d "op=and&key=runs:20170401&key=runs:20170402" /bitmap/runs:both/bitop
+func (this *CacheRequestHandler) opBitmap(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	dest := mux.Vars(r)["key"]
+	op := this.GetFormValue(w, r, "op")
+	keys := r.Form["key"]
+	switch {
+	case op != "and" && op != "or" && op != "xor" && op != "not":
+		ErrorParam(w, "op")
+		return
+	case len(keys) == 0, op == "not" && len(keys) != 1:
+		ErrorParam(w, "key")
+		return
+	}
+
+	name, client, err := this.keyClient(r, dest)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	local, temps, err := this.colocateKeys(r, name, keys)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if len(temps) > 0 {
+		defer client.Del(temps...)
+	}
+
+	args := []interface{}{"BITOP", op, dest}
+	for _, key := range local {
+		args = append(args, key)
+	}
+	cmd := redis.NewIntCmd(args...)
+	done := traceRedis(r, name, "BITOP", dest)
+	client.Process(cmd)
+	val, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, name, dest, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, val)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_SetBitmap(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+	_, client, _ := handler.keyClient(nil, "runs")
+
+	// A bad offset anywhere sets nothing.
+	w := serveTest("/bitmap/{key}", "PUT", handler.setBitmap, "/bitmap/runs", "offset=7&offset=-1")
+	if !strings.Contains(w.Body.String(), "Param 'offset'") {
+		t.Errorf("bad offset: %s", w.Body.String())
+	}
+	if client.Exists("runs").Val() {
+		t.Errorf("bits set before the offsets were checked")
+	}
+
+	w = serveTest("/bitmap/{key}", "PUT", handler.setBitmap, "/bitmap/runs", "offset=7&offset=42&offset=7")
+	if !strings.Contains(w.Body.String(), `"val":[0,0,1]`) {
+		t.Errorf("set: %s", w.Body.String())
+	}
+	if client.GetBit("runs", 42).Val() != 1 || client.BitCount("runs", nil).Val() != 2 {
+		t.Errorf("bits not set")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+const (
+	// Longest single blocking command sent to a shard. Long polls are split
+	// into slices so a call never outlives the client's read timeout and a
+	// gone HTTP client is noticed between slices.
+	blockSlice = time.Second
+	// Longest long poll a request may ask for.
+	maxPollTimeout = 5 * time.Minute
+	// Default for limitInfo.MaxBlocking.
+	defaultMaxBlocking = 100
+)
+
+// newBlockClient opens the dedicated pool of a shard used for blocking
+// commands, so long polls never take connections from master_clients.
+func newBlockClient(redis_cfg redisInfo, sentinels []string, pool_size int) (*redis.Client, error) {
+	return newMasterClient(redis_cfg, sentinels, pool_size, blockSlice+3*time.Second)
+}
+
+// blockClient returns the shard name owning key and its blocking client,
+// noted in the log of r like keyClient.
+func (this *CacheRequestHandler) blockClient(r *http.Request, key string) (string, *redis.Client, error) {
+	name, err := this.keyShard(key)
+	if err != nil {
+		return "", nil, err
+	}
+	noteShard(r, name)
+	return name, this.block_clients[name], nil
+}
+
+// longPoll repeats call, which should block for at most wait (or not at all
+// when wait is 0) and return redis.Nil when nothing arrived, until it gets a
+// result, timeout passes or the HTTP client disconnects.
+func longPoll(r *http.Request, timeout time.Duration, call func(wait time.Duration) (interface{}, error)) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := deadline.Sub(time.Now())
+		if wait > blockSlice {
+			wait = blockSlice
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		val, err := call(wait)
+		if err != redis.Nil {
+			return val, err
+		}
+		if wait == 0 || !time.Now().Before(deadline) {
+			return nil, redis.Nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		default:
+		}
+	}
+}
+
+// blockSeconds formats wait as the decimal seconds blocking list and zset
+// commands take (Redis 6.0, which BLMOVE needs anyway), so the last slice
+// of a poll ends at its deadline. It is at least 1ms, as 0 blocks forever.
+func blockSeconds(wait time.Duration) string {
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return strconv.FormatFloat(wait.Seconds(), 'f', 3, 64)
+}
+
+func (this *CacheRequestHandler) pollTimeout(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	v := this.GetFormValue(w, r, "timeout")
+	if v == "" {
+		return 0, true
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || secs < 0 {
+		ErrorParam(w, "timeout")
+		return 0, false
+	}
+	timeout := time.Duration(secs * float64(time.Second))
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+	return timeout, true
+}
+
+func listSide(side string) (string, bool) {
+	switch side {
+	case "", "left":
+		return "LEFT", true
+	case "right":
+		return "RIGHT", true
+	}
+	return "", false
+}
+
+// popArgs returns the command popList sends for one poll of at most wait:
+// (B)LMOVE when move says the destination shares the shard of key, else a
+// plain (B)LPOP or (B)RPOP whose item is pushed on afterwards.
+func popArgs(key, destination, from, to string, move bool, wait time.Duration) []interface{} {
+	switch {
+	case move && wait > 0:
+		return []interface{}{"BLMOVE", key, destination, from, to, blockSeconds(wait)}
+	case move:
+		return []interface{}{"LMOVE", key, destination, from, to}
+	case wait > 0:
+		return []interface{}{"B" + from[:1] + "POP", key, blockSeconds(wait)}
+	}
+	return []interface{}{from[:1] + "POP", key}
+}
+
+// Pops from the head ("from=left", default) or tail of the list, waiting up
+// to "timeout" seconds. With "destination" the item is pushed onto that list
+// ("to" side), atomically with BLMOVE when both lists share a shard; across
+// shards an item the destination refuses is put back where it was popped.
+// curl "/list/jobs/pop?timeout=30&from=right&destination=jobs:doing&to=left"
+func (this *CacheRequestHandler) popList(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	timeout, ok := this.pollTimeout(w, r)
+	if !ok {
+		return
+	}
+	from, ok := listSide(this.GetFormValue(w, r, "from"))
+	if !ok {
+		ErrorParam(w, "from")
+		return
+	}
+	to, ok := listSide(this.GetFormValue(w, r, "to"))
+	if !ok {
+		ErrorParam(w, "to")
+		return
+	}
+	destination := this.GetFormValue(w, r, "destination")
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+
+	name, client, err := this.blockClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	var des *redis.Client
+	des_name := ""
+	move := false
+	if destination != "" {
+		// Resolved before popping, so an unavailable destination loses nothing.
+		des_name, des, err = this.keyClient(r, destination)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		move = des_name == name
+	}
+
+	val, err := longPoll(r, timeout, func(wait time.Duration) (interface{}, error) {
+		args := popArgs(key, destination, from, to, move, wait)
+		cmd := redis.NewCmd(args...)
+		done := traceRedis(r, name, args[0].(string), key)
+		client.Process(cmd)
+		val, err := cmd.Result()
+		done(err)
+		return val, err
+	})
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		if r.Context().Err() == nil {
+			ErrorExcu(w, err)
+		}
+		return
+	}
+
+	// BLPOP/BRPOP reply with [key, item].
+	item := replyString(val)
+	if pair, ok := val.([]interface{}); ok && len(pair) == 2 {
+		item = replyString(pair[1])
+	}
+
+	if destination != "" && !move {
+		done := traceRedis(r, des_name, to[:1]+"PUSH", destination)
+		if to == "LEFT" {
+			err = des.LPush(destination, item).Err()
+		} else {
+			err = des.RPush(destination, item).Err()
+		}
+		done(err)
+		if err != nil {
+			ErrorExcu(w, this.restorePopped(r, name, key, from, item, err))
+			return
+		}
+	}
+	// Moved items keep their stored form; reads decrypt either way.
+	if item, err = this.loadValue(item); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, encodeValue(b64, item))
+}
+
+// restorePopped pushes item, popped from the from end of key, back there
+// after pushing it on failed with err. The returned error names the item
+// when it could not be restored either, so it is not lost silently.
+func (this *CacheRequestHandler) restorePopped(r *http.Request, name, key, from, item string, err error) error {
+	client := this.master_clients[name]
+	done := traceRedis(r, name, from[:1]+"PUSH", key)
+	var back error
+	if from == "LEFT" {
+		back = client.LPush(key, item).Err()
+	} else {
+		back = client.RPush(key, item).Err()
+	}
+	done(back)
+	if back != nil {
+		logError("list item lost", "key", key, "err", back)
+		return fmt.Errorf("%v; popped item %q not restored: %v", err, item, back)
+	}
+	return err
+}
+
+// Pops the lowest ("type=min", default) or highest scored member, waiting
+// up to "timeout" seconds.
+// curl "/zset/tasks/pop?timeout=10&type=max"
+func (this *CacheRequestHandler) popZset(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	timeout, ok := this.pollTimeout(w, r)
+	if !ok {
+		return
+	}
+	op := "ZPOPMIN"
+	switch this.GetFormValue(w, r, "type") {
+	case "", "min":
+	case "max":
+		op = "ZPOPMAX"
+	default:
+		ErrorParam(w, "type")
+		return
+	}
+
+	name, client, err := this.blockClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	val, err := longPoll(r, timeout, func(wait time.Duration) (interface{}, error) {
+		var cmd *redis.Cmd
+		name_op := op
+		if wait > 0 {
+			name_op = "B" + op
+			cmd = redis.NewCmd(name_op, key, blockSeconds(wait))
+		} else {
+			cmd = redis.NewCmd(op, key)
+		}
+		done := traceRedis(r, name, name_op, key)
+		client.Process(cmd)
+		val, err := cmd.Result()
+		done(err)
+		// ZPOPMIN on an empty zset replies with an empty array.
+		if items, ok := val.([]interface{}); ok && len(items) == 0 {
+			return nil, redis.Nil
+		}
+		return val, err
+	})
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		if r.Context().Err() == nil {
+			ErrorExcu(w, err)
+		}
+		return
+	}
+
+	// BZPOPMIN replies with [key, member, score], ZPOPMIN with [member, score].
+	items, _ := val.([]interface{})
+	if len(items) == 3 {
+		items = items[1:]
+	}
+	if len(items) != 2 {
+		ErrorExcu(w, fmt.Errorf("unexpected %s reply", op))
+		return
+	}
+	ErrorNil(w, map[string]string{"member": replyString(items[0]), "score": replyString(items[1])})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_PopArgs(t *testing.T) {
+	cases := []struct {
+		move bool
+		wait time.Duration
+		want []interface{}
+	}{
+		{true, 1500 * time.Millisecond, []interface{}{"BLMOVE", "jobs", "done", "RIGHT", "LEFT", "1.500"}},
+		{true, 0, []interface{}{"LMOVE", "jobs", "done", "RIGHT", "LEFT"}},
+		{false, time.Second, []interface{}{"BRPOP", "jobs", "1.000"}},
+		{false, 300 * time.Millisecond, []interface{}{"BRPOP", "jobs", "0.300"}},
+		{false, time.Microsecond, []interface{}{"BRPOP", "jobs", "0.001"}},
+		{false, 0, []interface{}{"RPOP", "jobs"}},
+	}
+	for _, c := range cases {
+		if got := popArgs("jobs", "done", "RIGHT", "LEFT", c.move, c.wait); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("move %v wait %v: %v", c.move, c.wait, got)
+		}
+	}
+}
+
+func Test_PopListMove(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}, "child0": {}}})
+
+	// A source and a destination on different shards.
+	src, des := "jobs", ""
+	src_name, _ := handler.keyShard(src)
+	for i := 0; des == ""; i++ {
+		if name, _ := handler.keyShard("done:" + strconv.Itoa(i)); name != src_name {
+			des = "done:" + strconv.Itoa(i)
+		}
+	}
+	_, src_client, _ := handler.keyClient(nil, src)
+	des_name, des_client, _ := handler.keyClient(nil, des)
+	src_client.RPush(src, "a", "b")
+
+	w := serveTest("/list/{key}/pop", "GET", handler.popList, "/list/jobs/pop?destination="+des+"&to=right", "")
+	if !strings.Contains(w.Body.String(), `"a"`) {
+		t.Fatalf("pop %s", w.Body.String())
+	}
+	if vals := des_client.LRange(des, 0, -1).Val(); len(vals) != 1 || vals[0] != "a" {
+		t.Errorf("%s on %s holds %v", des, des_name, vals)
+	}
+
+	// A destination that refuses the item gets it back to the source.
+	des_client.Del(des)
+	des_client.Set(des, "not a list", 0)
+	w = serveTest("/list/{key}/pop", "GET", handler.popList, "/list/jobs/pop?destination="+des, "")
+	if !strings.Contains(w.Body.String(), "WRONGTYPE") {
+		t.Errorf("pop onto a string: %s", w.Body.String())
+	}
+	if vals := src_client.LRange(src, 0, -1).Val(); len(vals) != 1 || vals[0] != "b" {
+		t.Errorf("%s holds %v after a failed move", src, vals)
+	}
+}
+
+func Test_PopListTimeout(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+	start := time.Now()
+	w := serveTest("/list/{key}/pop", "GET", handler.popList, "/list/empty/pop?timeout=0.3", "")
+	if took := time.Since(start); took < 250*time.Millisecond || took > 900*time.Millisecond {
+		t.Errorf("0.3s poll took %v", took)
+	}
+	if !strings.Contains(w.Body.String(), `"nil"`) {
+		t.Errorf("empty poll answered %s", w.Body.String())
+	}
+}
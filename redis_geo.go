@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// GEO keys are zsets, so they route like /zset and can be read or deleted
+// through it as well.
+const defaultGeoUnit = "m"
+
+type geoLocation struct {
+	Member string  `json:"member"`
+	Lon    float64 `json:"lon"`
+	Lat    float64 `json:"lat"`
+	// Only set by searches.
+	Dist *float64 `json:"dist,omitempty"`
+}
+
+func geoUnit(unit string) bool {
+	return unit == "m" || unit == "km" || unit == "mi" || unit == "ft"
+}
+
+// geoCoords converts a [lon, lat] reply.
+func geoCoords(v interface{}) (float64, float64, bool) {
+	pair, ok := v.([]interface{})
+	if !ok || len(pair) != 2 {
+		return 0, 0, false
+	}
+	lon, err0 := strconv.ParseFloat(replyString(pair[0]), 64)
+	lat, err1 := strconv.ParseFloat(replyString(pair[1]), 64)
+	return lon, lat, err0 == nil && err1 == nil
+}
+
+// Adds or moves the "member"s to the matching "lon"/"lat".
+// curl -d "member=dev1&lon=116.39&lat=39.91&member=dev2&lon=121.47&lat=31.23" /geo/devices
+func (this *CacheRequestHandler) addGeo(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	members, lons, lats := r.Form["member"], r.Form["lon"], r.Form["lat"]
+	if len(members) == 0 {
+		ErrorParam(w, "member")
+		return
+	}
+	if len(lons) != len(members) || len(lats) != len(members) {
+		ErrorParam(w, "member, lon and lat diff")
+		return
+	}
+
+	args := []interface{}{"GEOADD", key}
+	for i, member := range members {
+		lon, err := strconv.ParseFloat(lons[i], 64)
+		if err != nil || lon < -180 || lon > 180 {
+			ErrorParam(w, "lon")
+			return
+		}
+		lat, err := strconv.ParseFloat(lats[i], 64)
+		if err != nil || lat < -85.05112878 || lat > 85.05112878 {
+			ErrorParam(w, "lat")
+			return
+		}
+		args = append(args, lon, lat, member)
+	}
+
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	cmd := redis.NewIntCmd(args...)
+	done := traceRedis(r, shard, "GEOADD", key)
+	client.Process(cmd)
+	done(cmd.Err())
+	val, err := cmd.Result()
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, shard, key, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, val)
+}
+
+// curl "/geo/devices?type=geopos&member=dev1&member=dev2"
+// curl "/geo/devices?type=geodist&member=dev1&member=dev2&unit=km"
+// curl "/geo/devices?type=geosearch&member=dev1&radius=50&unit=km&sort=asc&count=10"
+// curl "/geo/devices?type=geosearch&lon=116.4&lat=39.9&width=20&height=10&unit=km"
+func (this *CacheRequestHandler) getGeo(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	action_type := this.GetFormValue(w, r, "type")
+	unit := this.GetFormValue(w, r, "unit")
+	if unit == "" {
+		unit = defaultGeoUnit
+	} else if !geoUnit(unit) {
+		ErrorParam(w, "unit")
+		return
+	}
+
+	if action_type == "geopos" {
+		members := r.Form["member"]
+		if len(members) == 0 {
+			ErrorParam(w, "member")
+			return
+		}
+		args := []interface{}{"GEOPOS", key}
+		for _, m := range members {
+			args = append(args, m)
+		}
+		cmd := redis.NewCmd(args...)
+		done := traceRedis(r, shard, "GEOPOS", key)
+		client.Process(cmd)
+		done(cmd.Err())
+		val, err := cmd.Result()
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		vals, _ := val.([]interface{})
+		locs := make([]*geoLocation, len(members))
+		for i, v := range vals {
+			if i >= len(members) {
+				break
+			}
+			// Missing members stay null.
+			if lon, lat, ok := geoCoords(v); ok {
+				locs[i] = &geoLocation{Member: members[i], Lon: lon, Lat: lat}
+			}
+		}
+		ErrorNil(w, locs)
+		return
+	} else if action_type == "geodist" {
+		members := r.Form["member"]
+		if len(members) != 2 {
+			ErrorParam(w, "member")
+			return
+		}
+		cmd := redis.NewStringCmd("GEODIST", key, members[0], members[1], unit)
+		done := traceRedis(r, shard, "GEODIST", key)
+		client.Process(cmd)
+		done(cmd.Err())
+		val, err := cmd.Float64()
+		if err == redis.Nil {
+			ErrorValNone(w)
+			return
+		} else if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
+	} else if action_type == "geosearch" {
+		this.searchGeo(w, r, shard, client, key, unit)
+		return
+	}
+	ErrorParam(w, "type")
+}
+
+// searchGeo runs GEOSEARCH from a "member" or "lon"/"lat", by "radius" or
+// "width"/"height", optionally sorted by distance and limited to "count".
+func (this *CacheRequestHandler) searchGeo(w http.ResponseWriter, r *http.Request, shard string, client *redis.Client, key, unit string) {
+	args := []interface{}{"GEOSEARCH", key}
+	if member := this.GetFormValue(w, r, "member"); member != "" {
+		args = append(args, "FROMMEMBER", member)
+	} else {
+		lon, err := strconv.ParseFloat(this.GetFormValue(w, r, "lon"), 64)
+		if err != nil {
+			ErrorParam(w, "member' or 'lon")
+			return
+		}
+		lat, err := strconv.ParseFloat(this.GetFormValue(w, r, "lat"), 64)
+		if err != nil {
+			ErrorParam(w, "lat")
+			return
+		}
+		args = append(args, "FROMLONLAT", lon, lat)
+	}
+
+	if radius := this.GetFormValue(w, r, "radius"); radius != "" {
+		n, err := strconv.ParseFloat(radius, 64)
+		if err != nil || n < 0 {
+			ErrorParam(w, "radius")
+			return
+		}
+		args = append(args, "BYRADIUS", n, unit)
+	} else {
+		width, err := strconv.ParseFloat(this.GetFormValue(w, r, "width"), 64)
+		if err != nil || width < 0 {
+			ErrorParam(w, "radius' or 'width")
+			return
+		}
+		height, err := strconv.ParseFloat(this.GetFormValue(w, r, "height"), 64)
+		if err != nil || height < 0 {
+			ErrorParam(w, "height")
+			return
+		}
+		args = append(args, "BYBOX", width, height, unit)
+	}
+
+	switch sort := this.GetFormValue(w, r, "sort"); sort {
+	case "":
+	case "asc", "desc":
+		args = append(args, strings.ToUpper(sort))
+	default:
+		ErrorParam(w, "sort")
+		return
+	}
+	count := this.max_full_read
+	if v := this.GetFormValue(w, r, "count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || (this.max_full_read > 0 && n > this.max_full_read) {
+			ErrorParam(w, "count")
+			return
+		}
+		count = n
+	}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	args = append(args, "WITHDIST", "WITHCOORD")
+
+	cmd := redis.NewCmd(args...)
+	done := traceRedis(r, shard, "GEOSEARCH", key)
+	client.Process(cmd)
+	done(cmd.Err())
+	val, err := cmd.Result()
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	// Each match is [member, dist, [lon, lat]].
+	items, _ := val.([]interface{})
+	locs := make([]geoLocation, 0, len(items))
+	for _, item := range items {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) != 3 {
+			ErrorExcu(w, fmt.Errorf("unexpected GEOSEARCH reply"))
+			return
+		}
+		loc := geoLocation{Member: replyString(fields[0])}
+		dist, _ := strconv.ParseFloat(replyString(fields[1]), 64)
+		loc.Dist = &dist
+		loc.Lon, loc.Lat, _ = geoCoords(fields[2])
+		locs = append(locs, loc)
+	}
+	ErrorNil(w, locs)
+}
+
+// curl -X DELETE "/geo/devices?member=dev1&member=dev2"
+func (this *CacheRequestHandler) delGeo(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	members := r.Form["member"]
+	if len(members) == 0 {
+		ErrorParam(w, "member")
+		return
+	}
+	vals := make([]interface{}, len(members))
+	for i, m := range members {
+		vals[i] = m
+	}
+
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "ZREM", key)
+	val, err := client.ZRem(key, vals...).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
+}
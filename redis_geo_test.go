@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_GeoCoords(t *testing.T) {
+	if lon, lat, ok := geoCoords([]interface{}{"116.39", []byte("39.91")}); !ok || lon != 116.39 || lat != 39.91 {
+		t.Errorf("coords %v %v %v", lon, lat, ok)
+	}
+	for _, v := range []interface{}{nil, []interface{}{"1"}, []interface{}{"x", "2"}} {
+		if _, _, ok := geoCoords(v); ok {
+			t.Errorf("%v parsed as coords", v)
+		}
+	}
+	for unit, want := range map[string]bool{"m": true, "km": true, "mi": true, "ft": true, "yd": false, "KM": false} {
+		if geoUnit(unit) != want {
+			t.Errorf("unit %s", unit)
+		}
+	}
+}
+
+func Test_GeoParams(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+
+	adds := map[string]string{
+		"":                                    "member",
+		"member=a&lon=1":                      "member, lon and lat diff",
+		"member=a&lon=181&lat=0":              "lon",
+		"member=a&lon=east&lat=0":             "lon",
+		"member=a&lon=0&lat=86":               "lat",
+		"member=a&lon=1&lat=2&member=b&lat=3": "member, lon and lat diff",
+	}
+	for body, param := range adds {
+		w := serveTest("/geo/{key}", "POST", handler.addGeo, "/geo/devices", body)
+		if !strings.Contains(w.Body.String(), "Param '"+param+"'") {
+			t.Errorf("add %q answered %s", body, w.Body.String())
+		}
+	}
+
+	gets := map[string]string{
+		"type=nearest":                                "type",
+		"type=geopos&unit=yd":                         "unit",
+		"type=geopos":                                 "member",
+		"type=geodist&member=a":                       "member",
+		"type=geosearch&radius=5":                     "member' or 'lon",
+		"type=geosearch&lon=1&radius=5":               "lat",
+		"type=geosearch&member=a&radius=-1":           "radius",
+		"type=geosearch&member=a":                     "radius' or 'width",
+		"type=geosearch&member=a&width=5":             "height",
+		"type=geosearch&member=a&radius=5&sort=up":    "sort",
+		"type=geosearch&member=a&radius=5&count=0":    "count",
+		"type=geosearch&member=a&radius=5&count=lots": "count",
+	}
+	for query, param := range gets {
+		w := serveTest("/geo/{key}", "GET", handler.getGeo, "/geo/devices?"+query, "")
+		if !strings.Contains(w.Body.String(), "Param '"+param+"'") {
+			t.Errorf("get %q answered %s", query, w.Body.String())
+		}
+	}
+
+	w := serveTest("/geo/{key}", "POST", handler.addGeo, "/geo/devices", "member=dev1&lon=116.39&lat=39.91")
+	if !strings.Contains(w.Body.String(), `"val":"1"`) {
+		t.Fatalf("add answered %s", w.Body.String())
+	}
+	w = serveTest("/geo/{key}", "GET", handler.getGeo, "/geo/devices?type=geopos&member=dev1&member=none", "")
+	if !strings.Contains(w.Body.String(), `"member":"dev1"`) || !strings.HasSuffix(strings.TrimSpace(w.Body.String()), `null]}`) {
+		t.Errorf("geopos answered %s", w.Body.String())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// Adds "element"s to the HyperLogLog; true when its estimate changed.
+// curl -d "element=u1&element=u2&expire=86400" /hll/visitors:20170401
+func (this *CacheRequestHandler) addHLL(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	elements := r.Form["element"]
+	if len(elements) == 0 {
+		ErrorParam(w, "element")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	args := []interface{}{"PFADD", key}
+	for _, e := range elements {
+		args = append(args, e)
+	}
+	cmd := redis.NewIntCmd(args...)
+	done := traceRedis(r, shard, "PFADD", key)
+	client.Process(cmd)
+	val, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, shard, key, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, val == 1)
+}
+
+// Estimates the cardinality of the union of the "key"s, which may live on
+// different shards.
+// curl "/hll?key=visitors:20170401&key=visitors:20170402"
+func (this *CacheRequestHandler) countHLL(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		ErrorParam(w, "key")
+		return
+	}
+
+	name, err := this.keyShard(keys[0])
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	client := this.master_clients[name]
+	local, temps, err := this.colocateKeys(r, name, keys)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if len(temps) > 0 {
+		defer client.Del(temps...)
+	}
+
+	args := []interface{}{"PFCOUNT"}
+	for _, key := range local {
+		args = append(args, key)
+	}
+	cmd := redis.NewIntCmd(args...)
+	done := traceRedis(r, name, "PFCOUNT", keys[0])
+	client.Process(cmd)
+	val, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
+}
+
+// Merges the "key"s into the HyperLogLog {key}; sources on other shards
+// are copied to its shard first.
+// curl -d "key=visitors:20170401&key=visitors:20170402" /hll/visitors:week14/merge
+func (this *CacheRequestHandler) mergeHLL(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	dest := mux.Vars(r)["key"]
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		ErrorParam(w, "key")
+		return
+	}
+
+	name, client, err := this.keyClient(r, dest)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	local, temps, err := this.colocateKeys(r, name, keys)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if len(temps) > 0 {
+		defer client.Del(temps...)
+	}
+
+	args := []interface{}{"PFMERGE", dest}
+	for _, key := range local {
+		args = append(args, key)
+	}
+	cmd := redis.NewStatusCmd(args...)
+	done := traceRedis(r, name, "PFMERGE", dest)
+	client.Process(cmd)
+	done(cmd.Err())
+	if err := cmd.Err(); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		if err := this.setExpire(r, name, dest, exp, client); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, nil)
+}
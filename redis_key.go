@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+// renameKey renames key to newkey. When both keys hash to the same shard the
+// native RENAME is used, otherwise the value is moved with DUMP/RESTORE
+// (keeping the remaining TTL) and the source key deleted.
+// With nx set an existing newkey is left untouched and false returned.
+func (this *CacheRequestHandler) renameKey(r *http.Request, key, newkey string, nx bool) (bool, error) {
+	src_name, src, err := this.keyClient(r, key)
+	if err != nil {
+		return false, err
+	}
+	des_name, des, err := this.keyClient(r, newkey)
+	if err != nil {
+		return false, err
+	}
+
+	if src_name == des_name {
+		if nx {
+			done := traceRedis(r, src_name, "RENAMENX", key)
+			ok, err := src.RenameNX(key, newkey).Result()
+			done(err)
+			return ok, err
+		}
+		done := traceRedis(r, src_name, "RENAME", key)
+		err = src.Rename(key, newkey).Err()
+		done(err)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return this.moveKey(r, src_name, src, des_name, des, key, newkey, nx)
+}
+
+// errNoSuchKey is what RENAME answers for a missing key.
+var errNoSuchKey = errors.New("ERR no such key")
+
+// KEYS: key. ARGV: dump. Deletes key if it still holds the dumped value;
+// returns 0 otherwise.
+var moveDelScript = NewLuaScript(`
+if redis.call('DUMP', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// moveKey copies key from shard src_name to newkey on des_name and deletes
+// the source. The source is only deleted if it still holds the dumped
+// value; when it was written in between both keys are kept and an error
+// says newkey holds the value from before.
+func (this *CacheRequestHandler) moveKey(r *http.Request, src_name string, src *redis.Client, des_name string, des *redis.Client, key, newkey string, nx bool) (bool, error) {
+	done := traceRedis(r, src_name, "DUMP", key)
+	dump, err := src.Dump(key).Result()
+	done(err)
+	if err == redis.Nil {
+		return false, errNoSuchKey
+	} else if err != nil {
+		return false, err
+	}
+
+	pttl_cmd := redis.NewIntCmd("PTTL", key)
+	done = traceRedis(r, src_name, "PTTL", key)
+	src.Process(pttl_cmd)
+	pttl, err := pttl_cmd.Result()
+	done(err)
+	if err != nil {
+		return false, err
+	}
+	if pttl == -2 {
+		return false, errNoSuchKey
+	}
+	if pttl < 0 {
+		pttl = 0
+	}
+
+	args := []interface{}{"RESTORE", newkey, pttl, dump}
+	if !nx {
+		args = append(args, "REPLACE")
+	}
+	restore_cmd := redis.NewStatusCmd(args...)
+	done = traceRedis(r, des_name, "RESTORE", newkey)
+	des.Process(restore_cmd)
+	done(restore_cmd.Err())
+	if err := restore_cmd.Err(); err != nil {
+		if nx && strings.HasPrefix(err.Error(), "BUSYKEY") {
+			return false, nil
+		}
+		return false, err
+	}
+
+	done = traceRedis(r, src_name, "EVALSHA", key)
+	n, err := moveDelScript.Run(src, []string{key}, dump).Result()
+	done(err)
+	if err != nil {
+		return true, err
+	}
+	if replyInt(n) == 0 {
+		return true, fmt.Errorf("%s was written while moving it to %s, which holds the earlier value; both are kept", key, newkey)
+	}
+	return true, nil
+}
+
+// Lifetime of the copies made by colocateKeys, in case the proxy dies
+// before removing them.
+const colocateTTL = time.Minute
+
+// colocateKeys makes string keys (HLLs, bitmaps) readable on shard name so a
+// multi-key command can run there. Keys owned by other shards are copied to
+// temporary keys, which the caller deletes with the returned list.
+func (this *CacheRequestHandler) colocateKeys(r *http.Request, name string, keys []string) ([]string, []string, error) {
+	client := this.master_clients[name]
+	local := make([]string, len(keys))
+	temps := []string{}
+	for i, key := range keys {
+		key_name, key_client, err := this.keyClient(r, key)
+		if err != nil {
+			client.Del(temps...)
+			return nil, nil, err
+		}
+		if key_name == name {
+			local[i] = key
+			continue
+		}
+
+		tmp := "tmp:colocate:" + newItemID()
+		local[i] = tmp
+		temps = append(temps, tmp)
+		done := traceRedis(r, key_name, "GET", key)
+		val, err := key_client.Get(key).Result()
+		done(err)
+		if err == redis.Nil {
+			// A missing key reads as empty on both sides.
+			continue
+		} else if err != nil {
+			client.Del(temps...)
+			return nil, nil, err
+		}
+		done = traceRedis(r, name, "SET", tmp)
+		err = client.Set(tmp, val, colocateTTL).Err()
+		done(err)
+		if err != nil {
+			client.Del(temps...)
+			return nil, nil, err
+		}
+	}
+	return local, temps, nil
+}
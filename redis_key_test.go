@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// keysApart returns two keys that hash to different shards.
+func keysApart(t *testing.T, handler *CacheRequestHandler, prefix string) (string, string) {
+	first, _, err := handler.keyClient(nil, prefix+"0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 1000; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		if name, _, _ := handler.keyClient(nil, key); name != first {
+			return prefix + "0", key
+		}
+	}
+	t.Fatal("all keys on one shard")
+	return "", ""
+}
+
+func Test_RenameKeyAcrossShards(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"s0": {}, "s1": {}}})
+	key, newkey := keysApart(t, handler, "rename-")
+	_, src, _ := handler.keyClient(nil, key)
+	_, des, _ := handler.keyClient(nil, newkey)
+
+	src.Set(key, "moved", time.Hour)
+	des.Set(newkey, "kept", 0)
+
+	// nx leaves both sides alone when the target exists.
+	if ok, err := handler.renameKey(nil, key, newkey, true); ok || err != nil {
+		t.Fatalf("nx rename answered %v %v", ok, err)
+	}
+	if v, _ := src.Get(key).Result(); v != "moved" {
+		t.Errorf("source after nx rename: %q", v)
+	}
+	if v, _ := des.Get(newkey).Result(); v != "kept" {
+		t.Errorf("target after nx rename: %q", v)
+	}
+
+	if ok, err := handler.renameKey(nil, key, newkey, false); !ok || err != nil {
+		t.Fatalf("rename answered %v %v", ok, err)
+	}
+	if n, _ := src.Exists(key).Result(); n {
+		t.Error("source survived the move")
+	}
+	if v, _ := des.Get(newkey).Result(); v != "moved" {
+		t.Errorf("target after rename: %q", v)
+	}
+	if ttl, _ := des.PTTL(newkey).Result(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("ttl after rename: %v", ttl)
+	}
+
+	if _, err := handler.renameKey(nil, key, newkey, false); err != errNoSuchKey {
+		t.Errorf("renaming a missing key answered %v", err)
+	}
+
+	// A source written after its DUMP is kept.
+	src.Set(key, "before", 0)
+	dump, _ := src.Dump(key).Result()
+	src.Set(key, "after", 0)
+	if n, err := moveDelScript.Run(src, []string{key}, dump).Result(); err != nil || replyInt(n) != 0 {
+		t.Errorf("deleting a changed source answered %v %v", n, err)
+	}
+	if v, _ := src.Get(key).Result(); v != "after" {
+		t.Errorf("changed source after the move: %q", v)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,48 +24,148 @@ func (this *CacheRequestHandler) GetFormValue(w http.ResponseWriter, r *http.Req
 	return r.Form[form_name][0]
 }
 
-func (this *CacheRequestHandler) setExpire(key, exp string, redis_client *redis.Client) error {
+func (this *CacheRequestHandler) setExpire(r *http.Request, name, key, exp string, redis_client *redis.Client) error {
 	exp_int, err := strconv.Atoi(exp)
 	if err != nil {
 		return err
 	}
 
-	err = redis_client.Expire(key, (time.Duration)(exp_int)).Err()
+	done := traceRedis(r, name, "EXPIRE", key)
+	err = redis_client.Expire(key, time.Duration(exp_int)*time.Second).Err()
+	done(err)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// keyClient returns the shard name owning key and its master client, and
+// notes the shard in the log of r (nil for background work).
+func (this *CacheRequestHandler) keyClient(r *http.Request, key string) (string, *redis.Client, error) {
+	name, err := this.keyShard(key)
+	if err != nil {
+		return "", nil, err
+	}
+	noteShard(r, name)
+	return name, this.master_clients[name], nil
+}
+
 func (this *CacheRequestHandler) addServer(name string, redis_cfg redisInfo) error {
-	master_client := redis.NewFailoverClient(&redis.FailoverOptions{
-		MasterName:    redis_cfg.MasterName,
-		SentinelAddrs: this.k8s_nodes[name],
-		DB:            redis_cfg.Db, // use default DB
-	})
-
-	_, err := master_client.Ping().Result()
-	if err == nil {
-		fmt.Println("Redis Link Success:", this.k8s_nodes)
-		this.master_clients[name] = master_client
-		this.master_hashRing.Add(name)
-		return nil
-	} else {
-		fmt.Println("Redis Link Failed:", this.k8s_nodes)
+	if this.shards_fixed {
+		return fmt.Errorf("shard %s: shards are fixed once the background loops run", name)
+	}
+	master_client, err := newMasterClient(redis_cfg, this.k8s_nodes[name], 0, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = master_client.Ping().Result()
+	if err != nil {
+		logError("redis ping", "shard", name, "nodes", this.k8s_nodes[name], "err", err)
+		master_client.Close()
+		return fmt.Errorf("Redis Link ERROR.")
+	}
+	block_client, err := newBlockClient(redis_cfg, this.k8s_nodes[name], this.max_blocking)
+	if err != nil {
+		master_client.Close()
+		return err
 	}
 
-	return fmt.Errorf("Redis Link ERROR.")
+	logInfo("redis link", "shard", name, "nodes", this.k8s_nodes[name])
+	this.master_clients[name] = master_client
+	this.block_clients[name] = block_client
+	this.addToRings(name)
+	return nil
 }
 
 func (this *CacheRequestHandler) Init(cfg cacheConfig) error {
+	level, err := parseLogLevel(cfg.Log.Level)
+	if err != nil {
+		logFatal("log", "err", err)
+	}
+	logger.level = level
+
 	this.master_clients = make(map[string]*redis.Client)
+	this.block_clients = make(map[string]*redis.Client)
 	this.k8s_nodes = make(map[string][]string)
 	this.master_hashRing = NewConsisten()
+	this.pubsub = newPubSubHub(this)
+	this.request_metrics = newRequestMetrics()
+
+	this.rate_limits = make(map[string]rateLimitInfo)
+	for bucket, l := range cfg.Ratelimit {
+		if strings.Contains(bucket, ":") {
+			logFatal("ratelimit", "name", bucket, "err", "':' in bucket name")
+		}
+		if err := l.validate(); err != nil {
+			logFatal("ratelimit", "name", bucket, "err", err)
+		}
+		this.rate_limits[bucket] = l
+	}
+	if err := this.initNamespaces(&cfg); err != nil {
+		logFatal("namespace", "err", err)
+	}
+	if err := this.initGroups(cfg); err != nil {
+		logFatal("group", "err", err)
+	}
+	if err := cfg.Listen.validate(); err != nil {
+		logFatal("listen", "err", err)
+	}
+	if len(cfg.Apikey) > 0 || cfg.Auth.Jwks != "" || cfg.Listen.ClientCA != "" {
+		a, err := newAuthenticator(cfg.Auth, cfg.Apikey, cfg.Acl)
+		if err != nil {
+			logFatal("auth", "err", err)
+		}
+		a.cert_auth = cfg.Listen.ClientCA != ""
+		a.cert_principals = cfg.Listen.Principals
+		this.auth = a
+	}
+	this.ws_origins = cfg.Listen.Origins
+	if cfg.Audit.File != "" {
+		a, err := newAuditor(cfg.Audit)
+		if err != nil {
+			logFatal("audit", "err", err)
+		}
+		this.auditor = a
+	}
+	if cfg.Tracing.Endpoint != "" && cfg.Tracing.SampleRate == 0 {
+		logWarn("tracing off", "reason", "samplerate is 0")
+	} else if cfg.Tracing.Endpoint != "" {
+		t, err := newTracer(cfg.Tracing)
+		if err != nil {
+			logFatal("tracing", "err", err)
+		}
+		this.tracer = t
+	}
+	if err := this.initCompression(cfg.Compression); err != nil {
+		logFatal("compression", "err", err)
+	}
+	if cfg.Encryption.Keyring != "" {
+		e, err := newEncryptor(cfg.Encryption)
+		if err != nil {
+			logFatal("encryption", "err", err)
+		}
+		this.encryptor = e
+	}
+
+	this.schedule = cfg.Schedule
+	if this.schedule.MaxAttempts <= 0 {
+		this.schedule.MaxAttempts = defaultScheduleMaxAttempts
+	}
+
+	this.max_full_read = cfg.Limit.MaxFullRead
+	if this.max_full_read == 0 {
+		this.max_full_read = defaultMaxFullRead
+	}
+	this.max_blocking = cfg.Limit.MaxBlocking
+	if this.max_blocking <= 0 {
+		this.max_blocking = defaultMaxBlocking
+	}
 
 	for name, redis_cfg := range cfg.Redis {
 		nodes, err := GetNodes("http://"+cfg.Kubernetes.Server+":"+strconv.Itoa(cfg.Kubernetes.Port)+"/api/v1/nodes", redis_cfg.Nodelabel)
 		if err != nil {
-			log.Fatalf("Get Nodes Error:%s, %s", name, err.Error())
+			logFatal("get nodes", "shard", name, "err", err)
 			return err
 		}
 
@@ -75,9 +174,21 @@ func (this *CacheRequestHandler) Init(cfg cacheConfig) error {
 		}
 		err = this.addServer(name, redis_cfg)
 		if err != nil {
-			log.Println(name, ",ERROR: ", err.Error())
+			logError("redis link", "shard", name, "err", err)
 		}
 	}
+	this.checkRings()
+
+	// Started once the shards are added, as they scan master_clients.
+	this.shards_fixed = true
+	if len(this.namespaces) > 0 {
+		go this.quotaLoop()
+	}
+	if this.encryptor != nil && this.encryptor.info.Reencrypt > 0 {
+		go this.reencryptLoop()
+	}
+	go this.queueReaper()
+	go this.scheduleMover()
 	return nil
 }
 
@@ -94,17 +205,37 @@ func (this *CacheRequestHandler) setString(w http.ResponseWriter, r *http.Reques
 		fmt.Fprintf(w, "%v", "ERR: val Empty")
 		return
 	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	val, err := decodeValue(b64, val)
+	if err != nil {
+		ErrorParam(w, "value")
+		return
+	}
+	val, err = this.storeValue(key, val)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	exp := this.GetFormValue(w, r, "expire")
 
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 
-	err := this.master_clients[name].Set(key, val, 0).Err()
+	done := traceRedis(r, name, "SET", key)
+	err = this.master_clients[name].Set(key, val, 0).Err()
+	done(err)
 	if err != nil {
 		fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 	}
 
 	if exp != "" {
-		err := this.setExpire(key, exp, this.master_clients[name])
+		err := this.setExpire(r, name, key, exp, this.master_clients[name])
 		if err != nil {
 			fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 			return
@@ -128,17 +259,37 @@ func (this *CacheRequestHandler) updateString(w http.ResponseWriter, r *http.Req
 		fmt.Fprintf(w, "%v", "ERR: val Empty")
 		return
 	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	val, err := decodeValue(b64, val)
+	if err != nil {
+		ErrorParam(w, "value")
+		return
+	}
+	val, err = this.storeValue(key, val)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	exp := this.GetFormValue(w, r, "expire")
 
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 
-	err := this.master_clients[name].Set(key, val, 0).Err()
+	done := traceRedis(r, name, "SET", key)
+	err = this.master_clients[name].Set(key, val, 0).Err()
+	done(err)
 	if err != nil {
 		fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 	}
 
 	if exp != "" {
-		err := this.setExpire(key, exp, this.master_clients[name])
+		err := this.setExpire(r, name, key, exp, this.master_clients[name])
 		if err != nil {
 			fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 			return
@@ -157,7 +308,11 @@ func (this *CacheRequestHandler) setHash(w http.ResponseWriter, r *http.Request)
 		fmt.Fprintf(w, "%v", "ERR: key Empty")
 		return
 	}
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	client := this.master_clients[name]
 
 	fields := r.Form["field"]
@@ -171,6 +326,18 @@ func (this *CacheRequestHandler) setHash(w http.ResponseWriter, r *http.Request)
 		ErrorParam(w, "value")
 		return
 	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	if err := decodeValues(b64, vals); err != nil {
+		ErrorParam(w, "value")
+		return
+	}
+	if err := this.storeValues(key, vals); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 
 	if len(fields) != len(vals) {
 		ErrorParam(w, "field and value diff")
@@ -179,14 +346,17 @@ func (this *CacheRequestHandler) setHash(w http.ResponseWriter, r *http.Request)
 
 	if len(fields) >= 2 {
 		val_map, err := ParseHashValue(fields, vals)
-		fmt.Println(val_map)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
 		}
+		done := traceRedis(r, name, "HMSET", key)
 		err = client.HMSet(key, val_map).Err()
+		done(err)
 	} else {
+		done := traceRedis(r, name, "HSET", key)
 		err = client.HSet(key, fields[0], vals[0]).Err()
+		done(err)
 	}
 	if err != nil {
 		ErrorExcu(w, err)
@@ -195,7 +365,7 @@ func (this *CacheRequestHandler) setHash(w http.ResponseWriter, r *http.Request)
 
 	exp := this.GetFormValue(w, r, "expire")
 	if exp != "" {
-		err := this.setExpire(key, exp, this.master_clients[name])
+		err := this.setExpire(r, name, key, exp, this.master_clients[name])
 		if err != nil {
 			ErrorExcu(w, err)
 			return
@@ -219,15 +389,36 @@ func (this *CacheRequestHandler) setList(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	port := this.master_hashRing.Get(key)
-	err := this.master_clients[port].LPush(key, val).Err()
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	val, err := decodeValue(b64, val)
+	if err != nil {
+		ErrorParam(w, "value")
+		return
+	}
+	val, err = this.storeValue(key, val)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, port, "LPUSH", key)
+	err = this.master_clients[port].LPush(key, val).Err()
+	done(err)
 	if err != nil {
 		fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 	}
 
 	exp := this.GetFormValue(w, r, "expire")
 	if exp != "" {
-		err := this.setExpire(key, exp, this.master_clients[port])
+		err := this.setExpire(r, port, key, exp, this.master_clients[port])
 		if err != nil {
 			fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 			return
@@ -251,16 +442,22 @@ func (this *CacheRequestHandler) setZset(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	port := this.master_hashRing.Get(key)
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	val_zset, err := ParseZSetValue(val)
+	done := traceRedis(r, port, "ZADD", key)
 	err = this.master_clients[port].ZAdd(key, val_zset).Err()
+	done(err)
 	if err != nil {
 		fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 	}
 
 	exp := this.GetFormValue(w, r, "expire")
 	if exp != "" {
-		err := this.setExpire(key, exp, this.master_clients[port])
+		err := this.setExpire(r, port, key, exp, this.master_clients[port])
 		if err != nil {
 			fmt.Fprintf(w, "%v", "ERR: "+err.Error())
 			return
@@ -285,16 +482,32 @@ func (this *CacheRequestHandler) getZset(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if action_type == "zscan" {
+		name, client, err := this.keyClient(r, key)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		this.scanCollection(w, r, name, client, key, action_type)
+		return
+	}
+
 	member := this.GetFormValue(w, r, "member")
 	if member == "" {
 		fmt.Fprintf(w, "%v", "ERR: member Empty")
 		return
 	}
 
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	client := this.master_clients[name]
 	if action_type == "zrank" {
+		done := traceRedis(r, name, "ZRANK", key)
 		val, err := client.ZRank(key, member).Result()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 		} else {
@@ -302,7 +515,9 @@ func (this *CacheRequestHandler) getZset(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	} else if action_type == "zrevrank" {
+		done := traceRedis(r, name, "ZREVRANK", key)
 		val, err := client.ZRevRank(key, member).Result()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 		} else {
@@ -331,7 +546,16 @@ func (this *CacheRequestHandler) getZset(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
+		if zrange_s < 0 || zrange_e < 0 || zrange_e-zrange_s >= this.max_full_read {
+			if err := this.checkFullRead(r, name, client, key, "zset"); err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+		}
+
+		done := traceRedis(r, name, "ZRANGE", key)
 		vals, err := client.ZRange(key, zrange_s, zrange_e).Result()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 		} else {
@@ -357,15 +581,30 @@ func (this *CacheRequestHandler) getString(w http.ResponseWriter, r *http.Reques
 		fmt.Fprintf(w, "%v", "ERR: Key Empty")
 	}
 
-	port := this.master_hashRing.Get(key)
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
+	done := traceRedis(r, port, "GET", key)
 	val, err := this.master_clients[port].Get(key).Result()
+	done(err)
 	if err == redis.Nil {
 		fmt.Fprintf(w, "%v", "NIL")
 	} else if err != nil {
 		ErrorExcu(w, err)
+	} else if wantOctetStream(r) {
+		this.writeStoredValue(w, r, val, this.GetFormValue(w, r, "raw") == "1")
+	} else if val, err = this.loadValue(val); err != nil {
+		ErrorExcu(w, err)
 	} else {
-		ErrorNil(w, val)
+		ErrorNil(w, encodeValue(b64, val))
 	}
 }
 
@@ -378,22 +617,36 @@ func (this *CacheRequestHandler) getHash(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	port := this.master_hashRing.Get(key)
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	client := this.master_clients[port]
 
 	action_type := this.GetFormValue(w, r, "type")
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
 
 	if action_type == "hget" {
 		field := this.GetFormValue(w, r, "field")
 		if field != "" {
+			done := traceRedis(r, port, "HGET", key)
 			val, err := client.HGet(key, field).Result()
+			done(err)
 			if err == redis.Nil {
 				fmt.Fprintf(w, "%v", "NIL")
 			} else if err != nil {
 				fmt.Fprintf(w, "%v", "ERR:"+err.Error())
 				return
 			}
-			ErrorNil(w, val)
+			if val, err = this.loadValue(val); err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+			ErrorNil(w, encodeValue(b64, val))
 			return
 		}
 	} else if action_type == "hmget" {
@@ -403,7 +656,9 @@ func (this *CacheRequestHandler) getHash(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
+		done := traceRedis(r, port, "HMGET", key)
 		vals, err := client.HMGet(key, fields...).Result()
+		done(err)
 		if err == redis.Nil {
 			fmt.Fprintf(w, "%v", "NIL")
 		} else if err != nil {
@@ -413,23 +668,49 @@ func (this *CacheRequestHandler) getHash(w http.ResponseWriter, r *http.Request)
 			fmt.Fprintf(w, "%v", `{"_type":"0","val":[]}`)
 			return
 		}
-		vals_str := "["
-		for _, s := range vals {
-			vals_str += `"` + s.(string) + `",`
+		// Missing fields stay null.
+		for i, v := range vals {
+			if s, ok := v.(string); ok {
+				s, err = this.loadValue(s)
+				if err != nil {
+					ErrorExcu(w, err)
+					return
+				}
+				vals[i] = encodeValue(b64, s)
+			}
 		}
-		vals_str = vals_str[:len(vals_str)-1] + `]`
-		ret := `{"_type":"0","val":` + vals_str + `}`
-		fmt.Fprintf(w, "%v", ret)
+		ErrorNil(w, vals)
+		return
+	} else if action_type == "hscan" {
+		this.scanCollection(w, r, port, client, key, action_type)
+		return
+	}
+
+	stream, ok := this.wantStream(w, r, port, client, key, "hash")
+	if !ok {
+		return
+	} else if stream {
+		this.streamCollection(w, r, port, client, key, "hash")
 		return
 	}
 
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
+	done := traceRedis(r, port, "HGETALL", key)
 	val, err := client.HGetAll(key).Result()
+	done(err)
 	if err == redis.Nil {
 		fmt.Fprintf(w, "%v", "NIL")
 	} else if err != nil {
 		fmt.Fprintf(w, "%v", "ERR:"+err.Error())
 	}
+	for field, v := range val {
+		v, err = this.loadValue(v)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		val[field] = encodeValue(b64, v)
+	}
 	if len(val) == 0 {
 		val["_type"] = "3"
 	} else {
@@ -450,7 +731,11 @@ func (this *CacheRequestHandler) updateHash(w http.ResponseWriter, r *http.Reque
 		ErrorNil(w, "key")
 		return
 	}
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	client := this.master_clients[name]
 
 	fields := r.Form["field"]
@@ -464,6 +749,18 @@ func (this *CacheRequestHandler) updateHash(w http.ResponseWriter, r *http.Reque
 		ErrorParam(w, "value")
 		return
 	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	if err := decodeValues(b64, vals); err != nil {
+		ErrorParam(w, "value")
+		return
+	}
+	if err := this.storeValues(key, vals); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 
 	if len(vals) != len(fields) {
 		ErrorParam(w, "value and field diff")
@@ -476,9 +773,13 @@ func (this *CacheRequestHandler) updateHash(w http.ResponseWriter, r *http.Reque
 			ErrorExcu(w, err)
 			return
 		}
+		done := traceRedis(r, name, "HMSET", key)
 		err = client.HMSet(key, val_map).Err()
+		done(err)
 	} else {
+		done := traceRedis(r, name, "HSET", key)
 		err = client.HSet(key, fields[0], vals[0]).Err()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
@@ -487,7 +788,7 @@ func (this *CacheRequestHandler) updateHash(w http.ResponseWriter, r *http.Reque
 
 	exp := this.GetFormValue(w, r, "expire")
 	if exp != "" {
-		err := this.setExpire(key, exp, client)
+		err := this.setExpire(r, name, key, exp, client)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
@@ -502,7 +803,11 @@ func (this *CacheRequestHandler) delHash(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	port := this.master_hashRing.Get(key)
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
 	client := this.master_clients[port]
 
@@ -510,7 +815,9 @@ func (this *CacheRequestHandler) delHash(w http.ResponseWriter, r *http.Request)
 	vals := strings.Split(field, " ")
 
 	if len(vals) > 0 {
+		done := traceRedis(r, port, "HDEL", key)
 		delvals, err := client.HDel(key, vals...).Result()
+		done(err)
 		if err == redis.Nil {
 			fmt.Fprintf(w, "%v", `{"_type":"1","_msg":"key is not exist"}`)
 		} else if err != nil {
@@ -536,16 +843,34 @@ func (this *CacheRequestHandler) setSet(w http.ResponseWriter, r *http.Request)
 		ErrorParam(w, "members")
 		return
 	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	if err := decodeValues(b64, members); err != nil {
+		ErrorParam(w, "member")
+		return
+	}
+	if err := this.storeMembers(key, members); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 
 	new_vals := make([]interface{}, len(members))
 	for i, v := range members {
 		new_vals[i] = v
 	}
 
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	client := this.master_clients[name]
 
-	err := client.SAdd(key, new_vals...).Err()
+	done := traceRedis(r, name, "SADD", key)
+	err = client.SAdd(key, new_vals...).Err()
+	done(err)
 	if err != nil {
 		ErrorExcu(w, err)
 		return
@@ -553,7 +878,7 @@ func (this *CacheRequestHandler) setSet(w http.ResponseWriter, r *http.Request)
 
 	exp := this.GetFormValue(w, r, "expire")
 	if exp != "" {
-		err := this.setExpire(key, exp, client)
+		err := this.setExpire(r, name, key, exp, client)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
@@ -572,24 +897,39 @@ func (this *CacheRequestHandler) getSet(w http.ResponseWriter, r *http.Request)
 	}
 
 	action_type := this.GetFormValue(w, r, "type")
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
 
-	port := this.master_hashRing.Get(key)
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
 	client := this.master_clients[port]
 
 	if action_type == "srandmember" {
+		done := traceRedis(r, port, "SRANDMEMBER", key)
 		val, err := client.SRandMember(key).Result()
+		done(err)
 		if err == redis.Nil {
 			fmt.Fprintf(w, "%v", "NIL")
 		} else if err != nil {
 			fmt.Fprintf(w, "%v", "ERR:"+err.Error())
 		}
+		if val, err = this.decryptValue(val); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
 
-		ret := `{"_type":"0","val":"` + val + `"}`
-		fmt.Fprintf(w, "%v", ret)
+		ErrorNil(w, encodeValue(b64, val))
 		return
 	} else if action_type == "scard" {
+		done := traceRedis(r, port, "SCARD", key)
 		val, err := client.SCard(key).Result()
+		done(err)
 		if err == redis.Nil {
 			ErrorValNone(w)
 			return
@@ -598,18 +938,21 @@ func (this *CacheRequestHandler) getSet(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		fmt.Println(val)
-
 		ErrorNil(w, val)
 		return
 	} else if action_type == "sismember" {
-		fmt.Println("SISMEMBER")
-		mem := this.GetFormValue(w, r, "member")
-		if mem == "" {
+		mem, err := decodeValue(b64, this.GetFormValue(w, r, "member"))
+		if mem == "" || err != nil {
 			ErrorParam(w, "member")
 			return
 		}
+		if mem, err = this.storeMember(key, mem); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		done := traceRedis(r, port, "SISMEMBER", key)
 		val, err := client.SIsMember(key, mem).Result()
+		done(err)
 		if err == redis.Nil {
 			ErrorValNone(w)
 			return
@@ -617,11 +960,22 @@ func (this *CacheRequestHandler) getSet(w http.ResponseWriter, r *http.Request)
 			ErrorExcu(w, err)
 			return
 		}
-		fmt.Println("=========:", val)
 		ErrorNil(w, val)
 		return
+	} else if action_type == "sscan" {
+		this.scanCollection(w, r, port, client, key, action_type)
+		return
 	} else { // smembers
+		stream, ok := this.wantStream(w, r, port, client, key, "set")
+		if !ok {
+			return
+		} else if stream {
+			this.streamCollection(w, r, port, client, key, "set")
+			return
+		}
+		done := traceRedis(r, port, "SMEMBERS", key)
 		vals, err := client.SMembers(key).Result()
+		done(err)
 		if err == redis.Nil {
 			fmt.Fprintf(w, "%v", "NIL")
 		} else if err != nil {
@@ -631,13 +985,11 @@ func (this *CacheRequestHandler) getSet(w http.ResponseWriter, r *http.Request)
 			fmt.Fprintf(w, "%v", `{"_type":"0","val":[]}`)
 			return
 		}
-		vals_str := "["
-		for _, s := range vals {
-			vals_str += `"` + s + `",`
+		if err := this.loadMembers(vals); err != nil {
+			ErrorExcu(w, err)
+			return
 		}
-		vals_str = vals_str[:len(vals_str)-1] + `]`
-		ret := `{"_type":"0","val":` + vals_str + `}`
-		fmt.Fprintf(w, "%v", ret)
+		ErrorNil(w, encodeValues(b64, vals))
 		return
 	}
 
@@ -649,7 +1001,11 @@ func (this *CacheRequestHandler) updateSet(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	key := vars["key0"]
 
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
 	client := this.master_clients[name]
 
@@ -658,58 +1014,79 @@ func (this *CacheRequestHandler) updateSet(w http.ResponseWriter, r *http.Reques
 		ErrorParam(w, `type`)
 		return
 	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
 
 	if action_type == "sadd" {
 		members := r.Form["member"]
-		if members == nil {
+		if members == nil || decodeValues(b64, members) != nil {
 			ErrorParam(w, `member`)
 			return
 		}
+		if err := this.storeMembers(key, members); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
 
 		new_vals := make([]interface{}, len(members))
 		for i, v := range members {
 			new_vals[i] = v
 		}
 
+		done := traceRedis(r, name, "SADD", key)
 		err := client.SAdd(key, new_vals...).Err()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
 		}
 	} else if action_type == "smove" {
 		key_desc := vars["key1"]
-		member := this.GetFormValue(w, r, "member")
+		member, err := decodeValue(b64, this.GetFormValue(w, r, "member"))
 
-		if key_desc == "" || member == "" {
+		if key_desc == "" || member == "" || err != nil {
 			ErrorParam(w, `'key' or 'member'`)
 			return
 		}
 
-		err := client.SMove(key, key_desc, member).Err()
+		_, err = this.moveMember(r, key, key_desc, member)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
 		}
 	} else if action_type == "spop" {
+		done := traceRedis(r, name, "SPOP", key)
 		val, err := client.SPop(key).Result()
+		done(err)
+		if err == nil {
+			val, err = this.decryptValue(val)
+		}
 		if err != nil {
 			ErrorExcu(w, err)
 			return
 		}
-		ErrorNil(w, val)
+		ErrorNil(w, encodeValue(b64, val))
 		return
 	} else if action_type == "srem" {
 		members := r.Form["member"]
-		if members == nil {
+		if members == nil || decodeValues(b64, members) != nil {
 			ErrorParam(w, "member")
 			return
 		}
+		if err := this.storeMembers(key, members); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
 
 		new_vals := make([]interface{}, len(members))
 		for i, v := range members {
 			new_vals[i] = v
 		}
+		done := traceRedis(r, name, "SREM", key)
 		rem_cnt, err := client.SRem(key, new_vals...).Result()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
@@ -725,11 +1102,17 @@ func (this *CacheRequestHandler) delSet(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	name := this.master_hashRing.Get(key)
+	name, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
 	client := this.master_clients[name]
 
-	err := client.Del(key).Err()
+	done := traceRedis(r, name, "DEL", key)
+	err = client.Del(key).Err()
+	done(err)
 	if err != nil {
 		ErrorExcu(w, err)
 	} else {
@@ -777,7 +1160,9 @@ func (this *CacheRequestHandler) RedisDBGet(w http.ResponseWriter, r *http.Reque
 	if ip == "" {
 		fmt.Fprintf(w, "%v", "ERR: Key Empty")
 	}
+	done := traceRedis(r, ip, "DBSIZE", "")
 	val, err := this.master_clients[ip].DbSize().Result()
+	done(err)
 	if err == redis.Nil {
 		fmt.Fprintf(w, "%v", "NIL")
 	} else if err != nil {
@@ -805,11 +1190,17 @@ func (this *CacheRequestHandler) delKey(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	port := this.master_hashRing.Get(key)
+	port, err := this.keyShard(key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 	//	slaver_ip := this.slaver_hashRing[master_ip].Get(key)
 	client := this.master_clients[port]
 
-	err := client.Del(key).Err()
+	done := traceRedis(r, port, "DEL", key)
+	err = client.Del(key).Err()
+	done(err)
 	if err != nil {
 		fmt.Fprintf(w, "%v", fmt.Sprintf(`{"_type":"-1","_msg":%s}`, err.Error()))
 	} else {
@@ -822,12 +1213,58 @@ func (this *CacheRequestHandler) updateKey(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	name := this.master_hashRing.Get(key)
-	client := this.master_clients[name]
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	action_type := this.GetFormValue(w, r, "type")
+	if action_type == "persist" {
+		done := traceRedis(r, name, "PERSIST", key)
+		val, err := client.Persist(key).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
+	} else if action_type == "expireat" {
+		timestamp := this.GetFormValue(w, r, "timestamp")
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			ErrorParam(w, "timestamp")
+			return
+		}
+		done := traceRedis(r, name, "EXPIREAT", key)
+		val, err := client.ExpireAt(key, time.Unix(ts, 0)).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
+	} else if action_type == "rename" {
+		newkey := this.GetFormValue(w, r, "newkey")
+		if newkey == "" {
+			ErrorParam(w, "newkey")
+			return
+		}
+		nx := this.GetFormValue(w, r, "nx") == "1"
+		val, err := this.renameKey(r, key, newkey, nx)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
+	}
 
 	exp := this.GetFormValue(w, r, "expire")
 	if exp != "" {
-		err := this.setExpire(key, exp, client)
+		err := this.setExpire(r, name, key, exp, client)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
@@ -850,18 +1287,77 @@ func (this *CacheRequestHandler) getKey(w http.ResponseWriter, r *http.Request)
 		ErrorParam(w, "type")
 		return
 	}
-	name := this.master_hashRing.Get(key)
-	client := this.master_clients[name]
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
 
 	if action_type == "exists" {
+		done := traceRedis(r, name, "EXISTS", key)
 		val, err := client.Exists(key).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
+	} else if action_type == "type" {
+		done := traceRedis(r, name, "TYPE", key)
+		val, err := client.Type(key).Result()
+		done(err)
 		if err != nil {
 			ErrorExcu(w, err)
 			return
 		}
 		ErrorNil(w, val)
 		return
+	} else if action_type == "encoding" {
+		cmd := redis.NewStringCmd("OBJECT", "ENCODING", key)
+		done := traceRedis(r, name, "OBJECT ENCODING", key)
+		client.Process(cmd)
+		done(cmd.Err())
+		val, err := cmd.Result()
+		if err == redis.Nil {
+			ErrorValNone(w)
+			return
+		} else if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, val)
+		return
 	}
 
-	ErrorNil(w, nil)
+	// Integer replies: -2 means the key does not exist, -1 that it has no
+	// expire (ttl/pttl).
+	var cmd *redis.IntCmd
+	switch action_type {
+	case "ttl":
+		cmd = redis.NewIntCmd("TTL", key)
+	case "pttl":
+		cmd = redis.NewIntCmd("PTTL", key)
+	case "idletime":
+		cmd = redis.NewIntCmd("OBJECT", "IDLETIME", key)
+	case "refcount":
+		cmd = redis.NewIntCmd("OBJECT", "REFCOUNT", key)
+	case "memory":
+		cmd = redis.NewIntCmd("MEMORY", "USAGE", key)
+	default:
+		ErrorNil(w, nil)
+		return
+	}
+	done := traceRedis(r, name, strings.ToUpper(action_type), key)
+	client.Process(cmd)
+	done(cmd.Err())
+	val, err := cmd.Result()
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, val)
 }
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gopkg.in/redis.v4"
+)
+
+const (
+	// Messages buffered per HTTP subscriber; further messages are dropped
+	// until the client catches up.
+	subscriberBuffer = 256
+	// Interval of SSE/WebSocket keepalives and of PINGs on idle shard
+	// subscriptions.
+	pubsubKeepalive = 15 * time.Second
+)
+
+type pubsubMessage struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Payload string `json:"payload"`
+}
+
+type subscriber struct {
+	msgs     chan *pubsubMessage
+	channels []string
+	patterns []string
+	// Shard of each channel, where publish sends it.
+	shards []string
+}
+
+// shardSubscriber holds the one Redis subscription of a shard that every
+// HTTP subscriber of its channels shares. Only the run goroutine touches the
+// redis.PubSub; subscription changes are picked up between reads.
+type shardSubscriber struct {
+	name   string
+	client *redis.Client
+
+	sync.Mutex
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+	// Signalled by add, so an idle run knows to subscribe.
+	wake chan struct{}
+}
+
+func newShardSubscriber(name string, client *redis.Client) *shardSubscriber {
+	s := &shardSubscriber{
+		name:     name,
+		client:   client,
+		channels: make(map[string]map[*subscriber]bool),
+		patterns: make(map[string]map[*subscriber]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+func (s *shardSubscriber) add(set map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	s.Lock()
+	defer s.Unlock()
+	if set[name] == nil {
+		set[name] = make(map[*subscriber]bool)
+	}
+	set[name][sub] = true
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *shardSubscriber) remove(set map[string]map[*subscriber]bool, name string, sub *subscriber) {
+	s.Lock()
+	defer s.Unlock()
+	delete(set[name], sub)
+	if len(set[name]) == 0 {
+		delete(set, name)
+	}
+}
+
+// run keeps the shard subscription alive while anyone is subscribed.
+// Whenever the connection fails, e.g. on a sentinel failover, it is reopened
+// against the current master and all channels and patterns are subscribed
+// again. Redis refuses a SUBSCRIBE without channels, so an idle shard holds
+// no connection and waits for the next add.
+func (s *shardSubscriber) run() {
+	for {
+		s.Lock()
+		channels, _ := diffSubscriptions(s.channels, nil)
+		patterns, _ := diffSubscriptions(s.patterns, nil)
+		s.Unlock()
+		if len(channels) == 0 && len(patterns) == 0 {
+			<-s.wake
+			continue
+		}
+
+		var pubsub *redis.PubSub
+		var err error
+		subscribed := make(map[string]bool)
+		psubscribed := make(map[string]bool)
+		if len(channels) > 0 {
+			pubsub, err = s.client.Subscribe(channels...)
+			for _, c := range channels {
+				subscribed[c] = true
+			}
+		} else {
+			pubsub, err = s.client.PSubscribe(patterns...)
+			for _, p := range patterns {
+				psubscribed[p] = true
+			}
+		}
+		if err == nil {
+			err = s.receive(pubsub, subscribed, psubscribed)
+			pubsub.Close()
+			if err == errPubSubIdle {
+				continue
+			}
+		}
+		logWarn("pubsub resubscribe", "shard", s.name, "err", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// errPubSubIdle ends receive once the shard has no subscribers left.
+var errPubSubIdle = errors.New("no subscribers")
+
+func (s *shardSubscriber) receive(pubsub *redis.PubSub, subscribed, psubscribed map[string]bool) error {
+	last_seen := time.Now()
+	last_ping := time.Now()
+
+	for {
+		if err := s.sync(pubsub, subscribed, psubscribed); err != nil {
+			return err
+		}
+		if len(subscribed) == 0 && len(psubscribed) == 0 {
+			return errPubSubIdle
+		}
+
+		if time.Since(last_ping) > pubsubKeepalive {
+			if time.Since(last_seen) > 3*pubsubKeepalive {
+				return fmt.Errorf("no reply from %s", s.name)
+			}
+			if err := pubsub.Ping(""); err != nil {
+				return err
+			}
+			last_ping = time.Now()
+		}
+
+		msg, err := pubsub.ReceiveTimeout(time.Second)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		last_seen = time.Now()
+
+		if m, ok := msg.(*redis.Message); ok {
+			s.dispatch(m)
+		}
+	}
+}
+
+// sync brings the Redis subscription in line with the wanted channels and
+// patterns.
+func (s *shardSubscriber) sync(pubsub *redis.PubSub, subscribed, psubscribed map[string]bool) error {
+	s.Lock()
+	sub, unsub := diffSubscriptions(s.channels, subscribed)
+	psub, punsub := diffSubscriptions(s.patterns, psubscribed)
+	s.Unlock()
+
+	if len(sub) > 0 {
+		if err := pubsub.Subscribe(sub...); err != nil {
+			return err
+		}
+	}
+	if len(unsub) > 0 {
+		if err := pubsub.Unsubscribe(unsub...); err != nil {
+			return err
+		}
+	}
+	if len(psub) > 0 {
+		if err := pubsub.PSubscribe(psub...); err != nil {
+			return err
+		}
+	}
+	if len(punsub) > 0 {
+		if err := pubsub.PUnsubscribe(punsub...); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range sub {
+		subscribed[c] = true
+	}
+	for _, c := range unsub {
+		delete(subscribed, c)
+	}
+	for _, p := range psub {
+		psubscribed[p] = true
+	}
+	for _, p := range punsub {
+		delete(psubscribed, p)
+	}
+	return nil
+}
+
+func diffSubscriptions(wanted map[string]map[*subscriber]bool, current map[string]bool) ([]string, []string) {
+	add := []string{}
+	del := []string{}
+	for name := range wanted {
+		if !current[name] {
+			add = append(add, name)
+		}
+	}
+	for name := range current {
+		if _, ok := wanted[name]; !ok {
+			del = append(del, name)
+		}
+	}
+	return add, del
+}
+
+func (s *shardSubscriber) dispatch(m *redis.Message) {
+	msg := &pubsubMessage{Channel: m.Channel, Pattern: m.Pattern, Payload: m.Payload}
+
+	s.Lock()
+	defer s.Unlock()
+	subs := s.channels[m.Channel]
+	if m.Pattern != "" {
+		subs = s.patterns[m.Pattern]
+	}
+	for sub := range subs {
+		select {
+		case sub.msgs <- msg:
+		default:
+		}
+	}
+}
+
+// pubsubHub routes channel subscriptions to the shard owning the channel
+// and pattern subscriptions to every shard, since a pattern may match
+// channels anywhere on the ring.
+type pubsubHub struct {
+	handler *CacheRequestHandler
+
+	sync.Mutex
+	shards map[string]*shardSubscriber
+}
+
+func newPubSubHub(handler *CacheRequestHandler) *pubsubHub {
+	return &pubsubHub{
+		handler: handler,
+		shards:  make(map[string]*shardSubscriber),
+	}
+}
+
+func (h *pubsubHub) shard(name string) *shardSubscriber {
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.shards[name]
+	if !ok {
+		s = newShardSubscriber(name, h.handler.master_clients[name])
+		h.shards[name] = s
+	}
+	return s
+}
+
+func (h *pubsubHub) Subscribe(channels, patterns []string) (*subscriber, error) {
+	sub := &subscriber{
+		msgs:     make(chan *pubsubMessage, subscriberBuffer),
+		channels: channels,
+		patterns: patterns,
+		shards:   make([]string, len(channels)),
+	}
+	for i, c := range channels {
+		name, err := h.handler.keyShard(c)
+		if err != nil {
+			return nil, err
+		}
+		sub.shards[i] = name
+	}
+	for i, c := range channels {
+		s := h.shard(sub.shards[i])
+		s.add(s.channels, c, sub)
+	}
+	for _, p := range patterns {
+		for name := range h.handler.master_clients {
+			s := h.shard(name)
+			s.add(s.patterns, p, sub)
+		}
+	}
+	return sub, nil
+}
+
+func (h *pubsubHub) Unsubscribe(sub *subscriber) {
+	for i, c := range sub.channels {
+		s := h.shard(sub.shards[i])
+		s.remove(s.channels, c, sub)
+	}
+	for _, p := range sub.patterns {
+		for name := range h.handler.master_clients {
+			s := h.shard(name)
+			s.remove(s.patterns, p, sub)
+		}
+	}
+}
+
+// curl -d "message=hello" /publish/news
+func (this *CacheRequestHandler) publish(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	channel := mux.Vars(r)["channel"]
+	message := this.GetFormValue(w, r, "message")
+	if message == "" {
+		ErrorParam(w, "message")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, channel)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "PUBLISH", channel)
+	cnt, err := client.Publish(channel, message).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, cnt)
+}
+
+// Streams messages as Server-Sent Events, or over a WebSocket when the
+// request is an upgrade.
+// curl -N "/subscribe?channel=news&pattern=jobs.*"
+func (this *CacheRequestHandler) subscribe(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	channels := r.Form["channel"]
+	patterns := r.Form["pattern"]
+	if len(channels) == 0 && len(patterns) == 0 {
+		ErrorParam(w, "channel' or 'pattern")
+		return
+	}
+
+	sub, err := this.pubsub.Subscribe(channels, patterns)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	defer this.pubsub.Unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		this.serveWebSocket(w, r, sub)
+		return
+	}
+	serveSSE(w, r, sub)
+}
+
+func serveSSE(w http.ResponseWriter, r *http.Request, sub *subscriber) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ErrorExcu(w, fmt.Errorf("streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	io.WriteString(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(pubsubKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-sub.msgs:
+			io.WriteString(w, "event: message\ndata: ")
+			b, _ := json.Marshal(msg)
+			w.Write(b)
+			io.WriteString(w, "\n\n")
+			flusher.Flush()
+		case <-keepalive.C:
+			io.WriteString(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// checkOrigin lets a WebSocket upgrade through when it comes from a page of
+// the server's own host, a configured origin or a client that sends no
+// Origin. Browsers send cookies and the access_token query along with
+// any page's upgrade, so other sites are refused.
+func (this *CacheRequestHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range this.ws_origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *CacheRequestHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *subscriber) {
+	upgrader := wsUpgrader
+	upgrader.CheckOrigin = this.checkOrigin
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The client never sends data; reading only notices the close.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(pubsubKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-sub.msgs:
+			conn.SetWriteDeadline(time.Now().Add(pubsubKeepalive))
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pubsubKeepalive))
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_PubSubDispatch(t *testing.T) {
+	s := &shardSubscriber{
+		name:     "main",
+		channels: make(map[string]map[*subscriber]bool),
+		patterns: make(map[string]map[*subscriber]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	news := &subscriber{msgs: make(chan *pubsubMessage, 4)}
+	jobs := &subscriber{msgs: make(chan *pubsubMessage, 4)}
+	s.add(s.channels, "jobs.a", news)
+	s.add(s.patterns, "jobs.*", jobs)
+
+	// A channel message goes to channel subscribers only, a pattern
+	// message to that pattern's subscribers only.
+	s.dispatch(&redis.Message{Channel: "jobs.a", Payload: "1"})
+	s.dispatch(&redis.Message{Channel: "jobs.a", Pattern: "jobs.*", Payload: "2"})
+	if len(news.msgs) != 1 || len(jobs.msgs) != 1 {
+		t.Fatalf("news got %d, jobs got %d", len(news.msgs), len(jobs.msgs))
+	}
+	if m := <-news.msgs; m.Payload != "1" || m.Pattern != "" {
+		t.Errorf("news got %+v", m)
+	}
+	if m := <-jobs.msgs; m.Payload != "2" || m.Pattern != "jobs.*" {
+		t.Errorf("jobs got %+v", m)
+	}
+
+	s.remove(s.channels, "jobs.a", news)
+	if _, ok := s.channels["jobs.a"]; ok {
+		t.Errorf("jobs.a left after its last subscriber")
+	}
+	s.dispatch(&redis.Message{Channel: "jobs.a", Payload: "3"})
+	if len(news.msgs) != 0 {
+		t.Errorf("removed subscriber got a message")
+	}
+
+	add, del := diffSubscriptions(s.patterns, map[string]bool{"old": true})
+	sort.Strings(add)
+	if strings.Join(add, ",") != "jobs.*" || strings.Join(del, ",") != "old" {
+		t.Errorf("diff added %v, removed %v", add, del)
+	}
+}
+
+func Test_PubSubShard(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+
+	sub, err := handler.pubsub.Subscribe([]string{"news"}, []string{"jobs.*"})
+	if err != nil {
+		t.Fatalf("Subscribe Error:%v", err.Error())
+	}
+	// The shard subscription is set up asynchronously.
+	client := handler.master_clients["main"]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, _ := client.Publish("news", "hello").Result()
+		m, _ := client.Publish("jobs.a", "work").Result()
+		if n > 0 && m > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("shard never subscribed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case m := <-sub.msgs:
+			got[m.Channel+"/"+m.Pattern] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got only %v", got)
+		}
+	}
+	if !got["news/"] || !got["jobs.a/jobs.*"] {
+		t.Errorf("got %v", got)
+	}
+
+	// Without subscribers the shard lets its subscription go.
+	handler.pubsub.Unsubscribe(sub)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		n, _ := client.Publish("news", "hello").Result()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("shard still subscribed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	w := serveTest("/publish/{channel}", "POST", handler.publish, "/publish/news", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "message") {
+		t.Errorf("publish without message answered %d %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_CheckOrigin(t *testing.T) {
+	handler := &CacheRequestHandler{ws_origins: []string{"https://dashboard.example.com/"}}
+	for origin, ok := range map[string]bool{
+		"":                              true,
+		"http://cache.example.com:9090": true,
+		"https://dashboard.example.com": true,
+		"https://evil.example.com":      false,
+		"https://cache.example.com":     false,
+	} {
+		r := httptest.NewRequest("GET", "http://cache.example.com:9090/subscribe?channel=news", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := handler.checkOrigin(r); got != ok {
+			t.Errorf("origin %q: %v", origin, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v4"
+)
+
+// Default for limitInfo.MaxFullRead.
+const defaultMaxFullRead = 10000
+
+// scanArgs reads the cursor, match and count form values of a *SCAN read.
+func (this *CacheRequestHandler) scanArgs(w http.ResponseWriter, r *http.Request) (uint64, string, int64, bool) {
+	cursor := uint64(0)
+	if v := this.GetFormValue(w, r, "cursor"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			ErrorParam(w, "cursor")
+			return 0, "", 0, false
+		}
+		cursor = c
+	}
+
+	count := int64(0)
+	if v := this.GetFormValue(w, r, "count"); v != "" {
+		c, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || c < 0 {
+			ErrorParam(w, "count")
+			return 0, "", 0, false
+		}
+		count = c
+	}
+
+	return cursor, this.GetFormValue(w, r, "match"), count, true
+}
+
+// scanCollection answers one HSCAN/SSCAN/ZSCAN page of key. Hash and zset
+// pages are returned as field->value and member->score objects.
+// curl "/hash?key=test&type=hscan&cursor=0&match=v*&count=100"
+func (this *CacheRequestHandler) scanCollection(w http.ResponseWriter, r *http.Request, shard string, client *redis.Client, key, action_type string) {
+	cursor, match, count, ok := this.scanArgs(w, r)
+	if !ok {
+		return
+	}
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+
+	var cmd *redis.ScanCmd
+	switch action_type {
+	case "hscan":
+		cmd = client.HScan(key, cursor, match, count).ScanCmd
+	case "sscan":
+		cmd = client.SScan(key, cursor, match, count).ScanCmd
+	case "zscan":
+		cmd = client.ZScan(key, cursor, match, count).ScanCmd
+	}
+	done := traceRedis(r, shard, strings.ToUpper(action_type), key)
+	vals, next, err := cmd.Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	if action_type == "sscan" {
+		if err := this.loadMembers(vals); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorScan(w, next, encodeValues(b64, vals))
+		return
+	}
+	// Hash values and zset members may be binary.
+	pairs := make(map[string]string, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		if action_type == "hscan" {
+			v, err := this.loadValue(vals[i+1])
+			if err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+			pairs[vals[i]] = encodeValue(b64, v)
+		} else {
+			pairs[encodeValue(b64, vals[i])] = vals[i+1]
+		}
+	}
+	ErrorScan(w, next, pairs)
+}
+
+// fullReadError is the checkFullRead refusal of a collection too large to
+// read at once.
+type fullReadError struct {
+	kind      string
+	size, max int64
+}
+
+func (e *fullReadError) Error() string {
+	return fmt.Sprintf("%s has %d members (max %d), use cursor reads", e.kind, e.size, e.max)
+}
+
+// checkFullRead refuses HGETALL/SMEMBERS style reads of collections with
+// more than max_full_read members, which would block the shard, with a
+// *fullReadError.
+func (this *CacheRequestHandler) checkFullRead(r *http.Request, shard string, client *redis.Client, key, kind string) error {
+	if this.max_full_read <= 0 {
+		return nil
+	}
+
+	var cmd *redis.IntCmd
+	var op string
+	switch kind {
+	case "hash":
+		cmd, op = client.HLen(key), "HLEN"
+	case "set":
+		cmd, op = client.SCard(key), "SCARD"
+	case "zset":
+		cmd, op = client.ZCard(key), "ZCARD"
+	}
+	done := traceRedis(r, shard, op, key)
+	size, err := cmd.Result()
+	done(err)
+	if err != nil {
+		return err
+	}
+	if size > this.max_full_read {
+		return &fullReadError{kind, size, this.max_full_read}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ScanArgs(t *testing.T) {
+	handler := new(CacheRequestHandler)
+	cases := []struct {
+		query  string
+		cursor uint64
+		match  string
+		count  int64
+		bad    string
+	}{
+		{"", 0, "", 0, ""},
+		{"cursor=42&match=v*&count=100", 42, "v*", 100, ""},
+		{"count=0", 0, "", 0, ""},
+		{"cursor=-1", 0, "", 0, "cursor"},
+		{"cursor=abc", 0, "", 0, "cursor"},
+		{"count=-5", 0, "", 0, "count"},
+		{"count=ten", 0, "", 0, "count"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hash?key=k&type=hscan&"+c.query, nil)
+		r.ParseForm()
+		cursor, match, count, ok := handler.scanArgs(w, r)
+		if c.bad != "" {
+			if ok || !strings.Contains(w.Body.String(), "Param '"+c.bad+"'") {
+				t.Errorf("%q: ok %v reply %s", c.query, ok, w.Body.String())
+			}
+			continue
+		}
+		if !ok || cursor != c.cursor || match != c.match || count != c.count {
+			t.Errorf("%q: %d %q %d %v", c.query, cursor, match, count, ok)
+		}
+	}
+}
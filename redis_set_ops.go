@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/redis.v4"
+)
+
+// Replaces destination with the given members in one step.
+var setStoreScript = NewLuaScript(`
+redis.call('DEL', KEYS[1])
+for i = 1, #ARGV, 1000 do
+	redis.call('SADD', KEYS[1], unpack(ARGV, i, math.min(i + 999, #ARGV)))
+end
+return redis.call('SCARD', KEYS[1])
+`)
+
+// groupKeysByShard groups keys by owning shard, keeping the first
+// appearance order of the shards.
+func (this *CacheRequestHandler) groupKeysByShard(keys []string) ([]string, map[string][]string, error) {
+	names := []string{}
+	groups := make(map[string][]string)
+	for _, key := range keys {
+		name, err := this.keyShard(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], key)
+	}
+	return names, groups, nil
+}
+
+// shardSetOp runs op natively on shard name for keys all owned by it.
+func (this *CacheRequestHandler) shardSetOp(r *http.Request, name, op string, keys []string) ([]string, error) {
+	client := this.master_clients[name]
+	var cmd *redis.StringSliceCmd
+	switch op {
+	case "sinter":
+		cmd = client.SInter(keys...)
+	case "sunion":
+		cmd = client.SUnion(keys...)
+	case "sdiff":
+		cmd = client.SDiff(keys...)
+	default:
+		return nil, fmt.Errorf("Unsupport set op: %s", op)
+	}
+	done := traceRedis(r, name, strings.ToUpper(op), keys[0])
+	members, err := cmd.Result()
+	done(err)
+	return members, err
+}
+
+// setOp computes SINTER/SUNION/SDIFF over keys on any shards. Keys sharing
+// a shard are combined there natively; the per-shard partial results are
+// then combined in the proxy.
+func (this *CacheRequestHandler) setOp(r *http.Request, op string, keys []string) ([]string, error) {
+	if op == "sdiff" {
+		return this.setDiff(r, keys)
+	}
+
+	names, groups, err := this.groupKeysByShard(keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 1 {
+		return this.shardSetOp(r, names[0], op, keys)
+	}
+
+	var result map[string]bool
+	for _, name := range names {
+		members, err := this.shardSetOp(r, name, op, groups[name])
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = make(map[string]bool, len(members))
+			for _, m := range members {
+				result[m] = true
+			}
+			continue
+		}
+		if op == "sunion" {
+			for _, m := range members {
+				result[m] = true
+			}
+			continue
+		}
+		partial := make(map[string]bool, len(members))
+		for _, m := range members {
+			if result[m] {
+				partial[m] = true
+			}
+		}
+		result = partial
+	}
+	return setMembers(result), nil
+}
+
+// setDiff computes the members of keys[0] missing from every other key.
+// Subtrahends colocated with keys[0] go into the native SDIFF, the others
+// are subtracted in the proxy.
+func (this *CacheRequestHandler) setDiff(r *http.Request, keys []string) ([]string, error) {
+	first_name, err := this.keyShard(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	local := []string{keys[0]}
+	remote := []string{}
+	for _, key := range keys[1:] {
+		name, err := this.keyShard(key)
+		if err != nil {
+			return nil, err
+		}
+		if name == first_name {
+			local = append(local, key)
+		} else {
+			remote = append(remote, key)
+		}
+	}
+
+	members, err := this.shardSetOp(r, first_name, "sdiff", local)
+	if err != nil || len(remote) == 0 {
+		return members, err
+	}
+
+	result := make(map[string]bool, len(members))
+	for _, m := range members {
+		result[m] = true
+	}
+	names, groups, err := this.groupKeysByShard(remote)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		others, err := this.shardSetOp(r, name, "sunion", groups[name])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range others {
+			delete(result, m)
+		}
+	}
+	return setMembers(result), nil
+}
+
+// setOpStore stores the result of op over keys into destination on its
+// owning shard and returns the resulting cardinality.
+func (this *CacheRequestHandler) setOpStore(r *http.Request, op, destination string, keys []string) (int64, error) {
+	des_name, des, err := this.keyClient(r, destination)
+	if err != nil {
+		return 0, err
+	}
+	names, _, err := this.groupKeysByShard(keys)
+	if err != nil {
+		return 0, err
+	}
+	if len(names) == 1 && names[0] == des_name {
+		var cmd *redis.IntCmd
+		switch op {
+		case "sinter":
+			cmd = des.SInterStore(destination, keys...)
+		case "sunion":
+			cmd = des.SUnionStore(destination, keys...)
+		case "sdiff":
+			cmd = des.SDiffStore(destination, keys...)
+		}
+		if cmd != nil {
+			done := traceRedis(r, des_name, strings.ToUpper(op)+"STORE", destination)
+			cnt, err := cmd.Result()
+			done(err)
+			return cnt, err
+		}
+	}
+
+	members, err := this.setOp(r, op, keys)
+	if err != nil {
+		return 0, err
+	}
+	if len(members) == 0 {
+		done := traceRedis(r, des_name, "DEL", destination)
+		err := des.Del(destination).Err()
+		done(err)
+		return 0, err
+	}
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	done := traceRedis(r, des_name, "EVALSHA", destination)
+	cnt, err := setStoreScript.Run(des, []string{destination}, args...).Result()
+	done(err)
+	if err != nil {
+		return 0, err
+	}
+	return cnt.(int64), nil
+}
+
+// moveMember is SMOVE across shards: the member is removed from source and
+// added to destination, and put back if the add fails.
+func (this *CacheRequestHandler) moveMember(r *http.Request, source, destination, member string) (bool, error) {
+	src_member, err := this.storeMember(source, member)
+	if err != nil {
+		return false, err
+	}
+	des_member, err := this.storeMember(destination, member)
+	if err != nil {
+		return false, err
+	}
+	src_name, src, err := this.keyClient(r, source)
+	if err != nil {
+		return false, err
+	}
+	des_name, des, err := this.keyClient(r, destination)
+	if err != nil {
+		return false, err
+	}
+	if src_name == des_name && src_member == des_member {
+		done := traceRedis(r, src_name, "SMOVE", source)
+		moved, err := src.SMove(source, destination, src_member).Result()
+		done(err)
+		return moved, err
+	}
+
+	done := traceRedis(r, src_name, "SREM", source)
+	removed, err := src.SRem(source, src_member).Result()
+	done(err)
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	done = traceRedis(r, des_name, "SADD", destination)
+	err = des.SAdd(destination, des_member).Err()
+	done(err)
+	if err != nil {
+		src.SAdd(source, src_member)
+		return false, err
+	}
+	return true, nil
+}
+
+func setMembers(set map[string]bool) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	return members
+}
+
+// curl "/set/ops?type=sinter&key=a&key=b"
+func (this *CacheRequestHandler) getSetOps(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	action_type := this.GetFormValue(w, r, "type")
+	if action_type != "sinter" && action_type != "sunion" && action_type != "sdiff" {
+		ErrorParam(w, "type")
+		return
+	}
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		ErrorParam(w, "key")
+		return
+	}
+
+	vals, err := this.setOp(r, action_type, keys)
+	if err == nil {
+		err = this.loadMembers(vals)
+	}
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, vals)
+}
+
+// curl -d "type=sinterstore&destination=c&key=a&key=b" /set/ops
+func (this *CacheRequestHandler) storeSetOps(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	var op string
+	switch this.GetFormValue(w, r, "type") {
+	case "sinterstore":
+		op = "sinter"
+	case "sunionstore":
+		op = "sunion"
+	case "sdiffstore":
+		op = "sdiff"
+	default:
+		ErrorParam(w, "type")
+		return
+	}
+	destination := this.GetFormValue(w, r, "destination")
+	if destination == "" {
+		ErrorParam(w, "destination")
+		return
+	}
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		ErrorParam(w, "key")
+		return
+	}
+
+	cnt, err := this.setOpStore(r, op, destination, keys)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	exp := this.GetFormValue(w, r, "expire")
+	if exp != "" {
+		des_name, client, err := this.keyClient(r, destination)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		err = this.setExpire(r, des_name, destination, exp, client)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	ErrorNil(w, cnt)
+}
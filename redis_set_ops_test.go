@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_SetDiffAcrossShards(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"s0": {}, "s1": {}}})
+	first, remote := keysApart(t, handler, "diff-")
+	first_name, _ := handler.keyShard(first)
+	local := ""
+	for i := 0; local == "" && i < 1000; i++ {
+		key := fmt.Sprintf("diff-local-%d", i)
+		if name, _ := handler.keyShard(key); name == first_name {
+			local = key
+		}
+	}
+
+	add := func(key string, members ...interface{}) {
+		_, client, _ := handler.keyClient(nil, key)
+		client.SAdd(key, members...)
+	}
+	add(first, "1", "2", "3", "4")
+	add(local, "1")
+	add(remote, "2", "9")
+
+	diff := func(keys ...string) string {
+		members, err := handler.setDiff(nil, keys)
+		if err != nil {
+			t.Fatalf("setDiff %v: %v", keys, err)
+		}
+		sort.Strings(members)
+		return strings.Join(members, ",")
+	}
+	if got := diff(first, local, remote); got != "3,4" {
+		t.Errorf("local and remote: %s", got)
+	}
+	if got := diff(first, local); got != "2,3,4" {
+		t.Errorf("local only: %s", got)
+	}
+	if got := diff(first, remote); got != "1,3,4" {
+		t.Errorf("remote only: %s", got)
+	}
+	if got := diff(remote, first); got != "9" {
+		t.Errorf("reversed: %s", got)
+	}
+}
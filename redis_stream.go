@@ -0,0 +1,548 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+type streamEntry struct {
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+type pendingEntry struct {
+	ID         string `json:"id"`
+	Consumer   string `json:"consumer"`
+	Idle       int64  `json:"idle"`
+	Deliveries int64  `json:"deliveries"`
+}
+
+func replyString(v interface{}) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case []byte:
+		return string(vv)
+	case int64:
+		return strconv.FormatInt(vv, 10)
+	}
+	return ""
+}
+
+func replyInt(v interface{}) int64 {
+	switch vv := v.(type) {
+	case int64:
+		return vv
+	case string:
+		n, _ := strconv.ParseInt(vv, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// parseStreamEntries converts an XRANGE style reply [[id, [f, v, ...]], ...].
+func parseStreamEntries(v interface{}) ([]streamEntry, error) {
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected stream reply %T", v)
+	}
+	entries := make([]streamEntry, 0, len(items))
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			// Entries deleted while pending come back as nil.
+			continue
+		}
+		entry := streamEntry{ID: replyString(pair[0]), Fields: make(map[string]string)}
+		fields, _ := pair[1].([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry.Fields[replyString(fields[i])] = replyString(fields[i+1])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// loadEntries returns the original field values of entries in place.
+func (this *CacheRequestHandler) loadEntries(entries []streamEntry) error {
+	for _, entry := range entries {
+		for f, v := range entry.Fields {
+			s, err := this.loadValue(v)
+			if err != nil {
+				return err
+			}
+			entry.Fields[f] = s
+		}
+	}
+	return nil
+}
+
+// streamCmd runs a stream command on key's shard, traced as part of r.
+func streamCmd(r *http.Request, shard string, client *redis.Client, key string, args ...interface{}) (interface{}, error) {
+	done := traceRedis(r, shard, fmt.Sprint(args[0]), key)
+	cmd := redis.NewCmd(args...)
+	client.Process(cmd)
+	val, err := cmd.Result()
+	done(err)
+	return val, err
+}
+
+// curl -d "field=status&value=pass&field=job&value=42&maxlen=10000&approx=1" /stream/results
+func (this *CacheRequestHandler) addStream(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	fields := r.Form["field"]
+	vals := r.Form["value"]
+	if len(fields) == 0 {
+		ErrorParam(w, "field")
+		return
+	}
+	if len(fields) != len(vals) {
+		ErrorParam(w, "field and value diff")
+		return
+	}
+
+	args := []interface{}{"XADD", key}
+	if maxlen := this.GetFormValue(w, r, "maxlen"); maxlen != "" {
+		n, err := strconv.ParseInt(maxlen, 10, 64)
+		if err != nil || n < 0 {
+			ErrorParam(w, "maxlen")
+			return
+		}
+		args = append(args, "MAXLEN")
+		if this.GetFormValue(w, r, "approx") == "1" {
+			args = append(args, "~")
+		}
+		args = append(args, n)
+	}
+	id := this.GetFormValue(w, r, "id")
+	if id == "" {
+		id = "*"
+	}
+	args = append(args, id)
+	for i, f := range fields {
+		v, err := this.storeValue(key, vals[i])
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		args = append(args, f, v)
+	}
+
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	val, err := streamCmd(r, name, client, key, args...)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, replyString(val))
+}
+
+// curl "/stream/results?type=xrange&start=-&end=+&count=10" | "?type=xlen"
+func (this *CacheRequestHandler) getStream(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	action_type := this.GetFormValue(w, r, "type")
+	if action_type == "xlen" {
+		val, err := streamCmd(r, name, client, key, "XLEN", key)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		ErrorNil(w, replyInt(val))
+		return
+	}
+
+	start := this.GetFormValue(w, r, "start")
+	end := this.GetFormValue(w, r, "end")
+	var args []interface{}
+	if action_type == "xrevrange" {
+		if start == "" {
+			start = "+"
+		}
+		if end == "" {
+			end = "-"
+		}
+		args = []interface{}{"XREVRANGE", key, start, end}
+	} else if action_type == "" || action_type == "xrange" {
+		if start == "" {
+			start = "-"
+		}
+		if end == "" {
+			end = "+"
+		}
+		args = []interface{}{"XRANGE", key, start, end}
+	} else {
+		ErrorParam(w, "type")
+		return
+	}
+
+	count := this.GetFormValue(w, r, "count")
+	if count == "" {
+		count = strconv.FormatInt(this.max_full_read, 10)
+	}
+	n, err := strconv.ParseInt(count, 10, 64)
+	if err != nil {
+		ErrorParam(w, "count")
+		return
+	}
+	if n > 0 {
+		args = append(args, "COUNT", n)
+	}
+
+	val, err := streamCmd(r, name, client, key, args...)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	entries, err := parseStreamEntries(val)
+	if err == nil {
+		err = this.loadEntries(entries)
+	}
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, entries)
+}
+
+// curl -d "group=runners&id=$&mkstream=1" /stream/results/group
+func (this *CacheRequestHandler) createStreamGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	key := mux.Vars(r)["key"]
+	group := this.GetFormValue(w, r, "group")
+	if group == "" {
+		ErrorParam(w, "group")
+		return
+	}
+	id := this.GetFormValue(w, r, "id")
+	if id == "" {
+		id = "$"
+	}
+	args := []interface{}{"XGROUP", "CREATE", key, group, id}
+	if this.GetFormValue(w, r, "mkstream") == "1" {
+		args = append(args, "MKSTREAM")
+	}
+
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if _, err := streamCmd(r, name, client, key, args...); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, nil)
+}
+
+// Destroys the group, or only removes one consumer when "consumer" is set.
+// curl -X DELETE /stream/results/group/runners?consumer=node1
+func (this *CacheRequestHandler) delStreamGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	key := vars["key"]
+	group := vars["group"]
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	args := []interface{}{"XGROUP", "DESTROY", key, group}
+	if consumer := this.GetFormValue(w, r, "consumer"); consumer != "" {
+		args = []interface{}{"XGROUP", "DELCONSUMER", key, group, consumer}
+	}
+	val, err := streamCmd(r, name, client, key, args...)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, replyInt(val))
+}
+
+// XREADGROUP; "block" (ms) long-polls until an entry arrives, the timeout
+// passes or the HTTP client goes away.
+// curl "/stream/results/group/runners?consumer=node1&count=10&block=30000"
+func (this *CacheRequestHandler) readStreamGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	key := vars["key"]
+	group := vars["group"]
+	consumer := this.GetFormValue(w, r, "consumer")
+	if consumer == "" {
+		ErrorParam(w, "consumer")
+		return
+	}
+	id := this.GetFormValue(w, r, "id")
+	if id == "" {
+		id = ">"
+	}
+
+	count := int64(1)
+	if v := this.GetFormValue(w, r, "count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			ErrorParam(w, "count")
+			return
+		}
+		count = n
+	}
+	block := time.Duration(0)
+	if v := this.GetFormValue(w, r, "block"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			ErrorParam(w, "block")
+			return
+		}
+		block = time.Duration(n) * time.Millisecond
+	}
+	noack := this.GetFormValue(w, r, "noack") == "1"
+
+	name, client, err := this.blockClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	val, err := longPoll(r, block, func(wait time.Duration) (interface{}, error) {
+		args := []interface{}{"XREADGROUP", "GROUP", group, consumer, "COUNT", count}
+		if wait > 0 {
+			args = append(args, "BLOCK", int64(wait/time.Millisecond))
+		}
+		if noack {
+			args = append(args, "NOACK")
+		}
+		args = append(args, "STREAMS", key, id)
+		return streamCmd(r, name, client, key, args...)
+	})
+	if err == redis.Nil {
+		ErrorNil(w, []streamEntry{})
+		return
+	} else if err != nil {
+		if r.Context().Err() == nil {
+			ErrorExcu(w, err)
+		}
+		return
+	}
+
+	// [[key, entries]]
+	entries := []streamEntry{}
+	if streams, ok := val.([]interface{}); ok && len(streams) > 0 {
+		if stream, ok := streams[0].([]interface{}); ok && len(stream) == 2 {
+			entries, err = parseStreamEntries(stream[1])
+			if err == nil {
+				err = this.loadEntries(entries)
+			}
+			if err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+		}
+	}
+	ErrorNil(w, entries)
+}
+
+// curl -d "id=1526569495631-0&id=1526569498055-0" /stream/results/group/runners/ack
+func (this *CacheRequestHandler) ackStreamGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	key := vars["key"]
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		ErrorParam(w, "id")
+		return
+	}
+
+	args := []interface{}{"XACK", key, vars["group"]}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	val, err := streamCmd(r, name, client, key, args...)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, replyInt(val))
+}
+
+// Without "start" the XPENDING summary is returned, otherwise the pending
+// entries between start and end, optionally of one consumer.
+// curl "/stream/results/group/runners/pending?start=-&end=+&count=10"
+func (this *CacheRequestHandler) pendingStreamGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	key := vars["key"]
+	group := vars["group"]
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	start := this.GetFormValue(w, r, "start")
+	if start == "" {
+		val, err := streamCmd(r, name, client, key, "XPENDING", key, group)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		summary := map[string]interface{}{}
+		if items, ok := val.([]interface{}); ok && len(items) == 4 {
+			summary["count"] = replyInt(items[0])
+			summary["min"] = replyString(items[1])
+			summary["max"] = replyString(items[2])
+			consumers := map[string]int64{}
+			list, _ := items[3].([]interface{})
+			for _, c := range list {
+				pair, ok := c.([]interface{})
+				if ok && len(pair) == 2 {
+					consumers[replyString(pair[0])] = replyInt(pair[1])
+				}
+			}
+			summary["consumers"] = consumers
+		}
+		ErrorNil(w, summary)
+		return
+	}
+
+	end := this.GetFormValue(w, r, "end")
+	if end == "" {
+		end = "+"
+	}
+	count, err := strconv.ParseInt(this.GetFormValue(w, r, "count"), 10, 64)
+	if err != nil || count <= 0 {
+		ErrorParam(w, "count")
+		return
+	}
+	entries, err := pendingEntries(r, name, client, key, group, start, end, count, this.GetFormValue(w, r, "consumer"))
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, entries)
+}
+
+func pendingEntries(r *http.Request, shard string, client *redis.Client, key, group, start, end string, count int64, consumer string) ([]pendingEntry, error) {
+	args := []interface{}{"XPENDING", key, group, start, end, count}
+	if consumer != "" {
+		args = append(args, consumer)
+	}
+	val, err := streamCmd(r, shard, client, key, args...)
+	if err != nil {
+		return nil, err
+	}
+	items, _ := val.([]interface{})
+	entries := make([]pendingEntry, 0, len(items))
+	for _, item := range items {
+		e, ok := item.([]interface{})
+		if !ok || len(e) != 4 {
+			continue
+		}
+		entries = append(entries, pendingEntry{
+			ID:         replyString(e[0]),
+			Consumer:   replyString(e[1]),
+			Idle:       replyInt(e[2]),
+			Deliveries: replyInt(e[3]),
+		})
+	}
+	return entries, nil
+}
+
+// Claims entries idle for at least min_idle ms for consumer. Without "id"
+// up to "count" of the oldest pending entries past min_idle are claimed,
+// which takes over the work of dead consumers.
+// curl -d "consumer=node2&min_idle=60000&count=10" /stream/results/group/runners/claim
+func (this *CacheRequestHandler) claimStreamGroup(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	key := vars["key"]
+	group := vars["group"]
+	consumer := this.GetFormValue(w, r, "consumer")
+	if consumer == "" {
+		ErrorParam(w, "consumer")
+		return
+	}
+	min_idle, err := strconv.ParseInt(this.GetFormValue(w, r, "min_idle"), 10, 64)
+	if err != nil || min_idle < 0 {
+		ErrorParam(w, "min_idle")
+		return
+	}
+	name, client, err := this.keyClient(r, key)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		count := int64(100)
+		if v := this.GetFormValue(w, r, "count"); v != "" {
+			count, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || count <= 0 {
+				ErrorParam(w, "count")
+				return
+			}
+		}
+		pending, err := pendingEntries(r, name, client, key, group, "-", "+", count, "")
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		for _, p := range pending {
+			if p.Idle >= min_idle {
+				ids = append(ids, p.ID)
+			}
+		}
+		if len(ids) == 0 {
+			ErrorNil(w, []streamEntry{})
+			return
+		}
+	}
+
+	args := []interface{}{"XCLAIM", key, group, consumer, min_idle}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	val, err := streamCmd(r, name, client, key, args...)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	entries, err := parseStreamEntries(val)
+	if err == nil {
+		err = this.loadEntries(entries)
+	}
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, entries)
+}
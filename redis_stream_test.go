@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func Test_ParseStreamEntries(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{"1-0", []interface{}{"status", "pass", "job", []byte("42")}},
+		nil,
+		[]interface{}{[]byte("2-1"), nil},
+	}
+	entries, err := parseStreamEntries(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("entries %+v", entries)
+	}
+	if e := entries[0]; e.ID != "1-0" || e.Fields["status"] != "pass" || e.Fields["job"] != "42" {
+		t.Errorf("first entry %+v", e)
+	}
+	if e := entries[1]; e.ID != "2-1" || len(e.Fields) != 0 {
+		t.Errorf("entry without fields %+v", e)
+	}
+	if _, err := parseStreamEntries("OK"); err == nil {
+		t.Error("status reply parsed as entries")
+	}
+
+	if s := replyString(int64(7)); s != "7" {
+		t.Errorf("replyString %q", s)
+	}
+	if n := replyInt("12"); n != 12 {
+		t.Errorf("replyInt %d", n)
+	}
+}
+
+func Test_StreamIDs(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+
+	add := func(body string) string {
+		return serveTest("/stream/{key}", "POST", handler.addStream, "/stream/results", body).Body.String()
+	}
+	if w := add("id=5-1&field=status&value=pass"); !strings.Contains(w, `"val":"5-1"`) {
+		t.Fatalf("explicit id answered %s", w)
+	}
+	if w := add("id=5-1&field=status&value=again"); !strings.Contains(w, `"_type":"-1"`) {
+		t.Errorf("repeated id answered %s", w)
+	}
+	if w := add("id=bogus&field=status&value=x"); !strings.Contains(w, `"_type":"-1"`) {
+		t.Errorf("malformed id answered %s", w)
+	}
+	if w := add("field=status&value=fail"); strings.Contains(w, `"val":"5-1"`) || !strings.Contains(w, `"_type":"0"`) {
+		t.Errorf("generated id answered %s", w)
+	}
+
+	var reply struct {
+		Val []streamEntry `json:"val"`
+	}
+	w := serveTest("/stream/{key}", "GET", handler.getStream, "/stream/results?start=5-1&end=5-1", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || len(reply.Val) != 1 ||
+		reply.Val[0].ID != "5-1" || reply.Val[0].Fields["status"] != "pass" {
+		t.Errorf("range answered %s", w.Body.String())
+	}
+	w = serveTest("/stream/{key}", "GET", handler.getStream, "/stream/results?type=xrevrange&count=1", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || len(reply.Val) != 1 || reply.Val[0].Fields["status"] != "fail" {
+		t.Errorf("xrevrange answered %s", w.Body.String())
+	}
+}
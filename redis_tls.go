@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	// How often sentinelDialer asks whether the master moved.
+	sentinelCheckInterval = 5 * time.Second
+)
+
+// newMasterClient connects to the master of redis_cfg through its
+// sentinels. The library's failover client can neither use TLS nor
+// authenticate to sentinels, so with either configured the master is looked
+// up on every new connection by sentinelDialer instead, which also closes
+// the pooled connections to a master the sentinels no longer report. A
+// command caught on such a connection is retried once on a new one.
+func newMasterClient(redis_cfg redisInfo, sentinels []string, pool_size int, read_timeout time.Duration) (*redis.Client, error) {
+	if !redis_cfg.Tls && redis_cfg.SentinelPassword == "" {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    redis_cfg.MasterName,
+			SentinelAddrs: sentinels,
+			Password:      redis_cfg.Password,
+			DB:            redis_cfg.Db,
+			PoolSize:      pool_size,
+			ReadTimeout:   read_timeout,
+		}), nil
+	}
+
+	tls_config, err := redisTLSConfig(redis_cfg)
+	if err != nil {
+		return nil, err
+	}
+	d := &sentinelDialer{
+		master:    redis_cfg.MasterName,
+		sentinels: sentinels,
+		password:  redis_cfg.SentinelPassword,
+		tls:       tls_config,
+	}
+	return redis.NewClient(&redis.Options{
+		Dialer:      d.dial,
+		Password:    redis_cfg.Password,
+		DB:          redis_cfg.Db,
+		PoolSize:    pool_size,
+		ReadTimeout: read_timeout,
+		MaxRetries:  1,
+		IdleTimeout: time.Minute,
+	}), nil
+}
+
+func redisTLSConfig(redis_cfg redisInfo) (*tls.Config, error) {
+	if (redis_cfg.TlsCert == "") != (redis_cfg.TlsKey == "") {
+		return nil, fmt.Errorf("tlscert and tlskey go together")
+	}
+	if !redis_cfg.Tls {
+		if redis_cfg.TlsCA != "" || redis_cfg.TlsCert != "" || redis_cfg.TlsServerName != "" {
+			return nil, fmt.Errorf("tls options without tls = true")
+		}
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: redis_cfg.TlsServerName, MinVersion: tls.VersionTLS12}
+	if redis_cfg.TlsCA != "" {
+		pool, err := loadCertPool(redis_cfg.TlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if redis_cfg.TlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(redis_cfg.TlsCert, redis_cfg.TlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+type sentinelDialer struct {
+	master    string
+	sentinels []string
+	password  string
+	// nil dials plain TCP.
+	tls *tls.Config
+
+	mu       sync.Mutex
+	conns    map[*sentinelConn]bool
+	watching bool
+}
+
+// sentinelConn is a connection to the master at addr.
+type sentinelConn struct {
+	net.Conn
+	d    *sentinelDialer
+	addr string
+}
+
+func (c *sentinelConn) Close() error {
+	c.d.mu.Lock()
+	delete(c.d.conns, c)
+	c.d.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (d *sentinelDialer) dialAddr(addr string) (net.Conn, error) {
+	if d.tls == nil {
+		return net.DialTimeout("tcp", addr, redisDialTimeout)
+	}
+	config := d.tls.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: redisDialTimeout}, "tcp", addr, config)
+}
+
+// masterAddr asks the sentinels in turn for the master address.
+func (d *sentinelDialer) masterAddr() (string, error) {
+	err := fmt.Errorf("no sentinel")
+	for _, addr := range d.sentinels {
+		sentinel_addr := addr
+		client := redis.NewClient(&redis.Options{
+			Dialer:   func() (net.Conn, error) { return d.dialAddr(sentinel_addr) },
+			Password: d.password,
+			PoolSize: 1,
+		})
+		cmd := redis.NewStringSliceCmd("SENTINEL", "get-master-addr-by-name", d.master)
+		client.Process(cmd)
+		client.Close()
+
+		vals, cmd_err := cmd.Result()
+		if cmd_err == nil && len(vals) == 2 {
+			return net.JoinHostPort(vals[0], vals[1]), nil
+		}
+		if cmd_err == nil {
+			cmd_err = fmt.Errorf("sentinel %s does not know %s", addr, d.master)
+		}
+		err = cmd_err
+	}
+	return "", err
+}
+
+func (d *sentinelDialer) dial() (net.Conn, error) {
+	addr, err := d.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	cn, err := d.dialAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &sentinelConn{Conn: cn, d: d, addr: addr}
+	d.mu.Lock()
+	if d.conns == nil {
+		d.conns = make(map[*sentinelConn]bool)
+	}
+	d.conns[c] = true
+	if !d.watching {
+		d.watching = true
+		go d.watch()
+	}
+	d.mu.Unlock()
+	return c, nil
+}
+
+// watch checks the master while there are connections, so a closed client
+// leaves no goroutine behind.
+func (d *sentinelDialer) watch() {
+	for {
+		time.Sleep(sentinelCheckInterval)
+		if !d.checkMaster() {
+			return
+		}
+	}
+}
+
+// checkMaster closes the connections to any address but the current
+// master's; the pool drops them on their next use. It returns false, and
+// stops the watch, once no connection is left.
+func (d *sentinelDialer) checkMaster() bool {
+	addr, err := d.masterAddr()
+
+	d.mu.Lock()
+	if len(d.conns) == 0 {
+		d.watching = false
+		d.mu.Unlock()
+		return false
+	}
+	stale := []*sentinelConn{}
+	for c := range d.conns {
+		if err == nil && c.addr != addr {
+			stale = append(stale, c)
+		}
+	}
+	d.mu.Unlock()
+
+	if err != nil {
+		logWarn("sentinel", "master", d.master, "err", err)
+		return true
+	}
+	if len(stale) > 0 {
+		logWarn("sentinel failover", "master", d.master, "addr", addr, "closed", len(stale))
+	}
+	for _, c := range stale {
+		c.Conn.Close()
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_RedisTLSConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	ca_file, _ := ca.write(t, dir, "ca")
+	cert_file, key_file := newTestCert(t, "client", ca).write(t, dir, "client")
+
+	if config, err := redisTLSConfig(redisInfo{}); config != nil || err != nil {
+		t.Errorf("no tls got %v, %v", config, err)
+	}
+	config, err := redisTLSConfig(redisInfo{Tls: true, TlsCA: ca_file, TlsCert: cert_file, TlsKey: key_file, TlsServerName: "redis"})
+	if err != nil {
+		t.Fatalf("redisTLSConfig Error:%v", err.Error())
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 1 || config.ServerName != "redis" {
+		t.Errorf("config %+v", config)
+	}
+
+	bad := []redisInfo{
+		{Tls: true, TlsCert: cert_file},
+		{Tls: true, TlsKey: key_file},
+		{Tls: true, TlsCA: key_file},
+		{Tls: true, TlsCA: filepath.Join(dir, "missing")},
+		{TlsCA: ca_file},
+		{TlsServerName: "redis"},
+	}
+	for _, info := range bad {
+		if _, err := redisTLSConfig(info); err == nil {
+			t.Errorf("%+v should fail", info)
+		}
+	}
+}
+
+// fakeSentinel answers SENTINEL get-master-addr-by-name with master.
+type fakeSentinel struct {
+	net.Listener
+	mu     sync.Mutex
+	master string
+}
+
+func newFakeSentinel(t *testing.T, master string) *fakeSentinel {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSentinel{Listener: l, master: master}
+	go func() {
+		for {
+			cn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(cn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSentinel) serve(cn net.Conn) {
+	defer cn.Close()
+	rd := bufio.NewReader(cn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := []string{}
+		for i := 0; i < n; i++ {
+			rd.ReadString('\n')
+			arg, _ := rd.ReadString('\n')
+			args = append(args, strings.TrimSpace(arg))
+		}
+		if len(args) > 0 && strings.EqualFold(args[0], "SENTINEL") {
+			s.mu.Lock()
+			host, port, _ := net.SplitHostPort(s.master)
+			s.mu.Unlock()
+			fmt.Fprintf(cn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		} else {
+			cn.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+func (s *fakeSentinel) setMaster(addr string) {
+	s.mu.Lock()
+	s.master = addr
+	s.mu.Unlock()
+}
+
+// fakeMaster accepts connections and reports when the client closes one.
+func fakeMaster(t *testing.T) (net.Listener, chan bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan bool, 8)
+	go func() {
+		for {
+			cn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ioutil.ReadAll(cn)
+				closed <- true
+			}()
+		}
+	}()
+	return l, closed
+}
+
+func Test_SentinelFailover(t *testing.T) {
+	old_master, old_closed := fakeMaster(t)
+	defer old_master.Close()
+	new_master, new_closed := fakeMaster(t)
+	defer new_master.Close()
+	sentinel := newFakeSentinel(t, old_master.Addr().String())
+	defer sentinel.Close()
+
+	d := &sentinelDialer{master: "mymaster", sentinels: []string{sentinel.Addr().String()}}
+	cn, err := d.dial()
+	if err != nil {
+		t.Fatalf("dial Error:%v", err.Error())
+	}
+	if !d.checkMaster() {
+		t.Fatalf("watch stopped with a connection open")
+	}
+	select {
+	case <-old_closed:
+		t.Fatalf("connection to the current master closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sentinel.setMaster(new_master.Addr().String())
+	d.checkMaster()
+	select {
+	case <-old_closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection to the old master left open")
+	}
+
+	cn2, err := d.dial()
+	if err != nil {
+		t.Fatalf("dial Error:%v", err.Error())
+	}
+	if sc := cn2.(*sentinelConn); sc.addr != new_master.Addr().String() {
+		t.Errorf("dialed %s", sc.addr)
+	}
+	cn.Close()
+	cn2.Close()
+	<-new_closed
+	if d.checkMaster() {
+		t.Errorf("watch kept running without connections")
+	}
+}
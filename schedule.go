@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// A schedule lives on the shard its name hashes to, like a zset written
+// through setZset:
+//
+//	schedule:<name>:due       zset job id -> due time (ms)
+//	schedule:<name>:jobs      hash job id -> job JSON
+//	schedule:<name>:attempts  hash job id -> failed deliveries
+//	schedule:<name>:dead      hash job id -> job JSON, once it failed
+//	                          [schedule] maxattempts times in a row
+//
+// schedule:names on every shard lists its schedules for the mover. A failed
+// delivery is retried when its lease runs out. Webhooks only go to the
+// hosts in [schedule] webhookhosts.
+const (
+	scheduleNamesKey           = "schedule:names"
+	scheduleMoveInterval       = time.Second
+	scheduleMoveBatch          = 100
+	scheduleLease              = time.Minute
+	scheduleWebhookTimeout     = 10 * time.Second
+	scheduleMaxDeliveries      = 16
+	defaultScheduleMaxAttempts = 5
+)
+
+type scheduleInfo struct {
+	// Hosts webhooks may be sent to; ".example.com" also allows its
+	// subdomains. No webhook is allowed when empty.
+	WebhookHosts []string
+	// Failed deliveries before a job is dead; 0 uses the default.
+	MaxAttempts int64
+}
+
+type scheduledJob struct {
+	ID      string `json:"id"`
+	Value   string `json:"value"`
+	Queue   string `json:"queue,omitempty"`
+	Webhook string `json:"webhook,omitempty"`
+	Cron    string `json:"cron,omitempty"`
+	Due     int64  `json:"due,omitempty"`
+}
+
+func scheduleKey(name, part string) string {
+	return "schedule:" + name + ":" + part
+}
+
+// KEYS: due, jobs, schedule:names. ARGV: name, id, job, due ms, "XX" or "".
+var scheduleScript = NewLuaScript(`
+if ARGV[5] == 'XX' and redis.call('HEXISTS', KEYS[2], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('SADD', KEYS[3], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[2], ARGV[3])
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[2])
+return 1
+`)
+
+// Leases due jobs to the caller by moving their score to the lease end, so
+// a mover that dies before delivering leaves them to be picked up again.
+// KEYS: due, jobs. ARGV: now ms, lease end ms, limit.
+// Returns id, job, id, job...
+var claimScript = NewLuaScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local out = {}
+for _, id in ipairs(ids) do
+	local job = redis.call('HGET', KEYS[2], id)
+	if job then
+		redis.call('ZADD', KEYS[1], ARGV[2], id)
+		table.insert(out, id)
+		table.insert(out, job)
+	else
+		redis.call('ZREM', KEYS[1], id)
+	end
+end
+return out
+`)
+
+// Completes a delivered job unless it was rescheduled or cancelled since
+// it was claimed. KEYS: due, jobs, attempts. ARGV: id, lease end ms, next
+// due ms or "".
+var finishScript = NewLuaScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HDEL', KEYS[3], ARGV[1])
+if ARGV[3] == '' then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('HDEL', KEYS[2], ARGV[1])
+else
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+end
+return 1
+`)
+
+// Counts a failed delivery of a claimed job, moving the job to the dead
+// hash once it failed max times; it is otherwise retried after its lease.
+// KEYS: due, jobs, attempts, dead. ARGV: id, lease end ms, max.
+// Returns the failures so far, 0 when the job changed since it was claimed.
+var failScript = NewLuaScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+	return 0
+end
+local n = redis.call('HINCRBY', KEYS[3], ARGV[1], 1)
+if n >= tonumber(ARGV[3]) then
+	local job = redis.call('HGET', KEYS[2], ARGV[1])
+	if job then
+		redis.call('HSET', KEYS[4], ARGV[1], job)
+	end
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('HDEL', KEYS[3], ARGV[1])
+end
+return n
+`)
+
+// scheduleMover hands due jobs to their ready queue or webhook. Delivery is
+// at least once: a job is only completed, or moved to its next cron time,
+// after the queue push or webhook call succeeded.
+func (this *CacheRequestHandler) scheduleMover() {
+	deliveries := make(chan struct{}, scheduleMaxDeliveries)
+	for range time.Tick(scheduleMoveInterval) {
+		for shard, client := range this.master_clients {
+			names, err := client.SMembers(scheduleNamesKey).Result()
+			if err != nil {
+				logError("schedule mover", "shard", shard, "err", err)
+				continue
+			}
+			for _, name := range names {
+				if err := this.moveDueJobs(client, name, deliveries); err != nil {
+					logError("schedule mover", "schedule", name, "err", err)
+				}
+			}
+		}
+	}
+}
+
+func (this *CacheRequestHandler) moveDueJobs(client *redis.Client, name string, deliveries chan struct{}) error {
+	now := time.Now()
+	lease := msTime(now.Add(scheduleLease))
+	keys := []string{scheduleKey(name, "due"), scheduleKey(name, "jobs"), scheduleKey(name, "attempts"), scheduleKey(name, "dead")}
+	val, err := claimScript.Run(client, keys[:2], msTime(now), lease, scheduleMoveBatch).Result()
+	if err != nil {
+		return err
+	}
+
+	items, _ := val.([]interface{})
+	for i := 0; i+1 < len(items); i += 2 {
+		job := scheduledJob{}
+		if err := json.Unmarshal([]byte(replyString(items[i+1])), &job); err != nil {
+			logError("schedule bad job", "schedule", name, "job", replyString(items[i]), "err", err)
+			continue
+		}
+		job.ID = replyString(items[i])
+
+		deliveries <- struct{}{}
+		go func(job scheduledJob) {
+			defer func() { <-deliveries }()
+			if err := this.deliverJob(name, job); err != nil {
+				logError("schedule job", "schedule", name, "job", job.ID, "err", err)
+				n, err := failScript.Run(client, keys, job.ID, lease, this.schedule.MaxAttempts).Result()
+				if err != nil {
+					logError("schedule job", "schedule", name, "job", job.ID, "err", err)
+				} else if replyInt(n) >= this.schedule.MaxAttempts {
+					logWarn("schedule job dead", "schedule", name, "job", job.ID, "attempts", replyInt(n))
+				}
+				return
+			}
+			next := ""
+			if job.Cron != "" {
+				if cron, err := parseCron(job.Cron); err == nil {
+					if t := cron.Next(time.Now()); !t.IsZero() {
+						next = strconv.FormatInt(msTime(t), 10)
+					}
+				}
+			}
+			err := finishScript.Run(client, keys[:3], job.ID, lease, next).Err()
+			if err != nil {
+				logError("schedule job", "schedule", name, "job", job.ID, "err", err)
+			}
+		}(job)
+	}
+	return nil
+}
+
+func (this *CacheRequestHandler) deliverJob(name string, job scheduledJob) error {
+	if job.Queue != "" {
+		_, err := this.pushQueue(nil, job.Queue, job.Value)
+		return err
+	}
+
+	// Checked again as the allowlist may have changed since scheduling.
+	if err := this.checkWebhook(job.Webhook); err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{"schedule": name, "id": job.ID, "value": job.Value})
+	client := http.Client{
+		Timeout: scheduleWebhookTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return this.checkWebhook(req.URL.String())
+		},
+	}
+	res, err := client.Post(job.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", job.Webhook, res.Status)
+	}
+	return nil
+}
+
+// checkWebhook refuses webhook URLs that are not http(s) to a host in
+// [schedule] webhookhosts.
+func (this *CacheRequestHandler) checkWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook scheme '%s' not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range this.schedule.WebhookHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook host '%s' not allowed", host)
+}
+
+// jobDue works out the due time from "at" (unix seconds), "delay" (seconds
+// from now) or, failing both, the next run of the cron expression.
+func (this *CacheRequestHandler) jobDue(w http.ResponseWriter, r *http.Request, cron_spec string) (int64, bool) {
+	if at := this.GetFormValue(w, r, "at"); at != "" {
+		secs, err := strconv.ParseFloat(at, 64)
+		if err != nil {
+			ErrorParam(w, "at")
+			return 0, false
+		}
+		return int64(secs * 1000), true
+	}
+	if delay := this.GetFormValue(w, r, "delay"); delay != "" {
+		secs, err := strconv.ParseFloat(delay, 64)
+		if err != nil || secs < 0 {
+			ErrorParam(w, "delay")
+			return 0, false
+		}
+		return msTime(time.Now()) + int64(secs*1000), true
+	}
+	if cron_spec != "" {
+		cron, err := parseCron(cron_spec)
+		if err != nil {
+			ErrorExcu(w, err)
+			return 0, false
+		}
+		next := cron.Next(time.Now())
+		if next.IsZero() {
+			ErrorParam(w, "cron")
+			return 0, false
+		}
+		return msTime(next), true
+	}
+	ErrorParam(w, "at' or 'delay' or 'cron")
+	return 0, false
+}
+
+// Schedules "value" for the work queue "queue" or a POST to "webhook", at a
+// time given by "at"/"delay" and/or recurring on "cron".
+// curl -d "value=nightly&queue=tests&cron=0 2 * * *" /schedule/builds
+func (this *CacheRequestHandler) addSchedule(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	job := scheduledJob{
+		Value:   this.GetFormValue(w, r, "value"),
+		Queue:   this.GetFormValue(w, r, "queue"),
+		Webhook: this.GetFormValue(w, r, "webhook"),
+		Cron:    this.GetFormValue(w, r, "cron"),
+	}
+	if (job.Queue == "") == (job.Webhook == "") {
+		ErrorParam(w, "queue' or 'webhook")
+		return
+	}
+	if job.Webhook != "" {
+		if err := this.checkWebhook(job.Webhook); err != nil {
+			replyStatus(w, http.StatusForbidden)
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	if job.Cron != "" {
+		if _, err := parseCron(job.Cron); err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+	}
+	due, ok := this.jobDue(w, r, job.Cron)
+	if !ok {
+		return
+	}
+
+	job.ID = newItemID()
+	if err := this.saveJob(r, name, job, due, false); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, job.ID)
+}
+
+func (this *CacheRequestHandler) saveJob(r *http.Request, name string, job scheduledJob, due int64, exists bool) error {
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		return err
+	}
+	// Id and due time are kept in the hash field and zset score.
+	id := job.ID
+	job.ID = ""
+	job.Due = 0
+	b, _ := json.Marshal(job)
+
+	xx := ""
+	if exists {
+		xx = "XX"
+	}
+	keys := []string{scheduleKey(name, "due"), scheduleKey(name, "jobs"), scheduleNamesKey}
+	done := traceRedis(r, shard, "EVALSHA", keys[0])
+	val, err := scheduleScript.Run(client, keys, name, id, string(b), due, xx).Result()
+	done(err)
+	if err != nil {
+		return err
+	}
+	if replyInt(val) == 0 {
+		return redis.Nil
+	}
+	return nil
+}
+
+func (this *CacheRequestHandler) loadJob(r *http.Request, name, id string) (scheduledJob, error) {
+	job := scheduledJob{}
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		return job, err
+	}
+	done := traceRedis(r, shard, "HGET", scheduleKey(name, "jobs"))
+	val, err := client.HGet(scheduleKey(name, "jobs"), id).Result()
+	done(err)
+	if err != nil {
+		return job, err
+	}
+	if err := json.Unmarshal([]byte(val), &job); err != nil {
+		return job, err
+	}
+	job.ID = id
+
+	done = traceRedis(r, shard, "ZSCORE", scheduleKey(name, "due"))
+	due, err := client.ZScore(scheduleKey(name, "due"), id).Result()
+	done(err)
+	if err != nil && err != redis.Nil {
+		return job, err
+	}
+	job.Due = int64(due)
+	return job, nil
+}
+
+// curl /schedule/builds/{id}
+func (this *CacheRequestHandler) getSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	job, err := this.loadJob(r, vars["name"], vars["id"])
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, job)
+}
+
+// Lists the next "count" jobs by due time.
+// curl "/schedule/builds?count=20"
+func (this *CacheRequestHandler) listSchedule(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	count := int64(scheduleMoveBatch)
+	if v := this.GetFormValue(w, r, "count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			ErrorParam(w, "count")
+			return
+		}
+		count = n
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "ZRANGE", scheduleKey(name, "due"))
+	due, err := client.ZRangeWithScores(scheduleKey(name, "due"), 0, count-1).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	jobs := []scheduledJob{}
+	if len(due) > 0 {
+		ids := make([]string, len(due))
+		for i, z := range due {
+			ids[i] = z.Member.(string)
+		}
+		done := traceRedis(r, shard, "HMGET", scheduleKey(name, "jobs"))
+		vals, err := client.HMGet(scheduleKey(name, "jobs"), ids...).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		for i, v := range vals {
+			job := scheduledJob{}
+			json.Unmarshal([]byte(replyString(v)), &job)
+			job.ID = ids[i]
+			job.Due = int64(due[i].Score)
+			jobs = append(jobs, job)
+		}
+	}
+	ErrorNil(w, jobs)
+}
+
+// Moves the job to a new "at"/"delay" time and/or replaces its "cron".
+// curl -X PUT -d "delay=600" /schedule/builds/{id}
+func (this *CacheRequestHandler) updateSchedule(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	vars := mux.Vars(r)
+	name := vars["name"]
+	job, err := this.loadJob(r, name, vars["id"])
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	if _, ok := r.Form["cron"]; ok {
+		job.Cron = this.GetFormValue(w, r, "cron")
+		if job.Cron != "" {
+			if _, err := parseCron(job.Cron); err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+		}
+	}
+	due, ok := this.jobDue(w, r, job.Cron)
+	if !ok {
+		return
+	}
+
+	err = this.saveJob(r, name, job, due, true)
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, nil)
+}
+
+// curl -X DELETE /schedule/builds/{id}
+func (this *CacheRequestHandler) delSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	id := vars["id"]
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	done := traceRedis(r, shard, "ZREM", scheduleKey(name, "due"))
+	err = client.ZRem(scheduleKey(name, "due"), id).Err()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "HDEL", scheduleKey(name, "jobs"))
+	val, err := client.HDel(scheduleKey(name, "jobs"), id).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "HDEL", scheduleKey(name, "attempts"))
+	done(client.HDel(scheduleKey(name, "attempts"), id).Err())
+	ErrorNil(w, val)
+}
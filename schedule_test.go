@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_CheckWebhook(t *testing.T) {
+	handler := &CacheRequestHandler{schedule: scheduleInfo{WebhookHosts: []string{"ci.example.com", ".hooks.example.com"}}}
+	for webhook, ok := range map[string]bool{
+		"https://ci.example.com/build":          true,
+		"http://CI.example.com:8080/build":      true,
+		"https://a.hooks.example.com/x":         true,
+		"https://hooks.example.com/x":           false,
+		"https://evilhooks.example.com/x":       false,
+		"http://169.254.169.254/latest":         false,
+		"file:///etc/passwd":                    false,
+		"https://ci.example.com.evil.org/build": false,
+	} {
+		if err := handler.checkWebhook(webhook); (err == nil) != ok {
+			t.Errorf("%s: %v", webhook, err)
+		}
+	}
+	if err := new(CacheRequestHandler).checkWebhook("https://ci.example.com/build"); err == nil {
+		t.Errorf("webhook allowed without an allowlist")
+	}
+}
+
+func Test_ScheduleDeadJob(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+	handler.schedule = scheduleInfo{WebhookHosts: []string{"127.0.0.1"}, MaxAttempts: 2}
+
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hook.Close()
+
+	w := serveTest("/schedule/{name}", "POST", handler.addSchedule, "/schedule/builds", "value=v&delay=0&webhook=http://10.0.0.1/x")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("webhook outside the allowlist: %d %s", w.Code, w.Body.String())
+	}
+	w = serveTest("/schedule/{name}", "POST", handler.addSchedule, "/schedule/builds", "value=v&delay=0&webhook="+hook.URL)
+	if !strings.Contains(w.Body.String(), `"_type":"0"`) {
+		t.Fatalf("schedule: %s", w.Body.String())
+	}
+
+	_, client, _ := handler.keyClient(nil, "builds")
+	deliveries := make(chan struct{}, 1)
+	for i := 0; i < 2; i++ {
+		// Make the leased job due again rather than wait for the lease.
+		for _, id := range client.ZRange(scheduleKey("builds", "due"), 0, -1).Val() {
+			client.ZAdd(scheduleKey("builds", "due"), redis.Z{Score: 0, Member: id})
+		}
+		if err := handler.moveDueJobs(client, "builds", deliveries); err != nil {
+			t.Fatalf("moveDueJobs Error:%v", err.Error())
+		}
+		// Waits for the delivery to finish.
+		deliveries <- struct{}{}
+		<-deliveries
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("%d webhook calls", n)
+	}
+	if client.ZCard(scheduleKey("builds", "due")).Val() != 0 || client.HLen(scheduleKey("builds", "jobs")).Val() != 0 {
+		t.Errorf("dead job still scheduled")
+	}
+	if client.HLen(scheduleKey("builds", "dead")).Val() != 1 || client.Exists(scheduleKey("builds", "attempts")).Val() {
+		t.Errorf("job not moved to the dead hash")
+	}
+}
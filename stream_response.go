@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v4"
+)
+
+// SCAN COUNT hint used per page when streaming a collection.
+const streamPageSize = 1000
+
+// collectionStream writes a collection as it is scanned, either as one
+// chunked JSON document ({"_type":"0","val":[...]} or {...} for hashes and
+// zsets) or as NDJSON with one element per line. Each SCAN page is flushed
+// before the next one is fetched, so the proxy never holds more than a page.
+type collectionStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ndjson  bool
+	pairs   bool
+	n       int
+}
+
+func newCollectionStream(w http.ResponseWriter, ndjson, pairs bool) *collectionStream {
+	s := &collectionStream{w: w, ndjson: ndjson, pairs: pairs}
+	s.flusher, _ = w.(http.Flusher)
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return s
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if pairs {
+		io.WriteString(w, `{"_type":"0", "val":{`)
+	} else {
+		io.WriteString(w, `{"_type":"0", "val":[`)
+	}
+	return s
+}
+
+func (s *collectionStream) writeJSON(v interface{}) {
+	b, _ := json.Marshal(v)
+	s.w.Write(b)
+}
+
+// Member writes one set member.
+func (s *collectionStream) Member(member string) {
+	if !s.ndjson && s.n > 0 {
+		io.WriteString(s.w, ",")
+	}
+	s.writeJSON(member)
+	if s.ndjson {
+		io.WriteString(s.w, "\n")
+	}
+	s.n++
+}
+
+// Pair writes one hash field or zset member with its value or score.
+func (s *collectionStream) Pair(field, value string) {
+	if s.ndjson {
+		s.writeJSON(map[string]string{"field": field, "value": value})
+		io.WriteString(s.w, "\n")
+		s.n++
+		return
+	}
+	if s.n > 0 {
+		io.WriteString(s.w, ",")
+	}
+	s.writeJSON(field)
+	io.WriteString(s.w, ":")
+	s.writeJSON(value)
+	s.n++
+}
+
+func (s *collectionStream) Flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// Close ends the document. An error after the response has started is
+// reported in a trailing "_msg" (JSON) or a final error line (NDJSON).
+func (s *collectionStream) Close(err error) {
+	if s.ndjson {
+		if err != nil {
+			s.writeJSON(map[string]string{"_type": "-1", "_msg": err.Error()})
+			io.WriteString(s.w, "\n")
+		}
+		s.Flush()
+		return
+	}
+
+	if s.pairs {
+		io.WriteString(s.w, "}")
+	} else {
+		io.WriteString(s.w, "]")
+	}
+	if err != nil {
+		io.WriteString(s.w, `, "_error":true, "_msg":`)
+		s.writeJSON(err.Error())
+	}
+	io.WriteString(s.w, ", \"count\":\""+strconv.Itoa(s.n)+"\"}")
+	s.Flush()
+}
+
+// streamCollection streams the whole hash, set or zset at key by iterating
+// its SCAN cursor. As with any SCAN, an element may be repeated if the
+// collection is resized while it is read.
+// curl "/set?key=big&stream=1" | "/hash?key=big&format=ndjson"
+func (this *CacheRequestHandler) streamCollection(w http.ResponseWriter, r *http.Request, shard string, client *redis.Client, key, kind string) {
+	match := this.GetFormValue(w, r, "match")
+	ndjson := this.GetFormValue(w, r, "format") == "ndjson"
+	b64, ok := this.base64Param(w, r)
+	if !ok {
+		return
+	}
+	s := newCollectionStream(w, ndjson, kind != "set")
+
+	cursor := uint64(0)
+	for {
+		var cmd *redis.ScanCmd
+		switch kind {
+		case "hash":
+			cmd = client.HScan(key, cursor, match, streamPageSize).ScanCmd
+		case "set":
+			cmd = client.SScan(key, cursor, match, streamPageSize).ScanCmd
+		case "zset":
+			cmd = client.ZScan(key, cursor, match, streamPageSize).ScanCmd
+		}
+		done := traceRedis(r, shard, strings.ToUpper(kind[:1])+"SCAN", key)
+		vals, next, err := cmd.Result()
+		done(err)
+		if err != nil {
+			s.Close(err)
+			return
+		}
+
+		switch kind {
+		case "set":
+			for _, v := range vals {
+				v, err := this.decryptValue(v)
+				if err != nil {
+					s.Close(err)
+					return
+				}
+				s.Member(encodeValue(b64, v))
+			}
+		case "hash":
+			for i := 0; i+1 < len(vals); i += 2 {
+				v, err := this.loadValue(vals[i+1])
+				if err != nil {
+					s.Close(err)
+					return
+				}
+				s.Pair(vals[i], encodeValue(b64, v))
+			}
+		case "zset":
+			for i := 0; i+1 < len(vals); i += 2 {
+				s.Pair(encodeValue(b64, vals[i]), vals[i+1])
+			}
+		}
+		s.Flush()
+
+		if next == 0 {
+			break
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+		cursor = next
+	}
+	s.Close(nil)
+}
+
+// wantStream reports whether a full read of key should be streamed: on
+// request, or when the collection is above max_full_read. false for ok
+// means the size check failed and the reply was sent.
+func (this *CacheRequestHandler) wantStream(w http.ResponseWriter, r *http.Request, shard string, client *redis.Client, key, kind string) (bool, bool) {
+	if this.GetFormValue(w, r, "stream") == "1" || this.GetFormValue(w, r, "format") == "ndjson" {
+		return true, true
+	}
+	err := this.checkFullRead(r, shard, client, key, kind)
+	if _, ok := err.(*fullReadError); ok {
+		return true, true
+	} else if err != nil {
+		ErrorExcu(w, err)
+		return false, false
+	}
+	return false, true
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_WantStream(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}, "child0": {}}})
+	handler.max_full_read = 2
+	clientOf := func(key string) *redis.Client {
+		_, client, _ := handler.keyClient(nil, key)
+		return client
+	}
+	clientOf("small").SAdd("small", "a")
+	clientOf("big").SAdd("big", "a", "b", "c")
+	clientOf("text").Set("text", "not a set", 0)
+
+	cases := []struct {
+		target, key  string
+		stream, ok   bool
+		reply_substr string
+	}{
+		{"/set?key=small", "small", false, true, ""},
+		{"/set?key=small&stream=1", "small", true, true, ""},
+		{"/set?key=big", "big", true, true, ""},
+		{"/set?key=text", "text", false, false, "WRONGTYPE"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.ParseForm()
+		shard, client, _ := handler.keyClient(r, c.key)
+		stream, ok := handler.wantStream(w, r, shard, client, c.key, "set")
+		if stream != c.stream || ok != c.ok || !strings.Contains(w.Body.String(), c.reply_substr) {
+			t.Errorf("%s: stream %v ok %v reply %s", c.target, stream, ok, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// Requests are traced when [tracing] has an OTLP endpoint. A W3C
+// traceparent header continues the caller's trace (and its sampling
+// decision); other requests start a trace sampled at SampleRate, and with
+// SampleRate 0 nothing is traced. Each request gets a server span named
+// after its route, with child spans for the Redis commands handlers report
+// with traceRedis.
+// Finished spans are batched and POSTed as OTLP/HTTP JSON.
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 8192
+
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+type tracingInfo struct {
+	// OTLP/HTTP traces URL, e.g. "http://127.0.0.1:4318/v1/traces".
+	Endpoint string
+	// Defaults to "fxqa-cache".
+	ServiceName string
+	// Share of new traces sampled, 1 for all; 0 turns tracing off.
+	SampleRate float64
+	// Key attribute on Redis spans: "hash" (default), "plain" or "redact".
+	Keys string
+}
+
+type tracer struct {
+	info  tracingInfo
+	spans chan *span
+	http  *http.Client
+}
+
+type span struct {
+	tracer   *tracer
+	trace_id string
+	span_id  string
+	parent   string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+}
+
+type spanKey struct{}
+
+func newTracer(info tracingInfo) (*tracer, error) {
+	switch info.Keys {
+	case "":
+		info.Keys = "hash"
+	case "hash", "plain", "redact":
+	default:
+		return nil, fmt.Errorf("bad keys '%s'", info.Keys)
+	}
+	if info.ServiceName == "" {
+		info.ServiceName = "fxqa-cache"
+	}
+	if info.SampleRate <= 0 || info.SampleRate > 1 {
+		return nil, fmt.Errorf("samplerate out of range")
+	}
+	t := &tracer{
+		info:  info,
+		spans: make(chan *span, traceQueueSize),
+		http:  &http.Client{Timeout: 10 * time.Second},
+	}
+	go t.exportLoop()
+	return t, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sampled(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(1<<30))
+	return float64(n.Int64()) < rate*(1<<30)
+}
+
+// parseTraceparent returns the trace id, parent span id and sampled flag
+// of a W3C traceparent header.
+func parseTraceparent(h string) (string, string, bool, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	for _, p := range parts[1:4] {
+		if _, err := hex.DecodeString(p); err != nil {
+			return "", "", false, false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2]), flags&1 == 1, true
+}
+
+func (t *tracer) startSpan(trace_id, parent, name string, kind int) *span {
+	return &span{
+		tracer:   t,
+		trace_id: trace_id,
+		span_id:  randomHex(8),
+		parent:   parent,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    make(map[string]interface{}),
+	}
+}
+
+// child starts a span under s; a nil span has nil children.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.startSpan(s.trace_id, s.span_id, name, kind)
+}
+
+func (s *span) set(key string, val interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = val
+	s.mu.Unlock()
+}
+
+// finish ends s, marking it failed with err, and queues it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil && err != redis.Nil {
+		s.err = err.Error()
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		// Collector too slow; drop rather than block requests.
+	}
+}
+
+// requestSpan returns the span of r, nil when untraced or r is nil.
+func requestSpan(r *http.Request) *span {
+	if r == nil {
+		return nil
+	}
+	s, _ := r.Context().Value(spanKey{}).(*span)
+	return s
+}
+
+// traceRedis starts a span for cmd on shard within the request's trace;
+// the returned func ends it. r is nil for background work. The shard also
+// goes in the request log and the command in the latency metrics.
+func traceRedis(r *http.Request, shard, cmd, key string) func(error) {
+	noteShard(r, shard)
+	start := time.Now()
+	observe := func() {
+		redisCommandMetrics.observe(commandLabels{shard, cmd}, time.Since(start))
+	}
+	parent := requestSpan(r)
+	if parent == nil {
+		return func(error) { observe() }
+	}
+	s := parent.child("redis "+cmd, spanKindClient)
+	s.set("db.system", "redis")
+	s.set("db.operation", cmd)
+	s.set("cache.shard", shard)
+	if key != "" {
+		s.set("cache.key", parent.tracer.keyAttr(key))
+	}
+	return func(err error) {
+		observe()
+		s.finish(err)
+	}
+}
+
+func (t *tracer) keyAttr(key string) string {
+	return redactKey(t.info.Keys, key)
+}
+
+// redactKey shows key as configured for traces and the audit log:
+// "plain", "redact" or, by default, a digest that still tells keys apart.
+func redactKey(mode, key string) string {
+	switch mode {
+	case "plain":
+		return key
+	case "redact":
+		return "redacted"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// trace wraps next in a server span per request, named after the route of
+// router the request ended up on.
+func (this *CacheRequestHandler) trace(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := this.tracer
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		trace_id, parent, is_sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if !ok {
+			trace_id, parent, is_sampled = randomHex(16), "", sampled(t.info.SampleRate)
+		}
+		if !is_sampled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s := t.startSpan(trace_id, parent, "HTTP "+r.Method, spanKindServer)
+		s.set("http.method", r.Method)
+		if id := requestID(r); id != "" {
+			s.set("http.request_id", id)
+		}
+		w.Header().Set("traceparent", "00-"+s.trace_id+"-"+s.span_id+"-01")
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+
+		// Matched again after any namespace rewrite.
+		route := routeOf(router, r)
+		s.name = "HTTP " + r.Method + " " + route
+		s.set("http.route", route)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		s.set("http.status_code", sw.code)
+		var err error
+		if sw.code >= 500 {
+			err = fmt.Errorf("%s", http.StatusText(sw.code))
+		}
+		s.finish(err)
+	})
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]interface{}) []otlpAttr {
+	out := make([]otlpAttr, 0, len(attrs))
+	for k, v := range attrs {
+		var val otlpValue
+		switch x := v.(type) {
+		case int:
+			s := strconv.Itoa(x)
+			val.IntValue = &s
+		default:
+			s := fmt.Sprint(x)
+			val.StringValue = &s
+		}
+		out = append(out, otlpAttr{Key: k, Value: val})
+	}
+	return out
+}
+
+// otlpJSON encodes spans as an OTLP ExportTraceServiceRequest.
+func (t *tracer) otlpJSON(spans []*span) ([]byte, error) {
+	out := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		m := map[string]interface{}{
+			"traceId":           s.trace_id,
+			"spanId":            s.span_id,
+			"name":              s.name,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.kind != 0 {
+			m["kind"] = s.kind
+		}
+		if s.parent != "" {
+			m["parentSpanId"] = s.parent
+		}
+		if s.err != "" {
+			m["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+		out[i] = m
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs(map[string]interface{}{"service.name": t.info.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "fxqa-cache"},
+				"spans": out,
+			}},
+		}},
+	})
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := t.otlpJSON(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := t.http.Post(t.info.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (t *tracer) exportLoop() {
+	batch := make([]*span, 0, traceBatchSize)
+	tick := time.NewTicker(traceFlushInterval)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			logError("trace export", "err", err)
+		}
+		batch = make([]*span, 0, traceBatchSize)
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
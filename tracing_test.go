@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func Test_ParseTraceparent(t *testing.T) {
+	trace_id, parent, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || trace_id != "4bf92f3577b34da6a3ce929d0e0e4736" || parent != "00f067aa0ba902b7" || !sampled {
+		t.Errorf("got %s %s %v %v", trace_id, parent, sampled, ok)
+	}
+	if _, _, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sampled {
+		t.Errorf("unsampled: %v %v", sampled, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok := parseTraceparent(bad); ok {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func Test_NewTracer(t *testing.T) {
+	for _, info := range []tracingInfo{
+		{Endpoint: "http://collector:4318", SampleRate: 0},
+		{Endpoint: "http://collector:4318", SampleRate: 1.5},
+		{Endpoint: "http://collector:4318", SampleRate: 1, Keys: "all"},
+	} {
+		if _, err := newTracer(info); err == nil {
+			t.Errorf("accepted %+v", info)
+		}
+	}
+
+	// Background work has no request and is never traced.
+	done := traceRedis(nil, "main", "GET", "user:1")
+	done(nil)
+}
+
+func Test_TraceSpans(t *testing.T) {
+	// No endpoint: the export loop is not started, spans stay queued.
+	tr := &tracer{info: tracingInfo{ServiceName: "fxqa-cache", Keys: "hash"}, spans: make(chan *span, 16)}
+	this := &CacheRequestHandler{tracer: tr}
+
+	router := mux.NewRouter()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done := traceRedis(r, "main", "GET", "user:1")
+		done(nil)
+	})
+
+	req := httptest.NewRequest("GET", "/string/user:1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	this.trace(router, next).ServeHTTP(w, req)
+
+	if !strings.HasPrefix(w.Header().Get("traceparent"), "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Errorf("traceparent %q", w.Header().Get("traceparent"))
+	}
+	spans := map[string]*span{}
+	for len(tr.spans) > 0 {
+		s := <-tr.spans
+		name := s.name
+		if s.kind == spanKindServer {
+			// Named after the route when the router knows it.
+			name = "server"
+		}
+		spans[name] = s
+	}
+	server, cmd := spans["server"], spans["redis GET"]
+	if server == nil || cmd == nil || len(spans) != 2 {
+		t.Fatalf("spans %v", spans)
+	}
+	if server.parent != "00f067aa0ba902b7" || cmd.parent != server.span_id {
+		t.Errorf("parents %s %s", server.parent, cmd.parent)
+	}
+	if k := cmd.attrs["cache.key"]; k == "user:1" || len(k.(string)) != 16 {
+		t.Errorf("key attr %v", k)
+	}
+
+	body, err := tr.otlpJSON([]*span{server, cmd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req_body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceId      string
+					ParentSpanId string
+					Kind         int
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &req_body); err != nil {
+		t.Fatal(err)
+	}
+	got := req_body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(got) != 2 || got[0].TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || got[0].Kind != spanKindServer || got[1].Kind != spanKindClient {
+		t.Errorf("otlp %s", body)
+	}
+
+	// Unsampled callers are not traced.
+	req = httptest.NewRequest("GET", "/string/user:1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	this.trace(router, next).ServeHTTP(httptest.NewRecorder(), req)
+	if len(tr.spans) != 0 {
+		t.Errorf("%d spans for an unsampled request", len(tr.spans))
+	}
+}
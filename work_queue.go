@@ -0,0 +1,711 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/redis.v4"
+)
+
+// A queue lives entirely on the shard its name hashes to:
+//
+//	queue:<name>:ready                 list of waiting item ids
+//	queue:<name>:processing:<consumer> ids handed to a consumer
+//	queue:<name>:deadline              zset id -> visibility deadline (ms)
+//	queue:<name>:owner                 hash id -> consumer holding it
+//	queue:<name>:items                 hash id -> payload
+//	queue:<name>:attempts              hash id -> deliveries so far
+//	queue:<name>:dead                  list of dead-lettered ids
+//	queue:<name>:consumers             set of consumers seen
+//	queue:<name>:conf                  hash max_attempts, visibility (s)
+//
+// queue:names on every shard lists its queues for the reaper.
+const (
+	queueNamesKey          = "queue:names"
+	defaultQueueAttempts   = 5
+	defaultQueueVisibility = 30 * time.Second
+	queueReapInterval      = time.Second
+	queueReapBatch         = 100
+)
+
+func queueKey(name, part string) string {
+	return "queue:" + name + ":" + part
+}
+
+func processingKey(name, consumer string) string {
+	return queueKey(name, "processing:"+consumer)
+}
+
+// KEYS: ready, items, queue:names. ARGV: name, id, payload, id, payload...
+var enqueueScript = NewLuaScript(`
+redis.call('SADD', KEYS[3], ARGV[1])
+for i = 2, #ARGV, 2 do
+	redis.call('HSET', KEYS[2], ARGV[i], ARGV[i + 1])
+	redis.call('LPUSH', KEYS[1], ARGV[i])
+end
+return redis.call('LLEN', KEYS[1])
+`)
+
+// KEYS: ready, processing, deadline, items, attempts, owner, consumers.
+// ARGV: deadline ms, consumer.
+var dequeueScript = NewLuaScript(`
+while true do
+	local id = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not id then
+		return false
+	end
+	local payload = redis.call('HGET', KEYS[4], id)
+	if payload then
+		local attempts = redis.call('HINCRBY', KEYS[5], id, 1)
+		redis.call('ZADD', KEYS[3], ARGV[1], id)
+		redis.call('HSET', KEYS[6], id, ARGV[2])
+		redis.call('SADD', KEYS[7], ARGV[2])
+		return {id, payload, attempts}
+	end
+	-- purged while waiting
+	redis.call('LREM', KEYS[2], -1, id)
+end
+`)
+
+// KEYS: processing, deadline, items, attempts, owner. ARGV: id, consumer.
+var ackScript = NewLuaScript(`
+if redis.call('HGET', KEYS[5], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('LREM', KEYS[1], -1, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+return 1
+`)
+
+// Takes an item back from its consumer: requeued, or dead-lettered once it
+// used up max_attempts or when forced. With a "now" argument (reaper) only
+// items past their deadline are released.
+// KEYS: processing, deadline, owner, attempts, ready, dead.
+// ARGV: id, consumer, max_attempts, force dead ("1"), now ms or "".
+// Returns 0 not held, 1 requeued, 2 dead-lettered.
+var releaseScript = NewLuaScript(`
+if redis.call('HGET', KEYS[3], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+if ARGV[5] ~= '' then
+	local deadline = redis.call('ZSCORE', KEYS[2], ARGV[1])
+	if not deadline or tonumber(deadline) > tonumber(ARGV[5]) then
+		return 0
+	end
+end
+redis.call('LREM', KEYS[1], -1, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+local attempts = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0')
+if ARGV[4] == '1' or attempts >= tonumber(ARGV[3]) then
+	redis.call('LPUSH', KEYS[6], ARGV[1])
+	return 2
+end
+redis.call('RPUSH', KEYS[5], ARGV[1])
+return 1
+`)
+
+// KEYS: deadline, owner. ARGV: id, consumer, deadline ms.
+var extendScript = NewLuaScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// KEYS: dead, ready, attempts. ARGV: count.
+var redriveScript = NewLuaScript(`
+local n = 0
+while n < tonumber(ARGV[1]) do
+	local id = redis.call('RPOPLPUSH', KEYS[1], KEYS[2])
+	if not id then
+		break
+	end
+	redis.call('HDEL', KEYS[3], id)
+	n = n + 1
+end
+return n
+`)
+
+type queueItem struct {
+	ID       string `json:"id"`
+	Value    string `json:"value"`
+	Attempts int64  `json:"attempts"`
+}
+
+func newItemID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36) + "-" + hex.EncodeToString(b)
+}
+
+func msTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// queueConf returns the max delivery attempts and visibility timeout of the
+// queue, falling back to the defaults.
+func queueConf(client *redis.Client, name string) (int64, time.Duration, error) {
+	vals, err := client.HMGet(queueKey(name, "conf"), "max_attempts", "visibility").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	max_attempts := int64(defaultQueueAttempts)
+	visibility := defaultQueueVisibility
+	if n := replyInt(vals[0]); n > 0 {
+		max_attempts = n
+	}
+	if n := replyInt(vals[1]); n > 0 {
+		visibility = time.Duration(n) * time.Second
+	}
+	return max_attempts, visibility, nil
+}
+
+// queueReaper requeues, or dead-letters, items whose consumer did not ack
+// them within the visibility timeout.
+func (this *CacheRequestHandler) queueReaper() {
+	for range time.Tick(queueReapInterval) {
+		for shard, client := range this.master_clients {
+			names, err := client.SMembers(queueNamesKey).Result()
+			if err != nil {
+				logError("queue reaper", "shard", shard, "err", err)
+				continue
+			}
+			for _, name := range names {
+				if err := reapQueue(client, name); err != nil {
+					logError("queue reaper", "queue", name, "err", err)
+				}
+			}
+		}
+	}
+}
+
+func reapQueue(client *redis.Client, name string) error {
+	now := msTime(time.Now())
+	ids, err := client.ZRangeByScore(queueKey(name, "deadline"), redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: queueReapBatch,
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	max_attempts, _, err := queueConf(client, name)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		consumer, err := client.HGet(queueKey(name, "owner"), id).Result()
+		if err == redis.Nil {
+			client.ZRem(queueKey(name, "deadline"), id)
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = releaseItem(client, name, id, consumer, max_attempts, false, strconv.FormatInt(now, 10))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseItem(client *redis.Client, name, id, consumer string, max_attempts int64, dead bool, now string) error {
+	force := "0"
+	if dead {
+		force = "1"
+	}
+	keys := []string{
+		processingKey(name, consumer),
+		queueKey(name, "deadline"),
+		queueKey(name, "owner"),
+		queueKey(name, "attempts"),
+		queueKey(name, "ready"),
+		queueKey(name, "dead"),
+	}
+	return releaseScript.Run(client, keys, id, consumer, max_attempts, force, now).Err()
+}
+
+// curl -d "value=job1&value=job2" /queue/tests
+func (this *CacheRequestHandler) enqueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	vals := r.Form["value"]
+	if len(vals) == 0 {
+		ErrorParam(w, "value")
+		return
+	}
+
+	ids, err := this.pushQueue(r, name, vals...)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, ids)
+}
+
+// pushQueue adds vals to the queue on its shard and returns their item ids.
+// Items are stored like values of the key name.
+func (this *CacheRequestHandler) pushQueue(r *http.Request, name string, vals ...string) ([]string, error) {
+	ids := make([]string, len(vals))
+	args := []interface{}{name}
+	for i, v := range vals {
+		v, err := this.storeValue(name, v)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = newItemID()
+		args = append(args, ids[i], v)
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{queueKey(name, "ready"), queueKey(name, "items"), queueNamesKey}
+	done := traceRedis(r, shard, "EVALSHA", keys[0])
+	err = enqueueScript.Run(client, keys, args...).Err()
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// curl -X PUT -d "max_attempts=3&visibility=60" /queue/tests
+func (this *CacheRequestHandler) configQueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	conf := map[string]string{}
+	for _, field := range []string{"max_attempts", "visibility"} {
+		v := this.GetFormValue(w, r, field)
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n <= 0 {
+			ErrorParam(w, field)
+			return
+		}
+		conf[field] = v
+	}
+	if len(conf) == 0 {
+		ErrorParam(w, "max_attempts' or 'visibility")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "HMSET", queueKey(name, "conf"))
+	err = client.HMSet(queueKey(name, "conf"), conf).Err()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "SADD", queueNamesKey)
+	done(client.SAdd(queueNamesKey, name).Err())
+	ErrorNil(w, nil)
+}
+
+// Hands the oldest item to consumer, which must ack it within the
+// visibility timeout ("visibility" seconds overrides the queue's). Waits up
+// to "timeout" seconds for an item.
+// curl -d "consumer=runner1&timeout=30" /queue/tests/dequeue
+func (this *CacheRequestHandler) dequeue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	consumer := this.GetFormValue(w, r, "consumer")
+	if consumer == "" {
+		ErrorParam(w, "consumer")
+		return
+	}
+	timeout, ok := this.pollTimeout(w, r)
+	if !ok {
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	block := this.block_clients[shard]
+	done := traceRedis(r, shard, "HMGET", queueKey(name, "conf"))
+	_, visibility, err := queueConf(client, name)
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if v := this.GetFormValue(w, r, "visibility"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			ErrorParam(w, "visibility")
+			return
+		}
+		visibility = time.Duration(n) * time.Second
+	}
+
+	keys := []string{
+		queueKey(name, "ready"),
+		processingKey(name, consumer),
+		queueKey(name, "deadline"),
+		queueKey(name, "items"),
+		queueKey(name, "attempts"),
+		queueKey(name, "owner"),
+		queueKey(name, "consumers"),
+	}
+	claim := func() (interface{}, error) {
+		deadline := msTime(time.Now().Add(visibility))
+		done := traceRedis(r, shard, "EVALSHA", keys[0])
+		val, err := dequeueScript.Run(client, keys, deadline, consumer).Result()
+		done(err)
+		return val, err
+	}
+	val, err := longPoll(r, timeout, func(wait time.Duration) (interface{}, error) {
+		val, err := claim()
+		if err != redis.Nil || wait == 0 {
+			return val, err
+		}
+		// Wait for an item with a BLMOVE from the tail of the ready list
+		// back onto it, which leaves the list as it was, then claim it.
+		// Every waiting consumer wakes; those that lose it wait again.
+		cmd := redis.NewCmd("BLMOVE", keys[0], keys[0], "RIGHT", "RIGHT", blockSeconds(wait))
+		done := traceRedis(r, shard, "BLMOVE", keys[0])
+		block.Process(cmd)
+		done(cmd.Err())
+		if err := cmd.Err(); err != nil {
+			return nil, err
+		}
+		return claim()
+	})
+	if err == redis.Nil {
+		ErrorValNone(w)
+		return
+	} else if err != nil {
+		if r.Context().Err() == nil {
+			ErrorExcu(w, err)
+		}
+		return
+	}
+
+	item := queueItem{}
+	if vals, ok := val.([]interface{}); ok && len(vals) == 3 {
+		item = queueItem{ID: replyString(vals[0]), Value: replyString(vals[1]), Attempts: replyInt(vals[2])}
+	}
+	if item.Value, err = this.loadValue(item.Value); err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, item)
+}
+
+// curl -d "consumer=runner1&id=..." /queue/tests/ack
+func (this *CacheRequestHandler) ackQueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	consumer := this.GetFormValue(w, r, "consumer")
+	id := this.GetFormValue(w, r, "id")
+	if consumer == "" || id == "" {
+		ErrorParam(w, "consumer' or 'id")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	keys := []string{
+		processingKey(name, consumer),
+		queueKey(name, "deadline"),
+		queueKey(name, "items"),
+		queueKey(name, "attempts"),
+		queueKey(name, "owner"),
+	}
+	done := traceRedis(r, shard, "EVALSHA", keys[0])
+	val, err := ackScript.Run(client, keys, id, consumer).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, replyInt(val) == 1)
+}
+
+// Gives the item back for redelivery, or to the dead-letter queue with
+// "dead=1" or once max_attempts deliveries failed.
+// curl -d "consumer=runner1&id=...&dead=1" /queue/tests/nack
+func (this *CacheRequestHandler) nackQueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	consumer := this.GetFormValue(w, r, "consumer")
+	id := this.GetFormValue(w, r, "id")
+	if consumer == "" || id == "" {
+		ErrorParam(w, "consumer' or 'id")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "HMGET", queueKey(name, "conf"))
+	max_attempts, _, err := queueConf(client, name)
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	dead := this.GetFormValue(w, r, "dead") == "1"
+	done = traceRedis(r, shard, "EVALSHA", processingKey(name, consumer))
+	err = releaseItem(client, name, id, consumer, max_attempts, dead, "")
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, nil)
+}
+
+// Pushes the item's deadline "visibility" seconds from now, for consumers
+// working longer than the visibility timeout.
+// curl -d "consumer=runner1&id=...&visibility=60" /queue/tests/extend
+func (this *CacheRequestHandler) extendQueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	consumer := this.GetFormValue(w, r, "consumer")
+	id := this.GetFormValue(w, r, "id")
+	if consumer == "" || id == "" {
+		ErrorParam(w, "consumer' or 'id")
+		return
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "HMGET", queueKey(name, "conf"))
+	_, visibility, err := queueConf(client, name)
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	if v := this.GetFormValue(w, r, "visibility"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			ErrorParam(w, "visibility")
+			return
+		}
+		visibility = time.Duration(n) * time.Second
+	}
+
+	keys := []string{queueKey(name, "deadline"), queueKey(name, "owner")}
+	done = traceRedis(r, shard, "EVALSHA", keys[0])
+	val, err := extendScript.Run(client, keys, id, consumer, msTime(time.Now().Add(visibility))).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, replyInt(val) == 1)
+}
+
+// curl /queue/tests
+func (this *CacheRequestHandler) getQueue(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	done := traceRedis(r, shard, "HMGET", queueKey(name, "conf"))
+	max_attempts, visibility, err := queueConf(client, name)
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "LLEN", queueKey(name, "ready"))
+	ready, err := client.LLen(queueKey(name, "ready")).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "ZCARD", queueKey(name, "deadline"))
+	inflight, err := client.ZCard(queueKey(name, "deadline")).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "LLEN", queueKey(name, "dead"))
+	dead, err := client.LLen(queueKey(name, "dead")).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	ErrorNil(w, map[string]int64{
+		"ready":        ready,
+		"inflight":     inflight,
+		"dead":         dead,
+		"max_attempts": max_attempts,
+		"visibility":   int64(visibility / time.Second),
+	})
+}
+
+// curl "/queue/tests/dead?start=0&end=99"
+func (this *CacheRequestHandler) getDeadQueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	start, end := int64(0), int64(queueReapBatch-1)
+	if v := this.GetFormValue(w, r, "start"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			ErrorParam(w, "start")
+			return
+		}
+		start = n
+	}
+	if v := this.GetFormValue(w, r, "end"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			ErrorParam(w, "end")
+			return
+		}
+		end = n
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done := traceRedis(r, shard, "LRANGE", queueKey(name, "dead"))
+	ids, err := client.LRange(queueKey(name, "dead"), start, end).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	items := []queueItem{}
+	if len(ids) > 0 {
+		done := traceRedis(r, shard, "HMGET", queueKey(name, "items"))
+		vals, err := client.HMGet(queueKey(name, "items"), ids...).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		done = traceRedis(r, shard, "HMGET", queueKey(name, "attempts"))
+		attempts, err := client.HMGet(queueKey(name, "attempts"), ids...).Result()
+		done(err)
+		if err != nil {
+			ErrorExcu(w, err)
+			return
+		}
+		for i, id := range ids {
+			v, err := this.loadValue(replyString(vals[i]))
+			if err != nil {
+				ErrorExcu(w, err)
+				return
+			}
+			items = append(items, queueItem{ID: id, Value: v, Attempts: replyInt(attempts[i])})
+		}
+	}
+	ErrorNil(w, items)
+}
+
+// Moves up to "count" dead-lettered items back to the queue with their
+// attempts reset.
+// curl -d "count=100" /queue/tests/dead/requeue
+func (this *CacheRequestHandler) redriveQueue(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(32 << 20)
+
+	name := mux.Vars(r)["name"]
+	count := int64(queueReapBatch)
+	if v := this.GetFormValue(w, r, "count"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			ErrorParam(w, "count")
+			return
+		}
+		count = n
+	}
+
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	keys := []string{queueKey(name, "dead"), queueKey(name, "ready"), queueKey(name, "attempts")}
+	done := traceRedis(r, shard, "EVALSHA", keys[0])
+	val, err := redriveScript.Run(client, keys, count).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	ErrorNil(w, replyInt(val))
+}
+
+// curl -X DELETE /queue/tests
+func (this *CacheRequestHandler) delQueue(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	shard, client, err := this.keyClient(r, name)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+
+	done := traceRedis(r, shard, "SMEMBERS", queueKey(name, "consumers"))
+	consumers, err := client.SMembers(queueKey(name, "consumers")).Result()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	keys := []string{}
+	for _, c := range consumers {
+		keys = append(keys, processingKey(name, c))
+	}
+	for _, part := range []string{"ready", "deadline", "owner", "items", "attempts", "dead", "consumers", "conf"} {
+		keys = append(keys, queueKey(name, part))
+	}
+	done = traceRedis(r, shard, "DEL", keys[0])
+	err = client.Del(keys...).Err()
+	done(err)
+	if err != nil {
+		ErrorExcu(w, err)
+		return
+	}
+	done = traceRedis(r, shard, "SREM", queueNamesKey)
+	done(client.SRem(queueNamesKey, name).Err())
+	ErrorNil(w, nil)
+}
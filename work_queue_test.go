@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+func Test_QueueRedelivery(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+	_, client, _ := handler.keyClient(nil, "jobs")
+
+	serveTest("/queue/{name}", "PUT", handler.configQueue, "/queue/jobs", "max_attempts=2&visibility=60")
+	serveTest("/queue/{name}", "POST", handler.enqueue, "/queue/jobs", "value=build")
+
+	dequeue := func(consumer string) queueItem {
+		w := serveTest("/queue/{name}/dequeue", "POST", handler.dequeue, "/queue/jobs/dequeue", "consumer="+consumer)
+		var reply struct {
+			Val queueItem `json:"val"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Val.ID == "" {
+			t.Fatalf("dequeue answered %s", w.Body.String())
+		}
+		return reply.Val
+	}
+	nack := func(consumer, id, extra string) {
+		serveTest("/queue/{name}/nack", "POST", handler.nackQueue, "/queue/jobs/nack", "consumer="+consumer+"&id="+id+extra)
+	}
+	counts := func() map[string]int64 {
+		w := serveTest("/queue/{name}", "GET", handler.getQueue, "/queue/jobs", "")
+		var reply struct {
+			Val map[string]int64 `json:"val"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply.Val
+	}
+
+	item := dequeue("c1")
+	if item.Value != "build" || item.Attempts != 1 {
+		t.Fatalf("first delivery %+v", item)
+	}
+	// Only the holder can give an item back.
+	nack("c2", item.ID, "")
+	if c := counts(); c["inflight"] != 1 || c["ready"] != 0 {
+		t.Errorf("nack by another consumer: %v", c)
+	}
+	nack("c1", item.ID, "")
+	if c := counts(); c["inflight"] != 0 || c["ready"] != 1 {
+		t.Errorf("after nack: %v", c)
+	}
+
+	// A consumer that misses the visibility deadline loses the item to
+	// the reaper, and the last allowed delivery ends up dead-lettered.
+	item = dequeue("c1")
+	if item.Attempts != 2 {
+		t.Errorf("second delivery %+v", item)
+	}
+	client.ZAdd(queueKey("jobs", "deadline"), redis.Z{Score: 1, Member: item.ID})
+	if err := reapQueue(client, "jobs"); err != nil {
+		t.Fatal(err)
+	}
+	if c := counts(); c["inflight"] != 0 || c["ready"] != 0 || c["dead"] != 1 {
+		t.Errorf("after reaping the last attempt: %v", c)
+	}
+
+	w := serveTest("/queue/{name}/dead/requeue", "POST", handler.redriveQueue, "/queue/jobs/dead/requeue", "count=10")
+	if c := counts(); c["ready"] != 1 || c["dead"] != 0 {
+		t.Errorf("redrive answered %s, counts %v", w.Body.String(), c)
+	}
+	item = dequeue("c1")
+	if item.Attempts != 1 {
+		t.Errorf("redriven delivery %+v", item)
+	}
+	nack("c1", item.ID, "&dead=1")
+	w = serveTest("/queue/{name}/dead", "GET", handler.getDeadQueue, "/queue/jobs/dead", "")
+	var dead struct {
+		Val []queueItem `json:"val"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &dead); err != nil || len(dead.Val) != 1 || dead.Val[0].Value != "build" {
+		t.Errorf("forced dead letter: %s", w.Body.String())
+	}
+}
+
+func Test_QueueDequeueWaits(t *testing.T) {
+	handler := testHandler(t, cacheConfig{Redis: map[string]redisInfo{"main": {}}})
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		serveTest("/queue/{name}", "POST", handler.enqueue, "/queue/jobs", "value=build")
+	}()
+	start := time.Now()
+	w := serveTest("/queue/{name}/dequeue", "POST", handler.dequeue, "/queue/jobs/dequeue", "consumer=c1&timeout=5")
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("dequeue took %v", took)
+	}
+	var reply struct {
+		Val queueItem `json:"val"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.Val.Value != "build" {
+		t.Fatalf("dequeue answered %s", w.Body.String())
+	}
+	_, client, _ := handler.keyClient(nil, "jobs")
+	if n, _ := client.LLen(queueKey("jobs", "ready")).Result(); n != 0 {
+		t.Errorf("ready list holds %d after the dequeue", n)
+	}
+}